@@ -0,0 +1,82 @@
+package doom
+
+// WriteBatch groups Put, Delete and Merge operations that are written to the DB atomically: after a crash either all of
+// them are found or none. Operations can go to any column family of the DB. The zero value is an empty batch ready to
+// use
+type WriteBatch struct {
+	ops   blockBuilder
+	count int
+
+	// merges counts the merge operands of the default column family. families are the other column families written
+	// by the batch, set to true for the ones that have merge operands
+	merges   int
+	families map[*ColumnFamily]bool
+}
+
+// Put adds the write of 'value' for 'key' to the batch
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.add(nil, RECORD_VALUE, key, value)
+}
+
+// PutCF adds the write of 'value' for 'key' of the column family 'cf' to the batch
+func (b *WriteBatch) PutCF(cf *ColumnFamily, key string, value []byte) {
+	b.add(cf, RECORD_VALUE, key, value)
+}
+
+// Delete adds the removal of 'key' to the batch
+func (b *WriteBatch) Delete(key string) {
+	b.add(nil, RECORD_TOMBSTONE, key, nil)
+}
+
+// DeleteCF adds the removal of 'key' of the column family 'cf' to the batch
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key string) {
+	b.add(cf, RECORD_TOMBSTONE, key, nil)
+}
+
+// add adds an operation of type 't' to the batch. A nil 'cf' is the default column family
+func (b *WriteBatch) add(cf *ColumnFamily, t byte, key string, value []byte) {
+	b.count++
+
+	if cf == nil || cf.id == DEFAULT_COLUMN_FAMILY_ID {
+		b.ops.add(t, key, value)
+		if t == RECORD_MERGE {
+			b.merges++
+		}
+		return
+	}
+
+	b.ops.add(RECORD_COLUMN_FAMILY, familyKey(cf.id, t, key), value)
+	if b.families == nil {
+		b.families = make(map[*ColumnFamily]bool)
+	}
+	b.families[cf] = b.families[cf] || t == RECORD_MERGE
+}
+
+// Clear removes every operation from the batch so it can be reused
+func (b *WriteBatch) Clear() {
+	b.ops.reset()
+	b.count, b.merges, b.families = 0, 0, nil
+}
+
+// Count returns the number of operations of the batch
+func (b *WriteBatch) Count() int {
+	return b.count
+}
+
+// size returns the number of bytes of the encoded operations of the batch
+func (b *WriteBatch) size() int {
+	return b.ops.len()
+}
+
+// append adds the operations of 'other' after the ones of the batch
+func (b *WriteBatch) append(other *WriteBatch) {
+	b.ops.buf = append(b.ops.buf, other.ops.buf...)
+	b.count += other.count
+	b.merges += other.merges
+	for cf, merges := range other.families {
+		if b.families == nil {
+			b.families = make(map[*ColumnFamily]bool)
+		}
+		b.families[cf] = b.families[cf] || merges
+	}
+}
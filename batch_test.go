@@ -0,0 +1,106 @@
+package doom
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("deleted", []byte("value"))
+
+	var b WriteBatch
+	b.Put("a", []byte("first"))
+	b.Put("b", []byte("value"))
+	b.Delete("deleted")
+	b.Put("a", []byte("second"))
+
+	if b.Count() != 4 {
+		t.Errorf("Expected 4 operations, got %d", b.Count())
+	}
+
+	if err = db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *DB) {
+		if value, err := db.Get("a"); err != nil || string(value) != "second" {
+			t.Errorf("Expected the last write of the batch to win, got '%s' (%v)", value, err)
+		}
+		if value, err := db.Get("b"); err != nil || string(value) != "value" {
+			t.Errorf("Expected 'value', got '%s' (%v)", value, err)
+		}
+		if _, err := db.Get("deleted"); err != ErrNotFound {
+			t.Errorf("Expected the key to be deleted by the batch, got %v", err)
+		}
+	}
+
+	t.Run("applied", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("recovered from the WAL", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = Open(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		check(t, db)
+
+		if db.seq != 5 {
+			t.Errorf("Expected the last sequence to be 5, got %d", db.seq)
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		b.Clear()
+		if b.Count() != 0 {
+			t.Errorf("Expected an empty batch, got %d operations", b.Count())
+		}
+
+		if err := db.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTornWriteBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	var b WriteBatch
+	b.Put("a", []byte("value"))
+	b.Put("b", []byte("value"))
+
+	single := encodeRecord(&Entry{Key: "single", Data: []byte("value"), Seq: 1})
+	batch := encodeBatchRecord(2, &b)
+	ioutil.WriteFile(walFileName(dir, 1), append(single, batch[:len(batch)-3]...), 0644)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Get("single"); err != nil {
+		t.Errorf("Expected the record before the batch to be recovered, got %v", err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, err = db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected key '%s' of the torn batch to be dropped, got %v", key, err)
+		}
+	}
+}
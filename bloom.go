@@ -0,0 +1,116 @@
+package doom
+
+import "sync/atomic"
+
+// FilterStats are the counters of the Bloom filters checked by the SSTable lookups of a DB since it was opened
+type FilterStats struct {
+	// Hits counts lookups where the filter answered that the key may be in the table and it was there
+	Hits int64
+
+	// Misses counts lookups where the filter answered that the key isn't in the table, so no data block was read
+	Misses int64
+
+	// FalsePositives counts lookups where the filter answered that the key may be in the table but it wasn't
+	FalsePositives int64
+}
+
+// load returns a copy of the counters, which are updated atomically
+func (s *FilterStats) load() FilterStats {
+	return FilterStats{
+		Hits:           atomic.LoadInt64(&s.Hits),
+		Misses:         atomic.LoadInt64(&s.Misses),
+		FalsePositives: atomic.LoadInt64(&s.FalsePositives),
+	}
+}
+
+// bloomFilter is a Bloom filter over the keys of a table. Its last byte is the number of probes of each key, so
+// filters built with different bits per key can be read with the same code
+type bloomFilter []byte
+
+// newBloomFilter builds a filter with 'bitsPerKey' bits for each of the 'keys'
+func newBloomFilter(keys []string, bitsPerKey int) bloomFilter {
+	// 0.69 is ln(2), the number of probes that minimizes the false positive rate
+	k := int(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+
+	// Very small filters have a high false positive rate so they get a minimum size
+	bits := len(keys) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	f := make(bloomFilter, bytes+1)
+	f[bytes] = byte(k)
+
+	for _, key := range keys {
+		// Double hashing simulates k hash functions from a single one
+		h := bloomHash(key)
+		delta := h>>17 | h<<15
+		for j := 0; j < k; j++ {
+			pos := h % uint32(bits)
+			f[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+
+	return f
+}
+
+// MayContain returns false if 'key' is definitely not in the filter
+func (f bloomFilter) MayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+
+	bits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	if k > 30 {
+		// Reserved for other kinds of filters, so it's considered a match
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for j := 0; j < k; j++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+
+	return true
+}
+
+// bloomHash is the hash function used by LevelDB filters, similar to murmur hash
+func bloomHash(key string) uint32 {
+	const seed, m = 0xbc9f1d34, 0xc6a4a793
+
+	h := uint32(seed) ^ uint32(len(key))*m
+	for ; len(key) >= 4; key = key[4:] {
+		h += uint32(key[0]) | uint32(key[1])<<8 | uint32(key[2])<<16 | uint32(key[3])<<24
+		h *= m
+		h ^= h >> 16
+	}
+
+	switch len(key) {
+	case 3:
+		h += uint32(key[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(key[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(key[0])
+		h *= m
+		h ^= h >> 24
+	}
+
+	return h
+}
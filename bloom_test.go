@@ -0,0 +1,129 @@
+package doom
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	keys := make([]string, 0)
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+
+	f := newBloomFilter(keys, 10)
+
+	for _, k := range keys {
+		if !f.MayContain(k) {
+			t.Fatalf("False negative for key '%s'", k)
+		}
+	}
+
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if f.MayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+
+	// 10 bits per key should give a rate around 1%
+	if falsePositives > 200 {
+		t.Errorf("Too many false positives: %d of 10000", falsePositives)
+	}
+
+	t.Run("empty filter", func(t *testing.T) {
+		if newBloomFilter(nil, 10).MayContain("hello") {
+			t.Error("An empty filter shouldn't contain any key")
+		}
+	})
+}
+
+func TestSSTableFilter(t *testing.T) {
+	es := make([]*Entry, 0)
+	for i := 0; i < 100; i++ {
+		es = append(es, &Entry{Key: fmt.Sprintf("key%03d", i*2), Data: []byte("value")})
+	}
+
+	name := writeTestSSTable(t, es)
+	defer os.Remove(name)
+
+	table, err := OpenSSTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if table.filter == nil {
+		t.Fatal("Expected a filter in the table")
+	}
+
+	stats := &FilterStats{}
+	table.filterStats = stats
+
+	if e, _ := table.Get("key010"); e == nil {
+		t.Error("Expected to find 'key010'")
+	}
+
+	// Keys after the last one of the table are discarded by the index, before checking the filter
+	for i := 0; i < 99; i++ {
+		table.Get(fmt.Sprintf("key%03d", i*2+1))
+	}
+
+	if stats.Hits != 1 {
+		t.Errorf("Expected 1 filter hit, got '%d'", stats.Hits)
+	}
+
+	if stats.Misses+stats.FalsePositives != 99 || stats.Misses < 90 {
+		t.Errorf("Unexpected filter misses '%d'", stats.Misses)
+	}
+
+	t.Run("filter disabled", func(t *testing.T) {
+		testTableOptions.bitsPerKey = 0
+		defer func() { testTableOptions.bitsPerKey = DEFAULT_BLOOM_BITS_PER_KEY }()
+
+		name := writeTestSSTable(t, es)
+		defer os.Remove(name)
+
+		table, err := OpenSSTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer table.Close()
+
+		if table.filter != nil {
+			t.Error("Unexpected filter in the table")
+		}
+
+		if e, _ := table.Get("key010"); e == nil {
+			t.Error("Expected to find 'key010'")
+		}
+	})
+	t.Run("counters of each DB", func(t *testing.T) {
+		dbs := make([]*DB, 2)
+		for i := range dbs {
+			db, err := Open("/db", &Options{FS: NewMemFS()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			db.Put("a", []byte("value"))
+			db.Put("c", []byte("value"))
+			if err = db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			dbs[i] = db
+		}
+
+		dbs[0].Get("a")
+		dbs[0].Get("b")
+
+		if stats := dbs[0].FilterStats(); stats.Hits != 1 || stats.Misses+stats.FalsePositives != 1 {
+			t.Errorf("Unexpected filter stats %+v", stats)
+		}
+		if stats := dbs[1].FilterStats(); stats != (FilterStats{}) {
+			t.Errorf("Expected the filter stats of another DB to be zero, got %+v", stats)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package doom
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats are the counters of the block cache of a DB
+type CacheStats struct {
+	// Hits counts data block reads served from the cache
+	Hits int64
+
+	// Misses counts data block reads that had to go to the table file
+	Misses int64
+
+	// Size is the number of bytes of the blocks in the cache and Capacity the most that it holds
+	Size, Capacity int64
+}
+
+// blockCache keeps the decoded data blocks of every open SSTable, up to a number of bytes, evicting the least
+// recently used ones first. It's split in BLOCK_CACHE_SHARDS shards with a lock of their own so concurrent reads of
+// different blocks rarely wait for each other
+type blockCache struct {
+	shards       [BLOCK_CACHE_SHARDS]cacheShard
+	nextID       uint64
+	hits, misses int64
+}
+
+// cacheKey identifies a block by the id given to its table when it was opened and its offset in the file
+type cacheKey struct {
+	id     uint64
+	offset int64
+}
+
+type cacheShard struct {
+	mu             sync.Mutex
+	capacity, size int64
+	items          map[cacheKey]*list.Element
+	lru            *list.List
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	entries []*Entry
+	charge  int64
+}
+
+// newBlockCache returns a cache of 'capacity' bytes, or nil if it isn't positive. A nil cache caches nothing
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	c := &blockCache{}
+	for i := range c.shards {
+		c.shards[i].capacity = (capacity + BLOCK_CACHE_SHARDS - 1) / BLOCK_CACHE_SHARDS
+		c.shards[i].items = make(map[cacheKey]*list.Element)
+		c.shards[i].lru = list.New()
+	}
+
+	return c
+}
+
+// newID returns the id that an opened table uses for the keys of its blocks. Ids are never reused, so the blocks of a
+// closed table are never found again and they're evicted eventually
+func (c *blockCache) newID() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	return atomic.AddUint64(&c.nextID, 1)
+}
+
+func (c *blockCache) shard(k cacheKey) *cacheShard {
+	h := (k.id*0x9e3779b97f4a7c15 ^ uint64(k.offset)) * 0xff51afd7ed558ccd
+	return &c.shards[h>>60%BLOCK_CACHE_SHARDS]
+}
+
+// get returns the entries of the block 'k' and moves it to the front of its shard
+func (c *blockCache) get(k cacheKey) (entries []*Entry, ok bool) {
+	s := c.shard(k)
+
+	s.mu.Lock()
+	el, ok := s.items[k]
+	if ok {
+		s.lru.MoveToFront(el)
+		entries = el.Value.(*cacheEntry).entries
+	}
+	s.mu.Unlock()
+
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+
+	return
+}
+
+// insert adds the entries of the block 'k', which take 'charge' bytes, evicting the least recently used blocks of
+// its shard until they fit. Blocks bigger than a shard aren't cached
+func (c *blockCache) insert(k cacheKey, entries []*Entry, charge int64) {
+	s := c.shard(k)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if charge > s.capacity {
+		return
+	}
+
+	if el, ok := s.items[k]; ok {
+		s.lru.MoveToFront(el)
+		return
+	}
+
+	s.items[k] = s.lru.PushFront(&cacheEntry{key: k, entries: entries, charge: charge})
+	s.size += charge
+
+	for s.size > s.capacity {
+		e := s.lru.Remove(s.lru.Back()).(*cacheEntry)
+		delete(s.items, e.key)
+		s.size -= e.charge
+	}
+}
+
+// stats returns a copy of the counters of the cache
+func (c *blockCache) stats() (stats CacheStats) {
+	if c == nil {
+		return
+	}
+
+	stats.Hits, stats.Misses = atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Size += s.size
+		stats.Capacity += s.capacity
+		s.mu.Unlock()
+	}
+
+	return
+}
@@ -0,0 +1,119 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	c := newBlockCache(BLOCK_CACHE_SHARDS * 100)
+
+	// Blocks of the same shard compete for its 100 bytes
+	shard := c.shard(cacheKey{id: 1})
+	keys := make([]cacheKey, 0)
+	for offset := int64(0); len(keys) < 4; offset++ {
+		if k := (cacheKey{id: 1, offset: offset}); c.shard(k) == shard {
+			keys = append(keys, k)
+		}
+	}
+
+	entries := []*Entry{{Key: "a"}}
+
+	t.Run("least recently used evicted", func(t *testing.T) {
+		c.insert(keys[0], entries, 40)
+		c.insert(keys[1], entries, 40)
+
+		if _, ok := c.get(keys[0]); !ok {
+			t.Fatal("Expected the first block to be cached")
+		}
+
+		c.insert(keys[2], entries, 40)
+
+		if _, ok := c.get(keys[1]); ok {
+			t.Error("Expected the least recently used block to be evicted")
+		}
+
+		for _, k := range []cacheKey{keys[0], keys[2]} {
+			if _, ok := c.get(k); !ok {
+				t.Errorf("Expected block at offset %d to be cached", k.offset)
+			}
+		}
+
+		if shard.size != 80 {
+			t.Errorf("Expected 80 bytes in the shard, got %d", shard.size)
+		}
+	})
+
+	t.Run("blocks bigger than a shard not cached", func(t *testing.T) {
+		c.insert(keys[3], entries, 101)
+
+		if _, ok := c.get(keys[3]); ok {
+			t.Error("Expected the block to be too big for the cache")
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats := c.stats()
+		if stats.Hits != 3 || stats.Misses != 2 {
+			t.Errorf("Expected 3 hits and 2 misses, got %d and %d", stats.Hits, stats.Misses)
+		}
+
+		if stats.Size != 80 || stats.Capacity != BLOCK_CACHE_SHARDS*100 {
+			t.Errorf("Expected 80 of %d bytes, got %d of %d", BLOCK_CACHE_SHARDS*100, stats.Size, stats.Capacity)
+		}
+	})
+
+	if newBlockCache(0) != nil || newBlockCache(0).stats() != (CacheStats{}) {
+		t.Error("Expected no cache without capacity")
+	}
+}
+
+func TestDBBlockCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 500; i++ {
+		db.Put(fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("scans don't fill the cache", func(t *testing.T) {
+		it := db.NewIterator(&IterOptions{DontFillCache: true})
+		n := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			n++
+		}
+		it.Close()
+
+		if n != 500 {
+			t.Fatalf("Expected 500 keys, got %d", n)
+		}
+
+		if stats := db.CacheStats(); stats.Size != 0 {
+			t.Errorf("Expected an empty cache after the scan, got %d bytes", stats.Size)
+		}
+	})
+
+	t.Run("lookups hit the cache", func(t *testing.T) {
+		for round := 0; round < 2; round++ {
+			if _, err := db.Get("key250"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stats := db.CacheStats()
+		if stats.Hits != 1 || stats.Size == 0 {
+			t.Errorf("Expected the second lookup to hit the cache, got %+v", stats)
+		}
+	})
+}
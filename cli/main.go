@@ -1,95 +1,273 @@
 package main
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
 	"github.com/sayden/doomdb"
 	"github.com/thehivecorporation/log"
 	"os"
-	"strings"
-	"github.com/juju/errors"
+	"time"
 )
 
-var tempFolder = "/tmp"
-var storageFolder = "/tmp"
+// The DB removes the files with the names of its own that it doesn't need, so it gets folders of its own
+var tempFolder = "/tmp/doomdb"
+var storageFolder = "/tmp/doomdb"
 
-var memtable *doom.MemTable
+// mergeOperator combines the operands of "merge" batch operations with the value of their key
+var mergeOperator = doom.Int64AddOperator
+
+var db *doom.DB
 
 type kv struct {
 	Key   string `json:"key,omitempty"`
 	Value string `json:"value,omitempty"`
+
+	// TTLSeconds makes the key expire after that many seconds. Keys without it never expire
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+}
+
+// op is an operation of a batch: "put", "delete" or "merge". Family is the column family of the key, the one of
+// the path by default, so a batch can write to several families atomically
+type op struct {
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Family string `json:"family,omitempty"`
 }
 
 func main() {
 	var err error
-	if memtable, err = doom.New(tempFolder, storageFolder); err != nil {
+	for _, folder := range []string{tempFolder, storageFolder} {
+		if err = os.MkdirAll(folder, 0755); err != nil {
+			log.WithError(err).Fatalf("Error creating folder %s", folder)
+		}
+	}
+
+	if db, err = doom.Open(storageFolder, &doom.Options{WALDir: tempFolder, MergeOperator: mergeOperator}); err != nil {
 		log.WithError(err).Fatal("Error creating DaDB")
 	}
+	defer db.Close()
 
 	r := gin.Default()
 
-	r.PUT("/", func(c *gin.Context) {
-		var e kv
-		if err := c.BindJSON(&e); err != nil {
-			log.WithError(err).Error("Could not bind entry")
+	// The keys of the default column family are at the root and the ones of any other family under
+	// /families/:family, with the same routes
+	keys(r)
+	keys(r.Group("/families/:family"))
+
+	// POST /families/:family creates an empty column family with the options of the DB
+	r.POST("/families/:family", func(c *gin.Context) {
+		if _, err := db.CreateColumnFamily(c.Param("family"), nil); errors.Cause(err) == doom.ErrColumnFamilyExists {
+			c.JSON(409, gin.H{"status": "error", "msg": err.Error()})
+			return
+		} else if err != nil {
 			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
 			return
 		}
 
-		if err = insert(e, memtable); err != nil {
+		c.Status(201)
+	})
+
+	// DELETE /families/:family drops a column family with all its keys
+	r.DELETE("/families/:family", func(c *gin.Context) {
+		if err := db.DropColumnFamily(c.Param("family")); errors.Cause(err) == doom.ErrColumnFamilyNotFound {
+			c.JSON(404, gin.H{"status": "error", "msg": err.Error()})
+			return
+		} else if err != nil {
 			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
+			return
 		}
 
+		c.Status(200)
 	})
 
-	storageFile := memtable.StorageFile.Name()
-
 	r.POST("/", func(c *gin.Context) {
-		if err := memtable.Persist(); err != nil {
+		if err := db.Flush(); err != nil {
 			c.JSON(500, "Error persisting data on disk")
 		}
 	})
 
 	r.GET("/", func(c *gin.Context) {
-		findUsingIndex(storageFile)
+		find("a_key")
 		c.Status(200)
 	})
 
 	r.Run(":8080")
 }
 
-func insert(e kv, memtable *doom.MemTable) (err error) {
+// keys registers the routes that read and write the keys of a column family in 'g'
+func keys(g gin.IRoutes) {
+	// PUT / takes {"key": ..., "value": ..., "ttl_seconds": ...}, where the TTL is optional. With ?sync=true it
+	// waits until the value is synced to disk
+	g.PUT("/", func(c *gin.Context) {
+		cf, ok := family(c)
+		if !ok {
+			return
+		}
+
+		var e kv
+		if err := c.BindJSON(&e); err != nil {
+			log.WithError(err).Error("Could not bind entry")
+			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
+			return
+		}
+
+		if err := insert(e, cf, c.Query("sync") == "true", db); err != nil {
+			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
+		}
+
+	})
+
+	g.DELETE("/keys/:key", func(c *gin.Context) {
+		cf, ok := family(c)
+		if !ok {
+			return
+		}
+
+		if err := cf.Delete(c.Param("key")); err != nil {
+			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
+			return
+		}
+
+		c.Status(200)
+	})
+
+	// POST /batch applies a JSON array of operations atomically. With ?sync=true it waits until they're synced to disk
+	g.POST("/batch", func(c *gin.Context) {
+		cf, ok := family(c)
+		if !ok {
+			return
+		}
+
+		var ops []op
+		if err := c.BindJSON(&ops); err != nil {
+			log.WithError(err).Error("Could not bind batch")
+			c.JSON(400, gin.H{"status": "error", "msg": err.Error()})
+			return
+		}
+
+		if err := writeBatch(ops, cf, c.Query("sync") == "true", db); err != nil {
+			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
+			return
+		}
+
+		c.Status(200)
+	})
+
+	// GET /scan?from=A&to=B returns the keys from A, included, to B, excluded
+	g.GET("/scan", func(c *gin.Context) {
+		cf, ok := family(c)
+		if !ok {
+			return
+		}
+
+		kvs, err := scan(cf, c.Query("from"), c.Query("to"))
+		if err != nil {
+			c.JSON(500, gin.H{"status": "error", "msg": err.Error()})
+			return
+		}
+
+		c.JSON(200, kvs)
+	})
+}
+
+// family returns the column family of the path, or the default one. It responds with a 404 if the family doesn't
+// exist
+func family(c *gin.Context) (cf *doom.ColumnFamily, ok bool) {
+	name := c.Param("family")
+	if name == "" {
+		return db.DefaultColumnFamily(), true
+	}
+
+	cf, err := db.ColumnFamily(name)
+	if err != nil {
+		c.JSON(404, gin.H{"status": "error", "msg": err.Error()})
+		return nil, false
+	}
+
+	return cf, true
+}
+
+func insert(e kv, cf *doom.ColumnFamily, sync bool, db *doom.DB) (err error) {
 	if e.Key == "" || len(e.Value) == 0 {
-		err := errors.New("Key or value not found")
+		err = errors.New("Key or value not found")
+		return
+	} else if e.TTLSeconds < 0 {
+		err = errors.New("TTL can't be negative")
 		return
 	}
 
-	if err := memtable.Insert(fmt.Sprintf("%s %s", e.Key, e.Value)); err != nil {
+	var b doom.WriteBatch
+	if e.TTLSeconds > 0 {
+		b.PutWithTTLCF(cf, e.Key, []byte(e.Value), time.Duration(e.TTLSeconds)*time.Second)
+	} else {
+		b.PutCF(cf, e.Key, []byte(e.Value))
+	}
+	if err = db.WriteWithOptions(&b, &doom.WriteOptions{Sync: sync}); err != nil {
 		err = errors.Annotate(err, "Error inserting data")
 	}
 
 	return
 }
 
-func findUsingIndex(fn string) {
-	log.Debugf("Opening file name %s", fn)
+func writeBatch(ops []op, cf *doom.ColumnFamily, sync bool, db *doom.DB) (err error) {
+	var b doom.WriteBatch
+	for _, o := range ops {
+		if o.Key == "" {
+			return errors.New("Key not found in batch operation")
+		}
 
-	f, err := os.Open(fn)
-	if err != nil {
-		log.WithError(err).Fatal("Error opening storage file")
+		opCF := cf
+		if o.Family != "" {
+			if opCF, err = db.ColumnFamily(o.Family); err != nil {
+				return
+			}
+		}
+
+		switch o.Op {
+		case "put":
+			b.PutCF(opCF, o.Key, []byte(o.Value))
+		case "delete":
+			b.DeleteCF(opCF, o.Key)
+		case "merge":
+			b.MergeCF(opCF, o.Key, []byte(o.Value))
+		default:
+			return errors.Errorf("Unknown batch operation '%s'", o.Op)
+		}
 	}
-	defer f.Close()
 
-	mario := memtable.Get("a_key")
-	if mario == nil {
-		log.Error("Key not found")
-		return
+	if err = db.WriteWithOptions(&b, &doom.WriteOptions{Sync: sync}); err != nil {
+		err = errors.Annotate(err, "Error writing batch")
+	}
+
+	return
+}
+
+func scan(cf *doom.ColumnFamily, from, to string) (kvs []kv, err error) {
+	it := cf.NewIterator(&doom.IterOptions{LowerBound: from, UpperBound: to, DontFillCache: true})
+	defer it.Close()
+
+	kvs = make([]kv, 0)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		kvs = append(kvs, kv{Key: it.Key(), Value: string(it.Value())})
+	}
+
+	if err = it.Error(); err != nil {
+		err = errors.Annotate(err, "Error scanning keys")
 	}
 
-	b := make([]byte, mario.Length)
-	f.ReadAt(b, mario.Offset)
+	return
+}
 
-	s := string(b)
+func find(key string) {
+	value, err := db.Get(key)
+	if err == doom.ErrNotFound {
+		log.Error("Key not found")
+		return
+	} else if err != nil {
+		log.WithError(err).Error("Error reading key")
+		return
+	}
 
-	log.Infof("DATA->%s", s[strings.Index(s, " ")+1:])
+	log.Infof("DATA->%s", value)
 }
@@ -0,0 +1,256 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrColumnFamilyExists is returned when a column family is created with the name of a live one
+	ErrColumnFamilyExists = errors.New("column family exists")
+
+	// ErrColumnFamilyNotFound is returned when a column family that doesn't exist is looked up or dropped
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+
+	// ErrColumnFamilyDropped is returned by the reads and writes of a column family after it's dropped
+	ErrColumnFamilyDropped = errors.New("column family dropped")
+)
+
+// ColumnFamily is a keyspace of a DB with its own SSTables, compactions and Options, like its comparator or its merge
+// operator. Every column family has a skiplist in the MemTable of the DB and they all share its WAL, so a WriteBatch
+// over several of them is atomic, and their MemTables are flushed together. The methods of the DB work on the
+// default column family, which always exists
+type ColumnFamily struct {
+	db   *DB
+	id   uint32
+	name string
+	opts *Options
+
+	strategy compactionStrategy
+	stats    compactionCounters
+
+	// levels, compactPointer and dropped are protected by db.mu
+	levels         [MAX_LEVELS][]*tableMeta
+	compactPointer [MAX_LEVELS]string
+	dropped        bool
+}
+
+// familyMeta is a column family as it's logged in the MANIFEST
+type familyMeta struct {
+	id         uint32
+	name       string
+	comparator string
+}
+
+// newColumnFamily returns the column family 'id' called 'name' with the validated options 'opts'. Its tables share
+// the table cache and the block cache of the DB
+func (db *DB) newColumnFamily(id uint32, name string, opts *Options) (cf *ColumnFamily, err error) {
+	cf = &ColumnFamily{db: db, id: id, name: name, opts: opts}
+
+	if cf.strategy, err = newCompactionStrategy(opts.CompactionStrategy); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// familyOptions validates the options 'o' of the column family 'name'. Nil options take the ones of
+// Options.ColumnFamilies for the name, or the ones of the DB. The settings shared by the whole DB, like its FS, its
+// WAL and its caches, are always the ones of the DB
+func (db *DB) familyOptions(name string, o *Options) (*Options, error) {
+	if o == nil {
+		o = db.opts.ColumnFamilies[name]
+	}
+	if o == nil {
+		o = db.opts
+	}
+
+	v := *o
+	v.FS, v.WALDir, v.ReadOnly, v.ColumnFamilies = db.opts.FS, db.opts.WALDir, db.opts.ReadOnly, nil
+	v.MaxWriteGroupSize, v.WALSyncPolicy, v.WALSyncInterval = db.opts.MaxWriteGroupSize, db.opts.WALSyncPolicy,
+		db.opts.WALSyncInterval
+	v.BlockCacheSize, v.MaxOpenFiles = db.opts.BlockCacheSize, db.opts.MaxOpenFiles
+
+	return v.validate()
+}
+
+// CreateColumnFamily creates an empty column family called 'name' with 'opts', which can be nil to take the ones of
+// Options.ColumnFamilies or the ones of the DB. The family is logged in the MANIFEST, so it's opened again with the
+// DB, and it must always be opened with the same comparator
+func (db *DB) CreateColumnFamily(name string, opts *Options) (cf *ColumnFamily, err error) {
+	if db.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	if opts, err = db.familyOptions(name, opts); err != nil {
+		return nil, err
+	}
+
+	// Applied at the front of the queue, so no write is inserted in the MemTable while the family is added to it
+	err = db.enqueue(&writer{apply: func() (err error) {
+		if _, err = db.ColumnFamily(name); err == nil {
+			return errors.Annotatef(ErrColumnFamilyExists, "Could not create column family '%s'", name)
+		}
+
+		db.manifestMu.Lock()
+		id := db.lastFamily + 1
+		db.manifestMu.Unlock()
+
+		if cf, err = db.newColumnFamily(id, name, opts); err != nil {
+			return
+		}
+
+		edit := &versionEdit{created: []*familyMeta{{id: id, name: name, comparator: opts.Comparator.Name()}}}
+		return db.logAndApply(edit, func() {
+			db.families[id] = cf
+			db.mem.addFamily(id, opts.Comparator)
+		})
+	}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// DropColumnFamily removes the column family called 'name' with all its keys. Its tables are deleted right away,
+// except the ones still read by open iterators, which go when the iterators are closed. The default column family
+// can't be dropped
+func (db *DB) DropColumnFamily(name string) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if name == DEFAULT_COLUMN_FAMILY {
+		return errors.Errorf("The column family '%s' can't be dropped", DEFAULT_COLUMN_FAMILY)
+	}
+
+	return db.enqueue(&writer{apply: func() error {
+		cf, err := db.ColumnFamily(name)
+		if err != nil {
+			return err
+		}
+
+		// Its entries in the MemTables are ignored from now on, and never flushed
+		var tables []*tableMeta
+		if err = db.logAndApply(&versionEdit{dropped: []uint32{cf.id}}, func() {
+			delete(db.families, cf.id)
+			db.mem.dropFamily(cf.id)
+			cf.dropped = true
+
+			for level := range cf.levels {
+				tables = append(tables, cf.levels[level]...)
+				cf.levels[level] = nil
+			}
+		}); err != nil {
+			return err
+		}
+
+		db.removeTables(tables)
+
+		return nil
+	}})
+}
+
+// ColumnFamily returns the live column family called 'name', or ErrColumnFamilyNotFound
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, cf := range db.families {
+		if cf.name == name {
+			return cf, nil
+		}
+	}
+
+	return nil, errors.Annotatef(ErrColumnFamilyNotFound, "No column family called '%s'", name)
+}
+
+// DefaultColumnFamily returns the column family read and written by the methods of the DB
+func (db *DB) DefaultColumnFamily() *ColumnFamily {
+	return db.defaultCF
+}
+
+// ColumnFamilies returns the names of the live column families, in the order that they were created
+func (db *DB) ColumnFamilies() []string {
+	families := db.sortedFamilies()
+
+	names := make([]string, len(families))
+	for i, cf := range families {
+		names[i] = cf.name
+	}
+
+	return names
+}
+
+// sortedFamilies returns the live column families in the order that they were created
+func (db *DB) sortedFamilies() []*ColumnFamily {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	families := make([]*ColumnFamily, 0, len(db.families))
+	for _, cf := range db.families {
+		families = append(families, cf)
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+
+	return families
+}
+
+// Name returns the name of the column family
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Put stores 'value' for 'key' in the column family
+func (cf *ColumnFamily) Put(key string, value []byte) error {
+	var b WriteBatch
+	b.PutCF(cf, key, value)
+
+	return cf.db.Write(&b)
+}
+
+// PutWithTTL writes 'value' for 'key' in the column family, which is reported as not found once 'ttl' has passed
+func (cf *ColumnFamily) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	var b WriteBatch
+	b.PutWithTTLCF(cf, key, value, ttl)
+
+	return cf.db.Write(&b)
+}
+
+// Delete removes 'key' from the column family
+func (cf *ColumnFamily) Delete(key string) error {
+	var b WriteBatch
+	b.DeleteCF(cf, key)
+
+	return cf.db.Write(&b)
+}
+
+// Merge combines 'operand' with the value of 'key' through the merge operator of the column family
+func (cf *ColumnFamily) Merge(key string, operand []byte) error {
+	var b WriteBatch
+	b.MergeCF(cf, key, operand)
+
+	return cf.db.Write(&b)
+}
+
+// Get returns the value of 'key' in the column family, like DB.Get
+func (cf *ColumnFamily) Get(key string) ([]byte, error) {
+	return cf.db.get(cf, key, atomic.LoadUint64(&cf.db.seq))
+}
+
+// NewIterator returns an iterator over the keys of the column family, like DB.NewIterator
+func (cf *ColumnFamily) NewIterator(opts *IterOptions) *Iterator {
+	return cf.db.newIterator(cf, opts)
+}
+
+// CompactionStats returns the bytes written by the flushes and the compactions of the column family
+func (cf *ColumnFamily) CompactionStats() CompactionStats {
+	return cf.stats.compactionStats(cf.opts.CompactionStrategy)
+}
@@ -0,0 +1,228 @@
+package doom
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"strings"
+	"testing"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	fs := NewMemFS()
+	familyOpts := &Options{Comparator: reverseComparator{}, MergeOperator: Int64AddOperator}
+	opts := &Options{FS: fs, ColumnFamilies: map[string]*Options{"users": familyOpts}}
+
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := db.CreateColumnFamily("users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.CreateColumnFamily("users", nil); errors.Cause(err) != ErrColumnFamilyExists {
+		t.Errorf("Expected ErrColumnFamilyExists, got %v", err)
+	}
+
+	keys := func(cf *ColumnFamily) string {
+		it := cf.NewIterator(nil)
+		defer it.Close()
+
+		found := make([]string, 0)
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			found = append(found, it.Key()+"="+string(it.Value()))
+		}
+
+		return strings.Join(found, " ")
+	}
+
+	t.Run("separate keyspaces", func(t *testing.T) {
+		for _, key := range []string{"a", "b", "c"} {
+			db.Put(key, []byte("default"))
+			users.Put(key, []byte("users"))
+		}
+		users.Delete("b")
+
+		if value, err := db.Get("b"); err != nil || string(value) != "default" {
+			t.Errorf("Expected 'default' for 'b', got '%s' (%v)", value, err)
+		}
+		if _, err := users.Get("b"); err != ErrNotFound {
+			t.Errorf("Expected 'b' to be deleted from the family, got %v", err)
+		}
+
+		// The family sorts its keys with its own comparator
+		if got := keys(users); got != "c=users a=users" {
+			t.Errorf("Unexpected keys of the family: %s", got)
+		}
+		if got := keys(db.DefaultColumnFamily()); got != "a=default b=default c=default" {
+			t.Errorf("Unexpected keys of the default family: %s", got)
+		}
+	})
+
+	t.Run("atomic batches over several families", func(t *testing.T) {
+		var b WriteBatch
+		b.Put("x", []byte("default"))
+		b.PutCF(users, "x", []byte("users"))
+		b.MergeCF(users, "counter", []byte("5"))
+		if err := db.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		if value, err := users.Get("x"); err != nil || string(value) != "users" {
+			t.Errorf("Expected 'users' for 'x', got '%s' (%v)", value, err)
+		}
+		if value, err := users.Get("counter"); err != nil || string(value) != "5" {
+			t.Errorf("Expected '5' for 'counter', got '%s' (%v)", value, err)
+		}
+
+		// Only the family has a merge operator
+		b.Clear()
+		b.MergeCF(users, "counter", []byte("1"))
+		b.Merge("counter", []byte("1"))
+		if err := db.Write(&b); err != ErrNoMergeOperator {
+			t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+		}
+	})
+
+	t.Run("families opened again", func(t *testing.T) {
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		users.Merge("counter", []byte("2"))
+		db.Close()
+
+		if db, err = Open("/db", opts); err != nil {
+			t.Fatal(err)
+		}
+		if users, err = db.ColumnFamily("users"); err != nil {
+			t.Fatal(err)
+		}
+
+		// One table from the flush and the operand replayed from the WAL
+		db.mu.RLock()
+		tables := len(users.levels[0])
+		db.mu.RUnlock()
+		if tables != 1 {
+			t.Errorf("Expected a table in level 0 of the family, found %d", tables)
+		}
+
+		if got := keys(users); got != "x=users counter=7 c=users a=users" {
+			t.Errorf("Unexpected keys of the family: %s", got)
+		}
+		if names := db.ColumnFamilies(); strings.Join(names, ",") != "default,users" {
+			t.Errorf("Unexpected column families %v", names)
+		}
+
+		db.Close()
+		if _, err = Open("/db", &Options{FS: fs}); errors.Cause(err) != ErrComparatorMismatch {
+			t.Errorf("Expected ErrComparatorMismatch opening the family with another comparator, got %v", err)
+		}
+
+		// The operand is found again in the WAL written by the replay
+		if db, err = Open("/db", opts); err != nil {
+			t.Fatal(err)
+		}
+		if users, err = db.ColumnFamily("users"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := users.Get("counter"); err != nil || string(value) != "7" {
+			t.Errorf("Expected '7' for 'counter', got '%s' (%v)", value, err)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		defer func() { db.Close() }()
+
+		db.mu.RLock()
+		table := users.levels[0][0].number
+		db.mu.RUnlock()
+
+		if err := db.DropColumnFamily("users"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fs.Stat(tableFileName("/db", table)); err == nil {
+			t.Error("Expected the tables of the family to be removed")
+		}
+		if _, err := users.Get("x"); err != ErrColumnFamilyDropped {
+			t.Errorf("Expected ErrColumnFamilyDropped reading, got %v", err)
+		}
+		if err := users.Put("x", []byte("value")); errors.Cause(err) != ErrColumnFamilyDropped {
+			t.Errorf("Expected ErrColumnFamilyDropped writing, got %v", err)
+		}
+		if err := db.DropColumnFamily("users"); errors.Cause(err) != ErrColumnFamilyNotFound {
+			t.Errorf("Expected ErrColumnFamilyNotFound, got %v", err)
+		}
+		if err := db.DropColumnFamily(DEFAULT_COLUMN_FAMILY); err == nil {
+			t.Error("Expected an error dropping the default family")
+		}
+
+		// Ids aren't reused, so the entries of the old family left in the WAL are never found in the new one
+		db.Close()
+		if db, err = Open("/db", opts); err != nil {
+			t.Fatal(err)
+		}
+
+		created, err := db.CreateColumnFamily("users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.id <= users.id {
+			t.Errorf("Expected a new id for the family, got %d after %d", created.id, users.id)
+		}
+		if got := keys(created); got != "" {
+			t.Errorf("Expected the new family to be empty, got %s", got)
+		}
+		if value, err := db.Get("x"); err != nil || string(value) != "default" {
+			t.Errorf("Expected 'default' for 'x', got '%s' (%v)", value, err)
+		}
+	})
+}
+
+func TestColumnFamilyCompaction(t *testing.T) {
+	db, err := Open("/db", &Options{FS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cf, err := db.CreateColumnFamily("events", &Options{WriteBufferSize: 1024, L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if err = cf.Put(fmt.Sprintf("key%03d", i%100), []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Put("key", []byte("value"))
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForCompactions(t, db)
+
+	// The family fills its own write buffer and compacts its own levels with its own trigger
+	if stats := cf.CompactionStats(); stats.BytesCompacted == 0 {
+		t.Error("Expected compactions of the family")
+	}
+	if stats := db.DefaultColumnFamily().CompactionStats(); stats.BytesCompacted != 0 || stats.BytesFlushed == 0 {
+		t.Errorf("Expected a single flush of the default family, got %+v", stats)
+	}
+	if stats := db.CompactionStats(); stats.BytesCompacted != cf.CompactionStats().BytesCompacted {
+		t.Errorf("Expected the stats of the DB to add the ones of the families, got %+v", stats)
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := cf.Get(fmt.Sprintf("key%03d", i))
+		if err != nil || string(value) != fmt.Sprintf("value %d", 400+i) {
+			t.Errorf("Unexpected value '%s' of key%03d (%v)", value, i, err)
+		}
+	}
+	if _, err = cf.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected the key of the default family not to be found in the family, got %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"github.com/thehivecorporation/log"
+	"sync/atomic"
+	"time"
+)
+
+// compaction merges the tables of 'inputs[0]', from 'level', with the tables of 'inputs[1]', from 'outputLevel', all
+// of the column family 'cf'. The result is written to new tables of 'outputLevel' of up to 'maxOutputSize' bytes, or
+// to a single table if it's 0
+type compaction struct {
+	cf                 *ColumnFamily
+	level, outputLevel int
+	inputs             [2][]*tableMeta
+	maxOutputSize      int64
+}
+
+// maybeScheduleCompaction wakes up the compaction goroutine without blocking
+func (db *DB) maybeScheduleCompaction() {
+	select {
+	case db.compactc <- struct{}{}:
+	default:
+	}
+}
+
+// compactionLoop runs compactions in background until the DB is closed
+func (db *DB) compactionLoop() {
+	defer db.wg.Done()
+
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-db.compactc:
+		}
+
+		for {
+			select {
+			case <-db.closing:
+				return
+			default:
+			}
+
+			c := db.pickCompaction()
+			if c == nil {
+				break
+			}
+
+			if err := db.runCompaction(c); err != nil {
+				log.WithError(err).Errorf("Error compacting level %d", c.level)
+				break
+			}
+		}
+	}
+}
+
+// compactionStrategy decides which tables are compacted together and where the result goes
+type compactionStrategy interface {
+	// pick returns the next compaction of the column family 'cf' to run or nil if no table needs one. It's called
+	// with db.mu held
+	pick(cf *ColumnFamily) *compaction
+}
+
+// newCompactionStrategy returns the strategy called 'name', one of LEVELED_COMPACTION or SIZE_TIERED_COMPACTION
+func newCompactionStrategy(name string) (compactionStrategy, error) {
+	switch name {
+	case LEVELED_COMPACTION:
+		return leveledCompaction{}, nil
+	case SIZE_TIERED_COMPACTION:
+		return sizeTieredCompaction{}, nil
+	}
+
+	return nil, errors.Errorf("Unknown compaction strategy '%s'", name)
+}
+
+// CompactionStats are the bytes written to SSTables since the DB was opened
+type CompactionStats struct {
+	Strategy       string
+	BytesFlushed   int64
+	BytesCompacted int64
+
+	// WriteAmplification is the number of bytes written to SSTables, by flushes and compactions, for each byte
+	// flushed from the MemTable
+	WriteAmplification float64
+}
+
+type compactionCounters struct {
+	flushed, compacted int64
+}
+
+func (c *compactionCounters) addFlushed(n int64) {
+	atomic.AddInt64(&c.flushed, n)
+}
+
+func (c *compactionCounters) addCompacted(n int64) {
+	atomic.AddInt64(&c.compacted, n)
+}
+
+// compactionStats returns the counters as the stats of the strategy 'strategy'
+func (c *compactionCounters) compactionStats(strategy string) CompactionStats {
+	stats := CompactionStats{
+		Strategy:       strategy,
+		BytesFlushed:   atomic.LoadInt64(&c.flushed),
+		BytesCompacted: atomic.LoadInt64(&c.compacted),
+	}
+
+	if stats.BytesFlushed > 0 {
+		stats.WriteAmplification = float64(stats.BytesFlushed+stats.BytesCompacted) / float64(stats.BytesFlushed)
+	}
+
+	return stats
+}
+
+// CompactionStats returns the bytes written by flushes and compactions, in every column family, and the write
+// amplification that they achieved. The strategy is the one of the options of the DB
+func (db *DB) CompactionStats() CompactionStats {
+	var total compactionCounters
+	for _, cf := range db.sortedFamilies() {
+		total.addFlushed(atomic.LoadInt64(&cf.stats.flushed))
+		total.addCompacted(atomic.LoadInt64(&cf.stats.compacted))
+	}
+
+	return total.compactionStats(db.opts.CompactionStrategy)
+}
+
+// pickCompaction returns the compaction chosen by the strategy of the first column family that needs one, in the
+// order that they were created, or nil if none does
+func (db *DB) pickCompaction() *compaction {
+	families := db.sortedFamilies()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, cf := range families {
+		if c := cf.strategy.pick(cf); c != nil {
+			c.cf = cf
+			return c
+		}
+	}
+
+	return nil
+}
+
+// runCompaction merges the inputs of 'c' dropping shadowed values, and tombstones and expired values when no older
+// value of their key can exist in other tables. The inputs are read in order through a merging iterator and the outputs
+// are written as they go, so the memory used doesn't grow with the size of the inputs. New tables are swapped with the
+// inputs atomically by a single edit of the MANIFEST, so outputs left by a crash before it are never live and they're
+// removed when the DB is opened again
+func (db *DB) runCompaction(c *compaction) (err error) {
+	log.Debugf("Compacting %d tables of level %d with %d tables of level %d", len(c.inputs[0]), c.level,
+		len(c.inputs[1]), c.outputLevel)
+
+	cf := c.cf
+	tables := make([]*cachedTable, 0, len(c.inputs[0])+len(c.inputs[1]))
+	defer func() {
+		for _, t := range tables {
+			t.release()
+		}
+	}()
+
+	children := make([]internalIterator, 0, cap(tables))
+	for _, inputs := range c.inputs {
+		for _, m := range inputs {
+			t, err := db.tables.get(m.number, cf.opts.Comparator)
+			if err != nil {
+				return err
+			}
+
+			tables = append(tables, t)
+			children = append(children, t.newIterator(false))
+		}
+	}
+
+	m := &versionMerger{op: cf.opts.MergeOperator, isOldest: func(key string) bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		return db.isOldestForKey(c, key)
+	}}
+
+	// A tombstone can go when it's the oldest version of its key left, as nothing else could be found without it.
+	// Expired values are read as tombstones so they're written as one, or dropped the same way. Entries can be
+	// shared with the block cache, so they're replaced instead of changed
+	now := time.Now().UnixNano()
+	out := &compactionOutput{db: db, cf: cf, level: c.outputLevel, maxSize: c.maxOutputSize}
+	input := newMergingIterator(cf.opts.Comparator, children)
+	err = mergeVersions(input, db.snapshots.sorted(), m, func(versions []*Entry) error {
+		live := versions[:0]
+		for i, e := range versions {
+			if isExpired(e, now) {
+				e = &Entry{Key: e.Key, Seq: e.Seq, Tombstone: true}
+			}
+
+			if e.Tombstone && i == len(versions)-1 && m.isOldest(e.Key) {
+				continue
+			}
+
+			live = append(live, e)
+		}
+
+		return out.add(live)
+	})
+
+	if err == nil {
+		err = out.finish()
+	} else {
+		out.abort()
+	}
+	outputs := out.tables
+
+	edit := &versionEdit{added: outputs}
+	for _, inputs := range c.inputs {
+		edit.removed = append(edit.removed, inputs...)
+	}
+
+	// A family dropped meanwhile has removed the inputs, and the outputs are never added to it
+	dropped := false
+	if err == nil {
+		err = db.logAndApply(edit, func() {
+			dropped = cf.dropped
+			if c.level > 0 {
+				_, cf.compactPointer[c.level] = keyRange(cf.opts.Comparator, c.inputs[0])
+			}
+		})
+	}
+
+	if err != nil || dropped {
+		db.removeTables(outputs)
+		return
+	}
+
+	// Iterators that still read the inputs keep them open after they're removed
+	db.removeTables(edit.removed)
+
+	written := totalSize(outputs)
+	cf.stats.addCompacted(written)
+
+	stats := cf.CompactionStats()
+	log.WithField("writeAmplification", stats.WriteAmplification).Infof("Compacted %d bytes into level %d",
+		written, c.outputLevel)
+
+	return
+}
+
+// isOldestForKey returns true if no table of the column family older than the inputs of 'c' can hold 'key'. Those
+// are the tables of level 0 older than the inputs when the output stays in level 0, and the tables of deeper levels.
+// Must be called with db.mu held
+func (db *DB) isOldestForKey(c *compaction, key string) bool {
+	cmp := c.cf.opts.Comparator
+	if c.outputLevel == 0 {
+		oldest, older := c.inputs[0][len(c.inputs[0])-1], false
+		for _, m := range c.cf.levels[0] {
+			if older && m.contains(cmp, key) {
+				return false
+			}
+
+			older = older || m == oldest
+		}
+	}
+
+	for l := c.outputLevel + 1; l < MAX_LEVELS; l++ {
+		if len(tablesForKey(cmp, l, c.cf.levels[l], key)) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compactionOutput writes the entries of a compaction to new SSTable files of 'level' of the column family 'cf' as
+// they're merged, starting a new file once one reaches 'maxSize' bytes. 'tables' has every table finished, so they can
+// be removed if the compaction fails
+type compactionOutput struct {
+	db      *DB
+	cf      *ColumnFamily
+	level   int
+	maxSize int64
+
+	f      File
+	number uint64
+	table  *sstableWriter
+	tables []*tableMeta
+}
+
+// add writes 'versions', the versions of a key kept by the compaction. Versions of a key never span two tables so
+// tables of a level don't overlap
+func (o *compactionOutput) add(versions []*Entry) (err error) {
+	if len(versions) == 0 {
+		return
+	}
+
+	if o.table != nil && o.maxSize > 0 && o.table.Size() >= o.maxSize {
+		if err = o.finish(); err != nil {
+			return
+		}
+	}
+
+	if o.table == nil {
+		o.number = o.db.newFileNumber()
+		if o.f, err = o.db.fs.Create(tableFileName(o.db.storageFolder, o.number)); err != nil {
+			return errors.Annotate(err, "Could not create sstable file for compaction")
+		}
+		o.table = newSSTableWriter(o.f, o.cf.opts.tableOptions(o.level))
+	}
+
+	for _, e := range versions {
+		if err = o.table.Add(e); err != nil {
+			return errors.Annotatef(err, "Could not write sstable file '%s' for compaction", o.f.Name())
+		}
+	}
+
+	return
+}
+
+// finish completes the table being written, if any, syncs it and opens it. A table that can't be completed is
+// removed
+func (o *compactionOutput) finish() (err error) {
+	if o.table == nil {
+		return
+	}
+
+	f, table := o.f, o.table
+	o.f, o.table = nil, nil
+
+	if err = table.Finish(); err == nil {
+		err = f.Sync()
+	}
+
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		removeFiles(o.db.fs, f.Name())
+		return errors.Annotatef(err, "Could not write sstable file '%s' for compaction", f.Name())
+	}
+
+	m, err := o.db.tables.tableMeta(o.number, o.level, o.cf.opts.Comparator)
+	if err != nil {
+		o.db.tables.evict(o.number)
+		removeFiles(o.db.fs, f.Name())
+		return errors.Annotatef(err, "Could not open sstable file '%s' for compaction", f.Name())
+	}
+	m.family = o.cf.id
+
+	o.tables = append(o.tables, m)
+
+	return
+}
+
+// abort closes and removes the table being written, if any, after an error
+func (o *compactionOutput) abort() {
+	if o.table == nil {
+		return
+	}
+
+	o.f.Close()
+	removeFiles(o.db.fs, o.f.Name())
+	o.f, o.table = nil, nil
+}
+
+// removeTables evicts the tables of 'ms' from the table cache and deletes their files
+func (db *DB) removeTables(ms []*tableMeta) {
+	for _, m := range ms {
+		db.tables.evict(m.number)
+		removeFiles(db.fs, tableFileName(db.storageFolder, m.number))
+	}
+}
+
+// mergeVersions walks 'input', sorted by internal key, and calls 'add' with the versions of each key that are kept:
+// the one with the highest sequence number and the older ones that a snapshot of 'snapshots', in ascending order,
+// reads. Merge operands are collapsed by 'm'. Only the versions of one key are held in memory at a time
+func mergeVersions(input internalIterator, snapshots []uint64, m *versionMerger, add func(versions []*Entry) error) (
+	err error) {
+	versions := make([]*Entry, 0)
+	for input.SeekToFirst(); input.Valid(); {
+		key := input.Entry().Key
+
+		versions = versions[:0]
+		for ; input.Valid() && input.Entry().Key == key; input.Next() {
+			versions = append(versions, input.Entry())
+		}
+
+		if err = add(visibleVersions(versions, snapshots, m)); err != nil {
+			return
+		}
+	}
+
+	if err = input.Error(); err != nil {
+		return errors.Annotate(err, "Could not read the inputs of the compaction")
+	}
+
+	return
+}
+
+func withoutTables(tables, remove []*tableMeta) []*tableMeta {
+	res := make([]*tableMeta, 0, len(tables))
+
+next:
+	for _, m := range tables {
+		for _, r := range remove {
+			if m == r {
+				continue next
+			}
+		}
+
+		res = append(res, m)
+	}
+
+	return res
+}
@@ -0,0 +1,55 @@
+package doom
+
+import "sort"
+
+// leveledCompaction is the strategy of LevelDB. Level 0 is compacted into level 1 once it has
+// Options.L0CompactionTrigger tables and every other level is compacted into the next one, a table at a time, once it
+// grows over maxBytesForLevel. Levels from 1 on never have overlapping tables, so reads check at most one table per
+// level
+type leveledCompaction struct{}
+
+// score returns how much 'level' needs a compaction. Anything at 1 or above needs it
+func (leveledCompaction) score(cf *ColumnFamily, level int) float64 {
+	if level == 0 {
+		return float64(len(cf.levels[0])) / float64(cf.opts.L0CompactionTrigger)
+	}
+
+	return float64(totalSize(cf.levels[level])) / float64(cf.opts.maxBytesForLevel(level))
+}
+
+// pick returns the compaction of the level with the highest score
+func (s leveledCompaction) pick(cf *ColumnFamily) *compaction {
+	best, bestScore := -1, 1.0
+	for level := 0; level < MAX_LEVELS-1; level++ {
+		if score := s.score(cf, level); score >= bestScore {
+			best, bestScore = level, score
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	c := &compaction{level: best, outputLevel: best + 1, maxOutputSize: cf.opts.TableFileSize}
+	if best == 0 {
+		// Tables of level 0 overlap each other so all of them are compacted together. Otherwise an older value left
+		// in level 0 would shadow a newer one moved to level 1
+		c.inputs[0] = append(c.inputs[0], cf.levels[0]...)
+	} else {
+		// Tables of other levels are compacted one at a time, rotating through the key space
+		tables := cf.levels[best]
+		i := sort.Search(len(tables), func(i int) bool {
+			return cf.opts.Comparator.Compare(tables[i].smallest, cf.compactPointer[best]) > 0
+		})
+		if i == len(tables) {
+			i = 0
+		}
+
+		c.inputs[0] = []*tableMeta{tables[i]}
+	}
+
+	smallest, largest := keyRange(cf.opts.Comparator, c.inputs[0])
+	c.inputs[1] = overlappingTables(cf.opts.Comparator, cf.levels[best+1], smallest, largest)
+
+	return c
+}
@@ -0,0 +1,217 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitForCompactions(t *testing.T, db *DB) {
+	for i := 0; i < 500; i++ {
+		if db.pickCompaction() == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Compactions didn't finish in time")
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	// Small tables and levels, so compactions write several tables and reach level 2
+	opts := &Options{TableFileSize: 256, L1MaxSize: 1024}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 3*DEFAULT_L0_COMPACTION_TRIGGER; round++ {
+		for i := 0; i < 50; i++ {
+			db.Put(fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value %d of round %d", i, round)))
+		}
+
+		db.Delete(fmt.Sprintf("key%03d", round))
+
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForCompactions(t, db)
+
+	check := func(t *testing.T, db *DB) {
+		last := 3*DEFAULT_L0_COMPACTION_TRIGGER - 1
+		for i := 0; i < 50; i++ {
+			value, err := db.Get(fmt.Sprintf("key%03d", i))
+			if i == last {
+				if err != ErrNotFound {
+					t.Errorf("Expected key%03d to be deleted, got '%s'", i, value)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := fmt.Sprintf("value %d of round %d", i, last); string(value) != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, value)
+			}
+		}
+	}
+
+	t.Run("values after compaction", func(t *testing.T) {
+		check(t, db)
+
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		if len(db.defaultCF.levels[0]) >= DEFAULT_L0_COMPACTION_TRIGGER {
+			t.Errorf("Level 0 wasn't compacted, it has %d tables", len(db.defaultCF.levels[0]))
+		}
+
+		for level := 1; level < MAX_LEVELS; level++ {
+			tables := db.defaultCF.levels[level]
+			for i := 1; i < len(tables); i++ {
+				if tables[i-1].largest >= tables[i].smallest {
+					t.Errorf("Tables of level %d overlap", level)
+				}
+			}
+		}
+
+		if len(db.defaultCF.levels[2]) < 2 {
+			t.Errorf("Expected several tables in level 2, got %d", len(db.defaultCF.levels[2]))
+		}
+	})
+
+	t.Run("values after reopening", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = Open(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		check(t, db)
+	})
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, &Options{CompactionStrategy: SIZE_TIERED_COMPACTION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rounds := 3 * DEFAULT_TIERED_MIN_THRESHOLD
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < 50; i++ {
+			db.Put(fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value %d of round %d", i, round)))
+		}
+
+		db.Delete(fmt.Sprintf("key%03d", round))
+
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForCompactions(t, db)
+
+	t.Run("values after compaction", func(t *testing.T) {
+		last := rounds - 1
+		for i := 0; i < 50; i++ {
+			value, err := db.Get(fmt.Sprintf("key%03d", i))
+			if i == last {
+				if err != ErrNotFound {
+					t.Errorf("Expected key%03d to be deleted, got '%s'", i, value)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := fmt.Sprintf("value %d of round %d", i, last); string(value) != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, value)
+			}
+		}
+	})
+
+	t.Run("tables stay in level 0", func(t *testing.T) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		if len(db.defaultCF.levels[0]) >= rounds {
+			t.Errorf("Level 0 wasn't compacted, it has %d tables", len(db.defaultCF.levels[0]))
+		}
+
+		for level := 1; level < MAX_LEVELS; level++ {
+			if len(db.defaultCF.levels[level]) != 0 {
+				t.Errorf("Expected level %d to be empty, it has %d tables", level, len(db.defaultCF.levels[level]))
+			}
+		}
+	})
+
+	t.Run("write amplification", func(t *testing.T) {
+		stats := db.CompactionStats()
+		if stats.Strategy != SIZE_TIERED_COMPACTION {
+			t.Errorf("Expected strategy '%s', got '%s'", SIZE_TIERED_COMPACTION, stats.Strategy)
+		}
+
+		if stats.BytesCompacted == 0 || stats.WriteAmplification <= 1 {
+			t.Errorf("Expected compacted bytes to add write amplification, got %+v", stats)
+		}
+	})
+}
+
+func TestNewCompactionStrategy(t *testing.T) {
+	if _, err := newCompactionStrategy("unknown"); err == nil {
+		t.Error("Expected an error for an unknown compaction strategy")
+	}
+}
+
+func TestMergeVersions(t *testing.T) {
+	runs := make([]internalIterator, 0)
+	for _, run := range [][]*Entry{
+		{
+			{Key: "a", Data: []byte("old"), Seq: 1}, {Key: "b", Data: []byte("old"), Seq: 2},
+			{Key: "d", Data: []byte("old"), Seq: 3},
+		},
+		{{Key: "b", Data: []byte("new"), Seq: 4}, {Key: "d", Tombstone: true, Seq: 5}},
+	} {
+		s := newSkiplist(BytewiseComparator)
+		for _, e := range run {
+			s.insert(e)
+		}
+		runs = append(runs, s.newIterator())
+	}
+
+	merged := make([]*Entry, 0)
+	err := mergeVersions(newMergingIterator(BytewiseComparator, runs), nil, nil, func(versions []*Entry) error {
+		merged = append(merged, versions...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(merged) != 3 {
+		t.Fatalf("Unexpected number of entries '%d'", len(merged))
+	}
+
+	if merged[0].Key != "a" || string(merged[1].Data) != "new" || !merged[2].Tombstone {
+		t.Errorf("Unexpected merged entries '%v'", merged)
+	}
+}
@@ -0,0 +1,75 @@
+package doom
+
+import "math"
+
+// sizeTieredCompaction keeps every table in level 0 and merges tables of similar size, so each byte is rewritten about
+// once per tier instead of once per level. It suits write-heavy workloads at the cost of more tables to check on reads.
+//
+// Tables are grouped in buckets of tables of similar age and size, from the newest to the oldest. A table joins the
+// bucket of the previous one if its size is between Options.TieredBucketLow and TieredBucketHigh times the average of
+// the bucket, or if both are smaller than Options.TableFileSize. Only tables next to each other in age can be merged,
+// because the age of a table decides which value of a key is the newest one
+type sizeTieredCompaction struct{}
+
+// pick returns the compaction of the bucket with at least Options.TieredMinThreshold tables with the smallest tables,
+// merging up to TieredMaxThreshold of them into a single table. The output isn't split, as tables of a bucket would be
+// merged again with the pieces of the same size, but it's written as the inputs are read, like every compaction, so
+// merging a bucket only holds a block of each input in memory
+func (sizeTieredCompaction) pick(cf *ColumnFamily) *compaction {
+	var best []*tableMeta
+	bestAverage := int64(math.MaxInt64)
+
+	for _, bucket := range sizeTieredBuckets(cf.opts, cf.levels[0]) {
+		if len(bucket) < cf.opts.TieredMinThreshold {
+			continue
+		}
+
+		if len(bucket) > cf.opts.TieredMaxThreshold {
+			bucket = bucket[:cf.opts.TieredMaxThreshold]
+		}
+
+		if average := totalSize(bucket) / int64(len(bucket)); average < bestAverage {
+			best, bestAverage = bucket, average
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	c := &compaction{level: 0, outputLevel: 0}
+	c.inputs[0] = best
+
+	return c
+}
+
+// sizeTieredBuckets groups tables of level 0, which are sorted from the newest to the oldest, in buckets of
+// consecutive tables of similar size
+func sizeTieredBuckets(o *Options, tables []*tableMeta) [][]*tableMeta {
+	buckets := make([][]*tableMeta, 0)
+
+	var bucket []*tableMeta
+	for _, m := range tables {
+		if len(bucket) > 0 && !isSimilarSize(o, bucket, m) {
+			buckets = append(buckets, bucket)
+			bucket = nil
+		}
+
+		bucket = append(bucket, m)
+	}
+
+	if len(bucket) > 0 {
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+func isSimilarSize(o *Options, bucket []*tableMeta, m *tableMeta) bool {
+	average := float64(totalSize(bucket)) / float64(len(bucket))
+	if average < float64(o.TableFileSize) && m.size < o.TableFileSize {
+		return true
+	}
+
+	return float64(m.size) >= average*o.TieredBucketLow && float64(m.size) <= average*o.TieredBucketHigh
+}
@@ -0,0 +1,65 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"strings"
+)
+
+// ErrComparatorMismatch is returned when a DB or an SSTable is opened with a comparator that isn't the one it was
+// written with
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
+// Comparator orders the keys of a DB. Its name is logged in the MANIFEST and stored in every SSTable, and data written
+// with a comparator can't be opened with another one
+type Comparator interface {
+	// Name identifies the ordering. It must change whenever the ordering does
+	Name() string
+
+	// Compare returns -1, 0 or 1 if 'a' sorts before, equal or after 'b'. It must only return 0 for identical keys
+	Compare(a, b string) int
+
+	// Separator returns a key, as short as possible, that sorts at or after 'a' and before 'b', where 'a' sorts
+	// before 'b'. SSTables index their blocks with it. Returning 'a' is always right
+	Separator(a, b string) string
+
+	// Successor returns a key, as short as possible, that sorts at or after 'a'. Returning 'a' is always right
+	Successor(a string) string
+}
+
+// BytewiseComparator orders keys by their bytes, like Go compares strings. It's the default comparator
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string {
+	return "doomdb.BytewiseComparator"
+}
+
+func (bytewiseComparator) Compare(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+// Separator increments the first byte where 'a' and 'b' differ, if that leaves it below the byte of 'b'
+func (bytewiseComparator) Separator(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	if i < len(a) && i < len(b) && a[i] < 0xff && a[i]+1 < b[i] {
+		return a[:i] + string([]byte{a[i] + 1})
+	}
+
+	return a
+}
+
+// Successor increments the first byte of 'a' that can be incremented and drops the rest
+func (bytewiseComparator) Successor(a string) string {
+	for i := 0; i < len(a); i++ {
+		if a[i] != 0xff {
+			return a[:i] + string([]byte{a[i] + 1})
+		}
+	}
+
+	return a
+}
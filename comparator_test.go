@@ -0,0 +1,186 @@
+package doom
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// reverseComparator sorts keys from the largest to the smallest bytewise
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string                 { return "test.ReverseComparator" }
+func (reverseComparator) Compare(a, b string) int      { return strings.Compare(b, a) }
+func (reverseComparator) Separator(a, b string) string { return a }
+func (reverseComparator) Successor(a string) string    { return a }
+
+func TestBytewiseComparator(t *testing.T) {
+	separators := []struct {
+		a, b, expected string
+	}{
+		{"abc1xyz", "abc5", "abc2"},
+		{"abc1xyz", "abc2", "abc1xyz"},
+		{"abc", "abcdef", "abc"},
+		{"a\xffz", "b", "a\xffz"},
+		{"", "b", ""},
+	}
+
+	for _, s := range separators {
+		if got := BytewiseComparator.Separator(s.a, s.b); got != s.expected {
+			t.Errorf("Expected separator '%s' of '%s' and '%s', got '%s'", s.expected, s.a, s.b, got)
+		}
+	}
+
+	successors := []struct {
+		a, expected string
+	}{
+		{"abc", "b"},
+		{"\xff\xffa", "\xff\xffb"},
+		{"\xff\xff", "\xff\xff"},
+		{"", ""},
+	}
+
+	for _, s := range successors {
+		if got := BytewiseComparator.Successor(s.a); got != s.expected {
+			t.Errorf("Expected successor '%s' of '%s', got '%s'", s.expected, s.a, got)
+		}
+	}
+}
+
+func TestShortIndexKeys(t *testing.T) {
+	// Every entry takes its own block and the first bytes of the keys skip a value, so the index keys can be cut
+	// after it
+	es := make([]*Entry, 0)
+	for i := 0; i < 100; i += 2 {
+		es = append(es, &Entry{Key: string([]byte{byte(i)}) + "-with-a-long-suffix", Data: []byte("value"), Seq: 1})
+	}
+
+	f, _ := ioutil.TempFile("/tmp", SSTABLES_PREFIX)
+	defer os.Remove(f.Name())
+
+	o := testTableOptions
+	o.blockSize = 1
+	w := newSSTableWriter(f, o)
+	for _, e := range es {
+		if err := w.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	table, err := OpenSSTable(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	for _, i := range table.index {
+		if len(i.lastKey) >= len(es[0].Key)+INTERNAL_KEY_TRAILER_SIZE {
+			t.Errorf("Expected a shortened index key, got %q", i.lastKey)
+		}
+	}
+
+	for _, e := range es {
+		if got, err := table.Get(e.Key); err != nil || got == nil {
+			t.Errorf("Expected to find '%s', got %v", e.Key, err)
+		}
+	}
+
+	// A key between two blocks sorts before the index key of the first one but it's found in the next one
+	it := table.newIterator(false)
+	for i := 1; i < 99; i += 2 {
+		it.Seek(string([]byte{byte(i)}), MAX_SEQUENCE)
+		if expected := es[(i+1)/2].Key; !it.Valid() || it.Entry().Key != expected {
+			t.Fatalf("Expected seeking %d to find %q", i, expected)
+		}
+	}
+}
+
+func TestCustomComparator(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{FS: fs, Comparator: reverseComparator{}, WriteBufferSize: 1024, L0CompactionTrigger: 2}
+
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if err = db.Put(fmt.Sprintf("key%03d", i%100), []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForCompactions(t, db)
+	if stats := db.CompactionStats(); stats.BytesCompacted == 0 {
+		t.Error("Expected compactions with the custom comparator")
+	}
+
+	t.Run("reads", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			value, err := db.Get(fmt.Sprintf("key%03d", i))
+			if err != nil || string(value) != fmt.Sprintf("value %d", 400+i) {
+				t.Errorf("Unexpected value '%s' of key%03d (%v)", value, i, err)
+			}
+		}
+	})
+
+	t.Run("iterator in the order of the comparator", func(t *testing.T) {
+		// The lower bound is the largest key bytewise
+		it := db.NewIterator(&IterOptions{LowerBound: "key080", UpperBound: "key020"})
+		defer it.Close()
+
+		expected := 80
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if key := fmt.Sprintf("key%03d", expected); it.Key() != key {
+				t.Fatalf("Expected '%s', got '%s'", key, it.Key())
+			}
+			expected--
+		}
+
+		if expected != 20 {
+			t.Errorf("Expected the iterator to stop before key020, it stopped before key%03d", expected)
+		}
+	})
+
+	db.Close()
+
+	t.Run("other comparator refused", func(t *testing.T) {
+		if _, err := Open("/db", &Options{FS: fs}); errors.Cause(err) != ErrComparatorMismatch {
+			t.Errorf("Expected ErrComparatorMismatch, got %v", err)
+		}
+
+		db, err := Open("/db", opts)
+		if err != nil {
+			t.Fatalf("Could not open the DB with its comparator: %v", err)
+		}
+		db.Close()
+	})
+
+	t.Run("table written with another comparator", func(t *testing.T) {
+		f, _ := ioutil.TempFile("/tmp", SSTABLES_PREFIX)
+		defer os.Remove(f.Name())
+
+		o := testTableOptions
+		o.comparator = reverseComparator{}
+		w := newSSTableWriter(f, o)
+		w.Add(&Entry{Key: "key", Data: []byte("value"), Seq: 1})
+		if err := w.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if _, err := OpenSSTable(f.Name()); errors.Cause(err) != ErrComparatorMismatch {
+			t.Errorf("Expected ErrComparatorMismatch, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package doom
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"github.com/juju/errors"
+	"io"
+	"io/ioutil"
+)
+
+// compressBlock returns 'b' compressed with 'compression' and the compression type to record in its trailer. The
+// block is kept uncompressed if compressing it doesn't save at least an eighth of its size
+func compressBlock(b []byte, compression byte) (res []byte, used byte, err error) {
+	if compression == BLOCK_NO_COMPRESSION {
+		return b, BLOCK_NO_COMPRESSION, nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case BLOCK_FLATE_COMPRESSION:
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case BLOCK_GZIP_COMPRESSION:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, 0, errors.Errorf("Unknown compression type %d", compression)
+	}
+
+	if _, err = w.Write(b); err == nil {
+		err = w.Close()
+	}
+
+	if err != nil {
+		return nil, 0, errors.Annotate(err, "Could not compress block")
+	}
+
+	if buf.Len() > len(b)-len(b)/8 {
+		return b, BLOCK_NO_COMPRESSION, nil
+	}
+
+	return buf.Bytes(), compression, nil
+}
+
+// decompressBlock returns the contents of a block stored with 'compression'
+func decompressBlock(b []byte, compression byte) (res []byte, err error) {
+	var r io.ReadCloser
+	switch compression {
+	case BLOCK_NO_COMPRESSION:
+		return b, nil
+	case BLOCK_FLATE_COMPRESSION:
+		r = flate.NewReader(bytes.NewReader(b))
+	case BLOCK_GZIP_COMPRESSION:
+		if r, err = gzip.NewReader(bytes.NewReader(b)); err != nil {
+			return nil, errors.Annotate(ErrCorruptedSSTable, err.Error())
+		}
+	default:
+		return nil, errors.Annotatef(ErrCorruptedSSTable, "Unknown compression type %d", compression)
+	}
+	defer r.Close()
+
+	if res, err = ioutil.ReadAll(r); err != nil {
+		return nil, errors.Annotate(ErrCorruptedSSTable, err.Error())
+	}
+
+	return
+}
@@ -1,7 +1,119 @@
 package doom
 
+import "time"
+
 const (
 	SSTABLES_PREFIX = "sstable"
-	INDEX_PREFIX    = "index"
 	WAL_PREFIX      = "write-ahead-log-"
 )
+
+// Record types and sizes of the framed format used in WAL files
+const (
+	RECORD_VALUE     byte = 1
+	RECORD_TOMBSTONE byte = 2
+	RECORD_BATCH     byte = 3
+
+	// RECORD_EXPIRING_VALUE is a value that expires. Its stored value starts with EXPIRY_SIZE bytes, little endian,
+	// with the unix time in nanoseconds when it expires
+	RECORD_EXPIRING_VALUE byte = 4
+	EXPIRY_SIZE                = 8
+
+	// RECORD_MERGE is an operand of the merge operator of the DB, stacked over the older versions of its key
+	RECORD_MERGE byte = 5
+
+	// RECORD_COLUMN_FAMILY is an operation of a batch on a column family other than the default one. Its key starts
+	// with the id of the family, as an unsigned varint, and the record type of the operation
+	RECORD_COLUMN_FAMILY byte = 6
+
+	RECORD_HEADER_SIZE       = 13
+	RECORD_BATCH_HEADER_SIZE = 12
+	MAX_RECORD_PAYLOAD_SIZE  = 1 << 30
+)
+
+// Internal keys end with 8 bytes holding the sequence number of the write and its record type, so sequence numbers
+// have 56 bits
+const (
+	INTERNAL_KEY_TRAILER_SIZE        = 8
+	MAX_SEQUENCE              uint64 = 1<<56 - 1
+)
+
+// Sizes and identifiers of the block based SSTable format
+const (
+	BLOCK_NO_COMPRESSION    byte = 0
+	BLOCK_FLATE_COMPRESSION byte = 1
+	BLOCK_GZIP_COMPRESSION  byte = 2
+	BLOCK_TRAILER_SIZE           = 5
+
+	SSTABLE_FOOTER_SIZE           = 44
+	SSTABLE_FORMAT_VERSION uint32 = 2
+	SSTABLE_MAGIC          uint64 = 0x646f6f6d64622e73
+
+	SSTABLE_FILTER_BLOCK_NAME     = "filter.bloom"
+	SSTABLE_PROPERTIES_BLOCK_NAME = "properties"
+	SSTABLE_MAX_SEQUENCE_PROPERTY = "sequence.max"
+	SSTABLE_COMPARATOR_PROPERTY   = "comparator"
+)
+
+// Shape of the skiplist of the MemTable. SKIPLIST_NODE_OVERHEAD is the approximate number of bytes that a node and
+// its entry take besides the key, the value and the links to other nodes
+const (
+	SKIPLIST_MAX_HEIGHT    = 12
+	SKIPLIST_BRANCHING     = 4
+	SKIPLIST_NODE_OVERHEAD = 96
+)
+
+// Names of the files of a DB. Tables and WAL files take their number from a counter kept in the MANIFEST, which logs
+// every change to the set of live files. CURRENT holds the name of the MANIFEST in use and LOCK is locked by the
+// process that has the DB open for writing
+const (
+	SSTABLE_FILE_EXT = ".sst"
+	WAL_FILE_EXT     = ".log"
+	MANIFEST_PREFIX  = "MANIFEST-"
+	CURRENT_FILE     = "CURRENT"
+	LOCK_FILE        = "LOCK"
+	TEMP_FILE_EXT    = ".tmp"
+)
+
+// Number of levels of SSTables
+const MAX_LEVELS = 7
+
+// The default column family always exists and it can't be dropped
+const (
+	DEFAULT_COLUMN_FAMILY           = "default"
+	DEFAULT_COLUMN_FAMILY_ID uint32 = 0
+)
+
+// Number of shards of the block cache, each one with its own lock and its share of Options.BlockCacheSize
+const BLOCK_CACHE_SHARDS = 16
+
+// Compaction strategies that can be set in Options.CompactionStrategy
+const (
+	LEVELED_COMPACTION     = "leveled"
+	SIZE_TIERED_COMPACTION = "size-tiered"
+)
+
+// Policies that can be set in Options.WALSyncPolicy
+const (
+	WAL_SYNC_ALWAYS   = "always"
+	WAL_SYNC_PERIODIC = "periodic"
+	WAL_SYNC_NEVER    = "never"
+)
+
+// Default values of Options
+const (
+	DEFAULT_WRITE_BUFFER_SIZE     = 4 << 20
+	DEFAULT_MAX_WRITE_GROUP_SIZE  = 1 << 20
+	DEFAULT_WAL_SYNC_INTERVAL     = 100 * time.Millisecond
+	DEFAULT_TABLE_FILE_SIZE       = 2 << 20
+	DEFAULT_BLOCK_SIZE            = 4096
+	DEFAULT_BLOOM_BITS_PER_KEY    = 10
+	DEFAULT_BLOCK_CACHE_SIZE      = 8 << 20
+	DEFAULT_MAX_OPEN_FILES        = 500
+	DEFAULT_L0_COMPACTION_TRIGGER = 4
+	DEFAULT_L1_MAX_SIZE           = 10 << 20
+	DEFAULT_LEVEL_SIZE_MULTIPLIER = 10
+	DEFAULT_TIERED_MIN_THRESHOLD  = 4
+	DEFAULT_TIERED_MAX_THRESHOLD  = 32
+	DEFAULT_TIERED_BUCKET_LOW     = 0.5
+	DEFAULT_TIERED_BUCKET_HIGH    = 1.5
+)
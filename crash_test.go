@@ -0,0 +1,140 @@
+package doom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// crashWorkload puts keys and deletes some of them until it's done or a write fails, with small MemTables so it
+// flushes and compacts on the way. It returns the operations that were acknowledged, a nil value being a delete, and
+// the key of the one that failed, which may or may not be applied
+func crashWorkload(db *DB) (acked map[string][]byte, failed string) {
+	acked = make(map[string][]byte)
+
+	for i := 0; i < 300; i++ {
+		key, value := fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value %d", i))
+
+		var err error
+		if i%10 == 9 {
+			key, value = fmt.Sprintf("key%04d", i-5), nil
+			err = db.Delete(key)
+		} else {
+			err = db.Put(key, value)
+		}
+
+		if err != nil {
+			return acked, key
+		}
+
+		acked[key] = value
+	}
+
+	return
+}
+
+func TestCrashRecovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+
+		// after returns the files found when the DB is opened again
+		after func(fs *MemFS) FS
+	}{
+		// Every acknowledged write is in the WAL when the process dies, synced or not
+		{"process crash", WAL_SYNC_NEVER, func(fs *MemFS) FS { return fs }},
+
+		// Only synced data survives, but every write is synced before it's acknowledged
+		{"power failure", WAL_SYNC_ALWAYS, func(fs *MemFS) FS { return fs.CrashClone() }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The workload is crashed at every write it does, until it's done without crashing
+			start := time.Now()
+			for point := 1; ; point++ {
+				mem := NewMemFS()
+				fs := NewFaultFS(mem)
+
+				opts := &Options{FS: fs, WALDir: "/wal", WriteBufferSize: 2048, WALSyncPolicy: test.policy}
+				db, err := Open("/db", opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				fs.CrashAtNthWrite(point)
+				acked, failed := crashWorkload(db)
+				crashed := fs.Crashed()
+				db.Close()
+
+				opts.FS = test.after(mem)
+				if db, err = Open("/db", opts); err != nil {
+					t.Fatalf("Could not open the DB after a crash at write %d: %v", point, err)
+				}
+
+				for key, value := range acked {
+					if key == failed {
+						continue
+					}
+
+					got, err := db.Get(key)
+					if value == nil && err != ErrNotFound {
+						t.Errorf("Expected '%s' deleted after a crash at write %d, got '%s' (%v)", key, point, got,
+							err)
+					} else if value != nil && string(got) != string(value) {
+						t.Errorf("Expected '%s' for '%s' after a crash at write %d, got '%s' (%v)", value, key,
+							point, got, err)
+					}
+				}
+				db.Close()
+
+				if t.Failed() || !crashed {
+					t.Logf("Crashed at %d points in %s", point-1, time.Since(start))
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestCrashAfterWALSwitch(t *testing.T) {
+	for _, policy := range []string{WAL_SYNC_PERIODIC, WAL_SYNC_NEVER} {
+		t.Run(policy, func(t *testing.T) {
+			fs := NewMemFS()
+			opts := &Options{FS: fs, WALDir: "/wal", WriteBufferSize: 64, WALSyncPolicy: policy,
+				WALSyncInterval: time.Hour}
+			db, err := Open("/db", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The flush of the old MemTable can't log its table, so its WAL is the only copy of the unsynced write
+			db.manifestMu.Lock()
+
+			if err = db.Put("unsynced", make([]byte, 64)); err != nil {
+				t.Fatal(err)
+			}
+
+			var b WriteBatch
+			b.Put("synced", []byte("value"))
+			if err = db.WriteWithOptions(&b, &WriteOptions{Sync: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			opts.FS = fs.CrashClone()
+			db.manifestMu.Unlock()
+			db.Close()
+
+			if db, err = Open("/db", opts); err != nil {
+				t.Fatalf("Could not open the DB after a power failure: %v", err)
+			}
+			defer db.Close()
+
+			for _, key := range []string{"unsynced", "synced"} {
+				if _, err := db.Get(key); err != nil {
+					t.Errorf("Expected '%s' after a power failure, got %v", key, err)
+				}
+			}
+		})
+	}
+}
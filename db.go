@@ -0,0 +1,414 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a key doesn't exist or it has been deleted
+	ErrNotFound = errors.New("key not found")
+
+	// ErrClosed is returned by the writes and flushes that were waiting when the DB was closed
+	ErrClosed = errors.New("db closed")
+
+	// ErrReadOnly is returned by the writes and flushes of a DB opened with Options.ReadOnly
+	ErrReadOnly = errors.New("db opened read-only")
+)
+
+// DB is a database made of a MemTable and the levels of SSTables that are flushed from it. When the MemTable grows past
+// Options.WriteBufferSize it's frozen as immutable and a background goroutine flushes it into a new table of level 0
+// while an empty one takes the writes. Another goroutine compacts the levels with the strategy chosen when the DB was
+// opened. Keys are kept in column families, each one with its own levels and options, that share the MemTable and its
+// WAL.
+//
+// A DB is safe for concurrent use. Writes and flushes wait in a queue and are applied by one goroutine at a time, which
+// commits the batches of the writers waiting behind it together. Reads don't wait for writes
+type DB struct {
+	opts                      *Options
+	fs                        FS
+	tempFolder, storageFolder string
+
+	// lock is held on the LOCK file while the DB is open for writing
+	lock io.Closer
+
+	// seq is the sequence number of the last write visible to reads. Every write takes the next one
+	seq       uint64
+	snapshots snapshotList
+
+	// writeMu protects the queue of writers. Only the writer at its front changes the MemTable or db.seq
+	writeMu sync.Mutex
+	writers []*writer
+
+	// manifestMu serializes the changes to the live files, which are logged to the MANIFEST before being applied.
+	// It protects logNumber, the number of the oldest WAL file that isn't stored in a table, and lastFamily, the
+	// highest id given to a column family. nextFile is the next number for a table or a WAL file
+	manifestMu sync.Mutex
+	manifest   *manifest
+	logNumber  uint64
+	nextFile   uint64
+	lastFamily uint32
+
+	cache     *blockCache
+	tables    *tableCache
+	defaultCF *ColumnFamily
+
+	// mu protects the MemTables, the live column families and their levels, which change on flushes and
+	// compactions, and bgErr. bgCond is signaled when the immutable MemTable is flushed
+	mu       sync.RWMutex
+	bgCond   *sync.Cond
+	mem, imm *MemTable
+	bgErr    error
+	families map[uint32]*ColumnFamily
+
+	flushc   chan struct{}
+	compactc chan struct{}
+	closing  chan struct{}
+	closed   int32
+	wg       sync.WaitGroup
+}
+
+// Open opens the DB stored in the folder 'dir' with 'opts', which can be nil to take the defaults. It locks the folder,
+// opens the column families and the SSTables of the MANIFEST, creates a MemTable with the contents of the WAL files
+// that aren't stored in tables yet and starts compacting in background. Files that aren't live are removed. DBs opened
+// with different options are independent of each other, but only one at a time can have a folder open for writing: the
+// rest get ErrLocked until it's closed
+func Open(dir string, opts *Options) (db *DB, err error) {
+	if opts, err = opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// Another process would replay and remove the WAL files of this one
+	var lock io.Closer
+	if !opts.ReadOnly {
+		if lock, err = opts.FS.Lock(filepath.Join(dir, LOCK_FILE)); err != nil {
+			return nil, errors.Annotatef(err, "Could not lock folder %s", dir)
+		}
+
+		defer func() {
+			if err != nil {
+				lock.Close()
+			}
+		}()
+	}
+
+	walDir := opts.WALDir
+	if walDir == "" {
+		walDir = dir
+	}
+
+	db = &DB{
+		opts:          opts,
+		fs:            opts.FS,
+		tempFolder:    walDir,
+		storageFolder: dir,
+		lock:          lock,
+		cache:         newBlockCache(opts.BlockCacheSize),
+		families:      make(map[uint32]*ColumnFamily),
+		flushc:        make(chan struct{}, 1),
+		compactc:      make(chan struct{}, 1),
+		closing:       make(chan struct{}),
+	}
+
+	db.bgCond = sync.NewCond(&db.mu)
+	db.tables = newTableCache(db.fs, dir, opts.MaxOpenFiles, db.cache)
+
+	if db.defaultCF, err = db.newColumnFamily(DEFAULT_COLUMN_FAMILY_ID, DEFAULT_COLUMN_FAMILY, opts); err != nil {
+		return nil, err
+	}
+	db.families[DEFAULT_COLUMN_FAMILY_ID] = db.defaultCF
+
+	if err = db.recover(); err != nil {
+		return nil, errors.Annotate(err, "Could not recover the live files")
+	}
+
+	// Files numbered from here on weren't logged by the DB, so they're skipped but never removed
+	issued := db.nextFile
+	if err = db.skipFileNumbersOnDisk(); err != nil {
+		return nil, err
+	}
+
+	if db.mem, err = db.createMemTable(); err != nil {
+		return nil, errors.Annotate(err, "Could not create MemTable")
+	}
+
+	if err = db.replayWALs(); err != nil {
+		return nil, errors.Annotate(err, "Could not read WAL files")
+	}
+
+	if db.mem.LastSeq > db.seq {
+		db.seq = db.mem.LastSeq
+	}
+
+	if opts.ReadOnly {
+		return
+	}
+
+	// Every WAL before the one of the new MemTable has been replayed into it
+	db.logNumber = db.mem.number
+	if db.manifest, err = createManifest(db.fs, dir, db.newFileNumber(), db.snapshotEdit()); err != nil {
+		return nil, err
+	}
+
+	db.removeObsoleteFiles(issued)
+
+	db.wg.Add(2)
+	go db.flushLoop()
+	go db.compactionLoop()
+	if opts.WALSyncPolicy == WAL_SYNC_PERIODIC {
+		db.wg.Add(1)
+		go db.syncLoop()
+	}
+	db.maybeScheduleCompaction()
+
+	return
+}
+
+// NewDB opens the DB stored in 'storageFolder' with its WAL files in 'tempFolder' and the default options
+func NewDB(tempFolder, storageFolder string) (*DB, error) {
+	return Open(storageFolder, &Options{WALDir: tempFolder})
+}
+
+// CacheStats returns the counters of the block cache shared by the SSTables of the DB. They are all zero if
+// the cache was disabled in the Options of the DB
+func (db *DB) CacheStats() CacheStats {
+	return db.cache.stats()
+}
+
+// FilterStats returns the counters of the Bloom filters checked by the lookups of the DB in its SSTables
+func (db *DB) FilterStats() FilterStats {
+	return db.tables.filters.load()
+}
+
+// Put stores 'value' for 'key'
+func (db *DB) Put(key string, value []byte) error {
+	var b WriteBatch
+	b.Put(key, value)
+
+	return db.Write(&b)
+}
+
+// Delete removes 'key'. Its older values are dropped when compaction reaches the last level that has them
+func (db *DB) Delete(key string) error {
+	var b WriteBatch
+	b.Delete(key)
+
+	return db.Write(&b)
+}
+
+// Write applies every operation of 'b' atomically. Later operations of the batch on the same key win over earlier
+// ones. Reads see all of them or none
+func (db *DB) Write(b *WriteBatch) error {
+	return db.WriteWithOptions(b, nil)
+}
+
+// WriteWithOptions is Write committed as 'opts' say. Nil options are the zero WriteOptions
+func (db *DB) WriteWithOptions(b *WriteBatch, opts *WriteOptions) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if b.Count() == 0 {
+		return nil
+	}
+
+	if b.merges > 0 && db.opts.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	if err := db.checkFamilies(b); err != nil {
+		return err
+	}
+
+	w := &writer{batch: b}
+	if opts != nil {
+		w.sync = opts.Sync
+	}
+
+	return db.enqueue(w)
+}
+
+// checkFamilies returns an error if 'b' writes to a column family that isn't of the DB, or that was dropped, or merge
+// operands to one without a merge operator
+func (db *DB) checkFamilies(b *WriteBatch) error {
+	if len(b.families) == 0 {
+		return nil
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for cf, merges := range b.families {
+		switch {
+		case cf.db != db:
+			return errors.Errorf("Column family '%s' is of another DB", cf.name)
+		case cf.dropped:
+			return errors.Annotatef(ErrColumnFamilyDropped, "Could not write to column family '%s'", cf.name)
+		case merges && cf.opts.MergeOperator == nil:
+			return errors.Annotatef(ErrNoMergeOperator, "Could not merge into column family '%s'", cf.name)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the value of 'key' with the highest sequence number, from the MemTable or from the SSTables. It
+// returns ErrNotFound if the key doesn't exist or if its newest entry is a tombstone or an expired value. Merge
+// operands written after the value are merged with it
+func (db *DB) Get(key string) (value []byte, err error) {
+	return db.get(db.defaultCF, key, atomic.LoadUint64(&db.seq))
+}
+
+// get returns the value of the newest entry of 'key' of the column family 'cf' with a sequence number up to 'seq'.
+// Merge operands are collected, from the newest to the oldest, until the version that they're stacked on is found,
+// and merged with it
+func (db *DB) get(cf *ColumnFamily, key string, seq uint64) (value []byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if cf.dropped {
+		return nil, ErrColumnFamilyDropped
+	}
+
+	operands := make([]*Entry, 0)
+	for {
+		e, err := db.lookup(cf, key, seq)
+		if err != nil {
+			return nil, err
+		}
+
+		if e == nil || !e.Merge {
+			if len(operands) > 0 {
+				return mergeValue(cf.opts.MergeOperator, key, e, operands, time.Now().UnixNano())
+			} else if e == nil {
+				return nil, ErrNotFound
+			}
+
+			return entryValue(e)
+		}
+
+		// Sequence numbers start at 1, so there's nothing older than an operand with 0
+		operands = append(operands, e)
+		if e.Seq == 0 {
+			return mergeValue(cf.opts.MergeOperator, key, nil, operands, time.Now().UnixNano())
+		}
+		seq = e.Seq - 1
+	}
+}
+
+// lookup returns the newest entry of 'key' of the column family 'cf' with a sequence number up to 'seq', or nil if
+// there is none. It must be called with the lock of the DB held
+func (db *DB) lookup(cf *ColumnFamily, key string, seq uint64) (*Entry, error) {
+	if e := db.mem.lookup(cf.id, key, seq); e != nil {
+		return e, nil
+	}
+
+	if db.imm != nil {
+		if e := db.imm.lookup(cf.id, key, seq); e != nil {
+			return e, nil
+		}
+	}
+
+	// Any level holds newer entries than the levels below it, but tables of level 0 can overlap so all of them
+	// are checked
+	for level, tables := range cf.levels {
+		var newest *Entry
+		for _, m := range tablesForKey(cf.opts.Comparator, level, tables, key) {
+			t, err := db.tables.get(m.number, cf.opts.Comparator)
+			if err != nil {
+				return nil, errors.Annotatef(err, "Could not read key '%s' from level %d", key, level)
+			}
+
+			e, err := t.get(key, seq)
+			t.release()
+			if err != nil {
+				return nil, errors.Annotatef(err, "Could not read key '%s' from level %d", key, level)
+			}
+
+			if e != nil && (newest == nil || e.Seq > newest.Seq) {
+				newest = e
+			}
+		}
+
+		if newest != nil {
+			return newest, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// entryValue returns a copy of the value of 'e', whose data is shared with the MemTable or the block cache
+func entryValue(e *Entry) ([]byte, error) {
+	if e.Tombstone || isExpired(e, time.Now().UnixNano()) {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), e.Data...), nil
+}
+
+// Flush persists the MemTable into new SSTables of level 0, one for each column family with entries, and replaces it
+// with an empty one. It waits for the writes queued before it and for the tables to be stored
+func (db *DB) Flush() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return db.enqueue(&writer{flush: true})
+}
+
+// flush must only be called by the writer at the front of the queue
+func (db *DB) flush() error {
+	if err := db.makeRoomForWrite(true); err != nil {
+		return err
+	}
+
+	return db.waitForFlush()
+}
+
+// Close stops the flushes and the compactions, closes the MemTables and every SSTable and releases the lock of the
+// folder. An immutable MemTable that wasn't flushed yet is replayed from its WAL when the DB is opened again. Closing
+// a closed DB returns ErrClosed
+func (db *DB) Close() (err error) {
+	if !atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		return ErrClosed
+	}
+
+	close(db.closing)
+	db.wg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bgErr == nil {
+		db.bgErr = ErrClosed
+	}
+	db.bgCond.Broadcast()
+
+	err = db.mem.Close()
+	if db.manifest != nil {
+		if err2 := db.manifest.Close(); err2 != nil {
+			err = err2
+		}
+	}
+	if db.imm != nil {
+		if err2 := db.imm.Close(); err2 != nil {
+			err = err2
+		}
+	}
+
+	// Tables still read by open iterators are closed when the iterators are
+	db.tables.close()
+
+	if db.lock != nil {
+		if err2 := db.lock.Close(); err2 != nil {
+			err = err2
+		}
+	}
+
+	return
+}
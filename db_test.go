@@ -0,0 +1,336 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	t.Run("WAL files replayed out of order", func(t *testing.T) {
+		// The newer WAL has the lower number
+		newer := encodeRecord(&Entry{Key: "key", Data: []byte("new"), Seq: 2})
+		older := encodeRecord(&Entry{Key: "key", Data: []byte("old"), Seq: 1})
+		ioutil.WriteFile(walFileName(dir, 1), newer, 0644)
+		ioutil.WriteFile(walFileName(dir, 2), older, 0644)
+
+		db, err := Open(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if value, err := db.Get("key"); err != nil || string(value) != "new" {
+			t.Errorf("Expected 'new', got '%s' (%v)", value, err)
+		}
+
+		if db.seq != 2 {
+			t.Errorf("Expected the last sequence to be 2, got %d", db.seq)
+		}
+
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("overwrites across flushes and reopening", func(t *testing.T) {
+		db, err := Open(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if db.seq != 2 {
+			t.Errorf("Expected the last sequence to be recovered from the MANIFEST, got %d", db.seq)
+		}
+
+		for _, value := range []string{"first", "second"} {
+			db.Put("key", []byte(value))
+			if err = db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = Open(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if value, err := db.Get("key"); err != nil || string(value) != "second" {
+			t.Errorf("Expected 'second', got '%s' (%v)", value, err)
+		}
+
+		db.Put("key", []byte("third"))
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if value, err := db.Get("key"); err != nil || string(value) != "third" {
+			t.Errorf("Expected 'third', got '%s' (%v)", value, err)
+		}
+	})
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	// MemTables are frozen and flushed in background while the writers and the flusher run
+	db, err := Open(dir, &Options{WriteBufferSize: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers, keys, rounds = 8, 20, 30
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errc := make(chan error, 100)
+
+	// Every writer owns its keys and writes increasing versions of them, plus a pair of keys in a batch that must
+	// always be seen with the same value
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for round := 1; round <= rounds; round++ {
+				for k := 0; k < keys; k++ {
+					if err := db.Put(fmt.Sprintf("w%d-key%02d", w, k), []byte(strconv.Itoa(round))); err != nil {
+						errc <- err
+						return
+					}
+				}
+
+				var b WriteBatch
+				b.Put(fmt.Sprintf("pair%d-a", w), []byte(strconv.Itoa(round)))
+				b.Put(fmt.Sprintf("pair%d-b", w), []byte(strconv.Itoa(round)))
+				if err := db.Write(&b); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(3)
+
+	// Versions of a key never go back
+	go func() {
+		defer readers.Done()
+
+		seen := make(map[string]int)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			key := fmt.Sprintf("w%d-key%02d", i%writers, i%keys)
+			value, err := db.Get(key)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				errc <- err
+				return
+			}
+
+			version, _ := strconv.Atoi(string(value))
+			if version < seen[key] {
+				errc <- fmt.Errorf("Key '%s' went back from version %d to %d", key, seen[key], version)
+				return
+			}
+			seen[key] = version
+		}
+	}()
+
+	// Iterators over snapshots see batches whole
+	go func() {
+		defer readers.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			snap := db.NewSnapshot()
+			it := snap.NewIterator(&IterOptions{LowerBound: "pair", UpperBound: "paiz"})
+			values := make(map[string]string)
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				values[it.Key()] = string(it.Value())
+			}
+			if err := it.Error(); err != nil {
+				errc <- err
+			}
+			it.Close()
+			snap.Release()
+
+			for w := 0; w < writers; w++ {
+				a, b := values[fmt.Sprintf("pair%d-a", w)], values[fmt.Sprintf("pair%d-b", w)]
+				if a != b {
+					errc <- fmt.Errorf("Batch of writer %d seen half applied: '%s' and '%s'", w, a, b)
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer readers.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+
+			if err := db.Flush(); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	close(errc)
+
+	for err := range errc {
+		t.Error(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("w%d-key%02d", w, k)
+			if value, err := db.Get(key); err != nil || string(value) != strconv.Itoa(rounds) {
+				t.Errorf("Expected key '%s' to have version %d, got '%s' (%v)", key, rounds, value, err)
+			}
+		}
+	}
+}
+
+func TestAutomaticFlush(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, &Options{WriteBufferSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keys = 500
+	for i := 0; i < keys; i++ {
+		if err = db.Put(fmt.Sprintf("key%03d", i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("MemTable flushed without calling Flush", func(t *testing.T) {
+		if stats := db.CompactionStats(); stats.BytesFlushed == 0 {
+			t.Error("Expected the MemTable to be flushed in background")
+		}
+
+		db.mu.RLock()
+		size := db.mem.ApproximateSize()
+		db.mu.RUnlock()
+		if size >= db.opts.WriteBufferSize+1024 {
+			t.Errorf("Expected the MemTable to stay around the write buffer size, got %d bytes", size)
+		}
+	})
+
+	t.Run("every write readable", func(t *testing.T) {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if value, err := db.Get(key); err != nil || string(value) != strconv.Itoa(i) {
+				t.Fatalf("Expected '%d' for '%s', got '%s' (%v)", i, key, value, err)
+			}
+		}
+
+		it := db.NewIterator(nil)
+		n := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			n++
+		}
+		it.Close()
+		if n != keys {
+			t.Errorf("Expected %d keys from the iterator, got %d", keys, n)
+		}
+	})
+
+	t.Run("writes replayed after reopening", func(t *testing.T) {
+		if err = db.Put("last", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.Put("closed", nil); err != ErrClosed {
+			t.Errorf("Expected ErrClosed writing to a closed DB, got %v", err)
+		}
+
+		if db, err = Open(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, key := range []string{"key000", fmt.Sprintf("key%03d", keys-1), "last"} {
+			if _, err := db.Get(key); err != nil {
+				t.Errorf("Expected '%s' after reopening: %v", key, err)
+			}
+		}
+	})
+}
+
+func TestReturnedValues(t *testing.T) {
+	db, err := Open("/db", &Options{FS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("memtable", []byte("value"))
+	db.Put("table", []byte("value"))
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("memtable", []byte("value"))
+
+	// Changing a value returned by a read doesn't change the next reads
+	for _, key := range []string{"memtable", "table"} {
+		value, _ := db.Get(key)
+		value[0] = 'X'
+
+		it := db.NewIterator(nil)
+		it.Seek(key)
+		it.Value()[0] = 'X'
+		it.Close()
+
+		if value, err := db.Get(key); err != nil || string(value) != "value" {
+			t.Errorf("Expected 'value' for '%s', got '%s' (%v)", key, value, err)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed closing the DB twice, got %v", err)
+	}
+}
@@ -9,8 +9,6 @@ It is generated from these files:
 
 It has these top-level messages:
 	Entry
-	SSTableSingleIndex
-	SSTableIndex
 */
 package doom
 
@@ -30,10 +28,15 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Entry struct {
-	Key    string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
-	Offset int64  `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
-	Length int64  `protobuf:"varint,3,opt,name=length" json:"length,omitempty"`
-	Data   []byte `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Key       string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Offset    int64  `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
+	Length    int64  `protobuf:"varint,3,opt,name=length" json:"length,omitempty"`
+	Data      []byte `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Tombstone bool   `protobuf:"varint,5,opt,name=tombstone" json:"tombstone,omitempty"`
+	Seq       uint64 `protobuf:"varint,6,opt,name=seq" json:"seq,omitempty"`
+	ExpiresAt int64  `protobuf:"varint,7,opt,name=expires_at,json=expiresAt" json:"expires_at,omitempty"`
+	Merge     bool   `protobuf:"varint,8,opt,name=merge" json:"merge,omitempty"`
+	Family    uint32 `protobuf:"varint,9,opt,name=family" json:"family,omitempty"`
 }
 
 func (m *Entry) Reset()                    { *m = Entry{} }
@@ -69,75 +72,60 @@ func (m *Entry) GetData() []byte {
 	return nil
 }
 
-type SSTableSingleIndex struct {
-	Key      string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
-	Offset   int64  `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
-	FileName string `protobuf:"bytes,3,opt,name=fileName" json:"fileName,omitempty"`
-}
-
-func (m *SSTableSingleIndex) Reset()                    { *m = SSTableSingleIndex{} }
-func (m *SSTableSingleIndex) String() string            { return proto.CompactTextString(m) }
-func (*SSTableSingleIndex) ProtoMessage()               {}
-func (*SSTableSingleIndex) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
-
-func (m *SSTableSingleIndex) GetKey() string {
+func (m *Entry) GetTombstone() bool {
 	if m != nil {
-		return m.Key
+		return m.Tombstone
 	}
-	return ""
+	return false
 }
 
-func (m *SSTableSingleIndex) GetOffset() int64 {
+func (m *Entry) GetSeq() uint64 {
 	if m != nil {
-		return m.Offset
+		return m.Seq
 	}
 	return 0
 }
 
-func (m *SSTableSingleIndex) GetFileName() string {
+func (m *Entry) GetExpiresAt() int64 {
 	if m != nil {
-		return m.FileName
+		return m.ExpiresAt
 	}
-	return ""
+	return 0
 }
 
-type SSTableIndex struct {
-	Indices []*SSTableSingleIndex `protobuf:"bytes,1,rep,name=indices" json:"indices,omitempty"`
+func (m *Entry) GetMerge() bool {
+	if m != nil {
+		return m.Merge
+	}
+	return false
 }
 
-func (m *SSTableIndex) Reset()                    { *m = SSTableIndex{} }
-func (m *SSTableIndex) String() string            { return proto.CompactTextString(m) }
-func (*SSTableIndex) ProtoMessage()               {}
-func (*SSTableIndex) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
-
-func (m *SSTableIndex) GetIndices() []*SSTableSingleIndex {
+func (m *Entry) GetFamily() uint32 {
 	if m != nil {
-		return m.Indices
+		return m.Family
 	}
-	return nil
+	return 0
 }
 
 func init() {
 	proto.RegisterType((*Entry)(nil), "doom.Entry")
-	proto.RegisterType((*SSTableSingleIndex)(nil), "doom.SSTableSingleIndex")
-	proto.RegisterType((*SSTableIndex)(nil), "doom.SSTableIndex")
 }
 
 func init() { proto.RegisterFile("entry.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 197 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x4e, 0xcd, 0x2b, 0x29,
-	0xaa, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x49, 0xc9, 0xcf, 0xcf, 0x55, 0x8a, 0xe5,
-	0x62, 0x75, 0x05, 0x09, 0x0a, 0x09, 0x70, 0x31, 0x67, 0xa7, 0x56, 0x4a, 0x30, 0x2a, 0x30, 0x6a,
-	0x70, 0x06, 0x81, 0x98, 0x42, 0x62, 0x5c, 0x6c, 0xf9, 0x69, 0x69, 0xc5, 0xa9, 0x25, 0x12, 0x4c,
-	0x0a, 0x8c, 0x1a, 0xcc, 0x41, 0x50, 0x1e, 0x48, 0x3c, 0x27, 0x35, 0x2f, 0xbd, 0x24, 0x43, 0x82,
-	0x19, 0x22, 0x0e, 0xe1, 0x09, 0x09, 0x71, 0xb1, 0xa4, 0x24, 0x96, 0x24, 0x4a, 0xb0, 0x28, 0x30,
-	0x6a, 0xf0, 0x04, 0x81, 0xd9, 0x4a, 0x51, 0x5c, 0x42, 0xc1, 0xc1, 0x21, 0x89, 0x49, 0x39, 0xa9,
-	0xc1, 0x99, 0x79, 0xe9, 0x39, 0xa9, 0x9e, 0x79, 0x29, 0xa9, 0x15, 0x24, 0xd8, 0x25, 0xc5, 0xc5,
-	0x91, 0x96, 0x99, 0x93, 0xea, 0x97, 0x98, 0x9b, 0x0a, 0xb6, 0x8d, 0x33, 0x08, 0xce, 0x57, 0x72,
-	0xe2, 0xe2, 0x81, 0x9a, 0x0d, 0x31, 0xd5, 0x88, 0x8b, 0x3d, 0x33, 0x2f, 0x25, 0x33, 0x39, 0xb5,
-	0x58, 0x82, 0x51, 0x81, 0x59, 0x83, 0xdb, 0x48, 0x42, 0x0f, 0xe4, 0x45, 0x3d, 0x4c, 0x07, 0x04,
-	0xc1, 0x14, 0x26, 0xb1, 0x81, 0xc3, 0xc2, 0x18, 0x10, 0x00, 0x00, 0xff, 0xff, 0xd4, 0x1a, 0x0a,
-	0xbc, 0x1a, 0x01, 0x00, 0x00,
+	// 200 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x44, 0x8f, 0x4d, 0x4a, 0x04, 0x31,
+	0x10, 0x46, 0x29, 0xfb, 0xc7, 0xe9, 0x52, 0x41, 0x0a, 0x91, 0x5a, 0x28, 0x04, 0x57, 0x59, 0xb9,
+	0xf1, 0x04, 0x2e, 0xbc, 0x40, 0x2e, 0x20, 0x19, 0xa6, 0x7a, 0x1c, 0x9c, 0x74, 0xda, 0xa4, 0x16,
+	0xf6, 0x55, 0x3d, 0x8d, 0x24, 0xdd, 0x30, 0xbb, 0xf7, 0xde, 0xe2, 0x4b, 0x0a, 0x6f, 0x64, 0xd2,
+	0xb4, 0xbc, 0xce, 0x29, 0x6a, 0xa4, 0xf6, 0x10, 0x63, 0x78, 0xf9, 0x03, 0xec, 0x3e, 0x4a, 0xa5,
+	0x7b, 0x6c, 0xbe, 0x65, 0x61, 0x30, 0x60, 0x07, 0x57, 0x90, 0x1e, 0xb1, 0x8f, 0xe3, 0x98, 0x45,
+	0xf9, 0xca, 0x80, 0x6d, 0xdc, 0x66, 0xa5, 0x9f, 0x65, 0x3a, 0xea, 0x17, 0x37, 0x6b, 0x5f, 0x8d,
+	0x08, 0xdb, 0x83, 0x57, 0xcf, 0xad, 0x01, 0x7b, 0xeb, 0x2a, 0xd3, 0x13, 0x0e, 0x1a, 0xc3, 0x3e,
+	0x6b, 0x9c, 0x84, 0x3b, 0x03, 0x76, 0xe7, 0x2e, 0xa1, 0xbc, 0x99, 0xe5, 0x87, 0x7b, 0x03, 0xb6,
+	0x75, 0x05, 0xe9, 0x19, 0x51, 0x7e, 0xe7, 0x53, 0x92, 0xfc, 0xe9, 0x95, 0xaf, 0xeb, 0xfe, 0xb0,
+	0x95, 0x77, 0xa5, 0x07, 0xec, 0x82, 0xa4, 0xa3, 0xf0, 0xae, 0x4e, 0xad, 0x52, 0x3e, 0x34, 0xfa,
+	0x70, 0x3a, 0x2f, 0x3c, 0x18, 0xb0, 0x77, 0x6e, 0xb3, 0x7d, 0x5f, 0x2f, 0x7d, 0xfb, 0x1f, 0x00,
+	0xc4, 0x9c, 0x43, 0x5a, 0xf8, 0x00, 0x00, 0x00,
 }
@@ -0,0 +1,226 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrInjectedFault is returned by the operations that a FaultFS makes fail
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultFS wraps an FS to make its operations fail on demand. A write that fails is torn: only the first half of it
+// reaches the file. Writes are counted from the last call to FailNthWrite or CrashAtNthWrite
+type FaultFS struct {
+	fs FS
+
+	mu sync.Mutex
+	// writes is the number of writes left until the one that fails, or zero if none has to
+	writes      int
+	crashOnFail bool
+	crashed     bool
+}
+
+// NewFaultFS returns a FaultFS that doesn't fail until it's told to
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs}
+}
+
+// FailNthWrite makes the nth write from now fail, 1 being the next one. The writes after it succeed
+func (fs *FaultFS) FailNthWrite(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writes, fs.crashOnFail = n, false
+}
+
+// CrashAtNthWrite makes the nth write from now fail and every operation after it too, as if the process had died
+// in the middle of that write
+func (fs *FaultFS) CrashAtNthWrite(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writes, fs.crashOnFail = n, true
+}
+
+// Crash makes every operation from now on fail
+func (fs *FaultFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.crashed = true
+}
+
+// Crashed tells if the FaultFS has crashed
+func (fs *FaultFS) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.crashed
+}
+
+func (fs *FaultFS) check() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.crashed {
+		return ErrInjectedFault
+	}
+
+	return nil
+}
+
+// write counts a write and tells if it has to fail
+func (fs *FaultFS) write() (fail bool, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.crashed {
+		return false, ErrInjectedFault
+	}
+
+	if fs.writes > 0 {
+		fs.writes--
+		if fs.writes == 0 {
+			fs.crashed = fs.crashOnFail
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+
+	return fs.fs.Remove(name)
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+
+	return fs.fs.Rename(oldname, newname)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+
+	return fs.fs.Stat(name)
+}
+
+func (fs *FaultFS) List(dir string) ([]string, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+
+	return fs.fs.List(dir)
+}
+
+func (fs *FaultFS) SyncDir(dir string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+
+	return fs.fs.SyncDir(dir)
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+
+	return fs.fs.Lock(name)
+}
+
+// faultFile is an open file of a FaultFS. Closing it always closes the wrapped file
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (n int, err error) {
+	fail, err := f.fs.write()
+	if err != nil {
+		return 0, err
+	}
+
+	if fail {
+		n, _ = f.File.Write(p[:len(p)/2])
+		return n, ErrInjectedFault
+	}
+
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fs.check(); err != nil {
+		return nil, err
+	}
+
+	return f.File.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+
+	return f.File.Sync()
+}
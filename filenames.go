@@ -0,0 +1,49 @@
+package doom
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kinds of the numbered files of a DB
+const (
+	tableFileKind = iota
+	walFileKind
+	manifestFileKind
+)
+
+func tableFileName(folder string, number uint64) string {
+	return filepath.Join(folder, fmt.Sprintf("%06d%s", number, SSTABLE_FILE_EXT))
+}
+
+func walFileName(folder string, number uint64) string {
+	return filepath.Join(folder, fmt.Sprintf("%06d%s", number, WAL_FILE_EXT))
+}
+
+func manifestFileName(folder string, number uint64) string {
+	return filepath.Join(folder, fmt.Sprintf("%s%06d", MANIFEST_PREFIX, number))
+}
+
+// parseFileName returns the kind and the number of a table, WAL or MANIFEST file from its name, or false if it isn't
+// one of them
+func parseFileName(name string) (kind int, number uint64, ok bool) {
+	name = filepath.Base(name)
+
+	var digits string
+	switch {
+	case strings.HasPrefix(name, MANIFEST_PREFIX):
+		kind, digits = manifestFileKind, strings.TrimPrefix(name, MANIFEST_PREFIX)
+	case strings.HasSuffix(name, SSTABLE_FILE_EXT):
+		kind, digits = tableFileKind, strings.TrimSuffix(name, SSTABLE_FILE_EXT)
+	case strings.HasSuffix(name, WAL_FILE_EXT):
+		kind, digits = walFileKind, strings.TrimSuffix(name, WAL_FILE_EXT)
+	default:
+		return 0, 0, false
+	}
+
+	number, err := strconv.ParseUint(digits, 10, 64)
+
+	return kind, number, err == nil
+}
@@ -0,0 +1,231 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"github.com/thehivecorporation/log"
+)
+
+// makeRoomForWrite freezes the MemTable as immutable and swaps in an empty one with a new WAL when any column family
+// has grown past its Options.WriteBufferSize in it, or when 'force' is set and it isn't empty. Column families share
+// the WAL, so all of them are frozen and flushed together. The frozen one is flushed in background, so writes only
+// wait here if the previous one is still being flushed. The old WAL is synced before the swap, whatever the sync
+// policy, so a synced write in the new one never survives a power failure that loses the writes before it. It must
+// only be called by the writer at the front of the queue
+func (db *DB) makeRoomForWrite(force bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for {
+		switch {
+		case db.bgErr != nil:
+			return db.bgErr
+		case !force && !db.isMemTableFull():
+			return nil
+		case force && db.mem.Len() == 0:
+			return nil
+		case db.imm != nil:
+			db.bgCond.Wait()
+		default:
+			// It's unknown which records reached the disk after a failed sync, so no write can be acknowledged
+			if err := db.mem.Sync(); err != nil {
+				db.bgErr = err
+				db.bgCond.Broadcast()
+				return err
+			}
+
+			mem, err := db.createMemTable()
+			if err != nil {
+				return errors.Annotate(err, "Could not create MemTable")
+			}
+
+			db.imm, db.mem = db.mem, mem
+			force = false
+			db.scheduleFlush()
+		}
+	}
+}
+
+// isMemTableFull returns true if any column family has reached its write buffer size in the MemTable. Must be called
+// with db.mu held
+func (db *DB) isMemTableFull() bool {
+	for _, cf := range db.families {
+		if db.mem.familySize(cf.id) >= cf.opts.WriteBufferSize {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createMemTable returns an empty MemTable, with its own WAL unless the DB is read-only, that has room for every live
+// column family. Must be called with db.mu held, or while the DB is opened
+func (db *DB) createMemTable() (mem *MemTable, err error) {
+	if db.opts.ReadOnly {
+		mem = newMemoryOnlyMemTable(db.opts)
+	} else if mem, err = newMemTable(db.opts, db.tempFolder, db.storageFolder, db.newFileNumber()); err != nil {
+		return nil, err
+	}
+
+	for id, cf := range db.families {
+		if id != DEFAULT_COLUMN_FAMILY_ID {
+			mem.addFamily(id, cf.opts.Comparator)
+		}
+	}
+
+	return
+}
+
+// waitForFlush waits until the immutable MemTable, if any, is stored in level 0
+func (db *DB) waitForFlush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for db.imm != nil && db.bgErr == nil {
+		db.bgCond.Wait()
+	}
+
+	return db.bgErr
+}
+
+func (db *DB) scheduleFlush() {
+	select {
+	case db.flushc <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop flushes the immutable MemTable in background until the DB is closed
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-db.flushc:
+		}
+
+		if err := db.flushImmutable(); err != nil {
+			log.WithError(err).Error("Error flushing MemTable")
+		}
+	}
+}
+
+// flushImmutable persists the immutable MemTable into a new SSTable of level 0 for each column family with entries in
+// it and logs them in the MANIFEST in a single edit, together with the number of the WAL of the current MemTable,
+// which is the oldest one left to replay. The default column family is written to the SSTable file of the MemTable.
+// Reads find the entries in the MemTable until the tables are installed. A failure stops the writes, whose entries
+// would be lost otherwise
+func (db *DB) flushImmutable() (err error) {
+	db.mu.RLock()
+	imm, mem := db.imm, db.mem
+	db.mu.RUnlock()
+
+	if imm == nil {
+		return
+	}
+
+	// Families dropped meanwhile are skipped here or when the edit is applied
+	snapshots := db.snapshots.sorted()
+	outputs, flushed := make([]*tableMeta, 0), make(map[*tableMeta]*ColumnFamily)
+	for _, cf := range db.sortedFamilies() {
+		var m *tableMeta
+		if m, err = db.flushFamily(cf, imm, snapshots); err != nil {
+			break
+		} else if m != nil {
+			outputs, flushed[m] = append(outputs, m), cf
+		}
+	}
+
+	dropped := make(map[*ColumnFamily]bool)
+	if err == nil {
+		err = db.logAndApply(&versionEdit{logNumber: mem.number, added: outputs}, func() {
+			for _, cf := range flushed {
+				dropped[cf] = cf.dropped
+			}
+
+			db.imm = nil
+			db.bgCond.Broadcast()
+		})
+	}
+
+	for m, cf := range flushed {
+		if err != nil || dropped[cf] {
+			db.removeTables([]*tableMeta{m})
+		}
+	}
+
+	if err != nil {
+		db.mu.Lock()
+		db.bgErr = err
+		db.bgCond.Broadcast()
+		db.mu.Unlock()
+
+		return
+	}
+
+	removeFiles(db.fs, walFileName(db.tempFolder, imm.number))
+
+	for m, cf := range flushed {
+		if !dropped[cf] {
+			cf.stats.addFlushed(m.size)
+		}
+	}
+	db.maybeScheduleCompaction()
+
+	return
+}
+
+// flushFamily writes the entries of the column family 'cf' in 'imm' to a new SSTable of level 0, keeping the versions
+// that 'snapshots' read, and opens it. It returns nil if the family has no entries in 'imm'. The default family is
+// persisted in the SSTable file of 'imm', which is removed if it has no entries
+func (db *DB) flushFamily(cf *ColumnFamily, imm *MemTable, snapshots []uint64) (m *tableMeta, err error) {
+	number := imm.number
+	if cf.id == DEFAULT_COLUMN_FAMILY_ID && imm.familyLen(cf.id) == 0 {
+		imm.Close()
+		removeFiles(db.fs, imm.StorageFile.Name())
+		return nil, nil
+	} else if cf.id == DEFAULT_COLUMN_FAMILY_ID {
+		if err = imm.Persist(snapshots...); err != nil {
+			return nil, errors.Annotate(err, "Could not persist MemTable")
+		}
+	} else if imm.familyLen(cf.id) == 0 {
+		return nil, nil
+	} else if number, err = db.writeFamilyTable(cf, imm, snapshots); err != nil {
+		return nil, errors.Annotatef(err, "Could not persist column family '%s' of MemTable", cf.name)
+	}
+
+	if m, err = db.tables.tableMeta(number, 0, cf.opts.Comparator); err != nil {
+		db.tables.evict(number)
+		removeFiles(db.fs, tableFileName(db.storageFolder, number))
+		return nil, errors.Annotate(err, "Could not open flushed SSTable")
+	}
+	m.family = cf.id
+
+	return
+}
+
+// writeFamilyTable writes the entries of the column family 'cf' in 'imm' to a new SSTable file, synced, and returns
+// its number. The file is removed on error
+func (db *DB) writeFamilyTable(cf *ColumnFamily, imm *MemTable, snapshots []uint64) (number uint64, err error) {
+	number = db.newFileNumber()
+	f, err := db.fs.Create(tableFileName(db.storageFolder, number))
+	if err != nil {
+		return 0, errors.Annotate(err, "Could not create sstable file")
+	}
+
+	if err = imm.writeTable(f, cf.id, cf.opts, snapshots); err == nil {
+		err = f.Sync()
+	}
+
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		removeFiles(db.fs, f.Name())
+		return 0, err
+	}
+
+	return
+}
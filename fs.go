@@ -1,146 +1,156 @@
 package doom
 
 import (
-	"bufio"
-	"fmt"
 	"github.com/juju/errors"
 	"github.com/thehivecorporation/log"
 	"io"
-	"io/ioutil"
+	"math/rand"
 	"os"
-	"strings"
+	"path/filepath"
+	"strconv"
 )
 
-// cleanEmptyFilesOnFolder searches for files with size 0 on f and removes them
-func cleanEmptyFilesOnFolder(f string) {
-	files, err := ioutil.ReadDir(f)
-	if err != nil {
-		log.WithError(err).Errorf("Could not read folder %s", f)
-	}
+// ErrLocked is returned when the lock of a DB is held, by another process or by another DB of this one
+var ErrLocked = errors.New("db locked by another process")
 
-	for _, cf := range files {
-		if cf.Size() == 0 {
-			log.Warnf("Removing file '%s'", cf.Name())
-			os.Remove(fmt.Sprintf("%s/%s", f, cf.Name()))
-		}
-	}
-}
+// FS is the file system where a DB keeps its files. OSFS stores them on disk, MemFS in memory and FaultFS wraps
+// another FS to inject failures
+type FS interface {
+	// Create creates the file 'name' for reading and writing, failing if it already exists
+	Create(name string) (File, error)
 
-func readWALFilesFromFolder(f string, s *MemTable) (err error) {
-	files, err := ioutil.ReadDir(f)
-	if err != nil {
-		err = errors.Annotatef(err, "Could not read folder %s", f)
-		return
-	}
+	// Open opens the file 'name' for reading
+	Open(name string) (File, error)
 
-	for _, cf := range files {
-		filePath := fmt.Sprintf("%s/%s", s.tempFolder, cf.Name())
-		isWALFile := strings.Contains(cf.Name(), "write_ahead_log")
-		isNotCurrentWALFile := filePath != s.walFile.Name()
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Stat(name string) (os.FileInfo, error)
 
-		//Only process 'write_ahead_log' files that aren't the current opened one
-		if !cf.IsDir() && isWALFile && isNotCurrentWALFile {
-			log.Infof("Indexing WAL file '%s' into MemTable", cf.Name())
+	// List returns the names of the files in the folder 'dir'
+	List(dir string) ([]string, error)
 
-			readWALFileToMemTable(filePath, s)
-		}
-	}
+	// SyncDir makes the files created, renamed and removed in the folder 'dir' survive a power failure
+	SyncDir(dir string) error
 
-	return
+	// Lock creates the file 'name' if it doesn't exist and takes an exclusive lock on it, failing with ErrLocked if
+	// it's already held. Closing the returned Closer releases it, and so does the end of the process
+	Lock(name string) (io.Closer, error)
 }
 
-func readWALFileToMemTable(filePath string, s *MemTable) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		log.WithError(err).Fatalf("WAL file named '%s' found but couldn't be opened. You must check the "+
-			"contents of this file or remove it and try again if its information isn't critical", filePath)
-	}
-
-	// Close and delete old WAL file after reading it successfully
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.WithError(err).Error("Error closing WAL file")
-		}
+// File is an open file of an FS. An *os.File is one
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
 
-		if err := deleteFile(f); err != nil {
-			log.WithError(err).Error("Could not delete WAL file")
-		}
-	}()
+	Name() string
+	Stat() (os.FileInfo, error)
 
-	reader := bufio.NewReader(f)
-
-	var line string
-	for {
-		line, err = reader.ReadString('\n')
-		if err != nil {
-			break
-		}
+	// Sync makes the data written to the file survive a power failure
+	Sync() error
+}
 
-		// Proper WAL lines has syntax 'key value\n' so the minimum possible characters to try insertion are four 'k v\n'
-		// Omit 'corrupted' line if it doesn't pass this check
-		if !(strings.Contains(line, " ") && len(line) > 4) {
-			continue
-		}
+// OSFS is the FS of the operating system
+var OSFS FS = osFS{}
 
-		if err2 := s.Insert(line[:len(line)-1]); err2 != nil {
-			log.WithError(err2).WithField("line", line).Fatal("Could not insert data from old WAL file")
-		}
-	}
+type osFS struct{}
 
-	if err != io.EOF {
-		fmt.Printf(" > Failed!: %v\n", err)
-	}
+func (osFS) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 }
 
-func createDbFiles(storageFolder, tempFolder string) (storageFile *os.File, walFile *os.File, err error) {
-	if storageFile, err = createSStableFileOn(storageFolder); err != nil {
-		return
-	}
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
 
-	if walFile, err = createWALFileOn(tempFolder); err != nil {
-		err = errors.Annotatef(err, "Error trying to create a temp file for WAL")
-	}
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
 
-	return
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
 }
 
-func extractSuffix(prefix, s string) string {
-	pos := strings.LastIndex(s, prefix)
-	return s[pos+len(prefix):]
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
 }
 
-func fileNameBasedOnTempFile(baseFilename, path, orPrefix, newPrefix string) string {
-	suffix := extractSuffix(orPrefix, baseFilename)
-	return fmt.Sprintf("%s/%s%s", path, newPrefix, suffix)
+func (osFS) List(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdirnames(-1)
 }
 
-func createIndexFile(storageFilename, storagePath string) (indexFile *os.File, err error) {
-	suffix := extractSuffix(WAL_PREFIX, storageFilename)
-	newFile := fmt.Sprintf("%s/%s%s", storagePath, INDEX_PREFIX, suffix)
+func (osFS) SyncDir(dir string) (err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
 
-	if indexFile, err = os.Create(newFile); err != nil {
-		err = errors.Annotatef(err, "Could not create index file '%s'", newFile)
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
 	}
 
-	return
+	return f.Close()
 }
 
-func createWALFileOn(tempFolder string) (walFile *os.File, err error) {
-	if walFile, err = ioutil.TempFile(tempFolder, WAL_PREFIX); err != nil {
-		err = errors.Annotatef(err, "Error trying to create a temp file for WAL")
+// createTempFile creates a new file in the folder 'dir' of 'fs' with a random name that starts with 'prefix', like
+// ioutil.TempFile
+func createTempFile(fs FS, dir, prefix string) (f File, err error) {
+	for try := 0; try < 10000; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		if f, err = fs.Create(name); !os.IsExist(errors.Cause(err)) {
+			return
+		}
 	}
 
 	return
 }
 
-func createSSTableFileWithSuffix(storageFolder, filename string) (*os.File, error) {
-	return os.Create(fmt.Sprintf("%s/%s%s", storageFolder, SSTABLES_PREFIX, extractSuffix(WAL_PREFIX, filename)))
+func removeFiles(fs FS, names ...string) {
+	for _, name := range names {
+		if err := fs.Remove(name); err != nil {
+			log.WithError(err).Errorf("Error deleting file '%s'", name)
+		}
+	}
 }
 
-func createSStableFileOn(storageFolder string) (newSStable *os.File, err error) {
-	if newSStable, err = ioutil.TempFile(storageFolder, SSTABLES_PREFIX); err != nil {
-		err = errors.Annotatef(err, "Could not create SSTable file")
+// readWALFileToMemTable inserts the records of the WAL file 'filePath' into 's'. The file is kept, so it's read again
+// if 's' is lost before its own WAL is synced
+func readWALFileToMemTable(fs FS, filePath string, s *MemTable) (err error) {
+	f, err := fs.Open(filePath)
+	if err != nil {
+		return errors.Annotatef(err, "WAL file named '%s' found but couldn't be opened. You must check the "+
+			"contents of this file or remove it and try again if its information isn't critical", filePath)
 	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.WithError(err).Error("Error closing WAL file")
+		}
+	}()
 
-	return
+	// A torn record at the end is dropped by readRecords, but a corrupted one in the middle means that the file
+	// must be checked by hand so it's kept on disk
+	entries, _, err := readRecords(f)
+	if err != nil {
+		err = errors.Annotatef(err, "WAL file named '%s' is corrupted. You must check the contents of this file "+
+			"or remove it and try again if its information isn't critical", filePath)
+		return
+	}
+
+	for _, e := range entries {
+		if err = s.insert(e); err != nil {
+			err = errors.Annotatef(err, "Could not insert data from old WAL file '%s'", filePath)
+			return
+		}
+	}
+
+	return nil
 }
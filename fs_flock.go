@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package doom
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Lock takes a flock on 'name'. The lock belongs to the open file, so two DBs of the same process can't share it
+// either
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+
+		return nil, &os.PathError{Op: "flock", Path: name, Err: err}
+	}
+
+	return f, nil
+}
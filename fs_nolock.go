@@ -0,0 +1,52 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package doom
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Systems without flock only lock the DB against the other DBs of the same process
+var (
+	osLocksMu sync.Mutex
+	osLocks   = make(map[string]bool)
+)
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	osLocksMu.Lock()
+	defer osLocksMu.Unlock()
+
+	if osLocks[name] {
+		return nil, ErrLocked
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	osLocks[name] = true
+
+	return &osLock{File: f, name: name}, nil
+}
+
+type osLock struct {
+	*os.File
+	name string
+}
+
+func (l *osLock) Close() error {
+	osLocksMu.Lock()
+	delete(osLocks, l.name)
+	osLocksMu.Unlock()
+
+	return l.File.Close()
+}
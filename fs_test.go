@@ -1,27 +1,175 @@
 package doom
 
 import (
-	"testing"
+	"github.com/juju/errors"
+	"io/ioutil"
 	"os"
-	"fmt"
+	"testing"
 )
 
-func TestCreateIndexFile(t *testing.T){
-	f, err := os.Create(fmt.Sprintf("/tmp/%s12345", WAL_PREFIX))
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	write := func(name, data string, sync bool) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		f.Write([]byte(data))
+		if sync {
+			f.Sync()
+		}
+	}
+
+	read := func(fs FS, name string) string {
+		f, err := fs.Open(name)
+		if err != nil {
+			return "<" + err.Error() + ">"
+		}
+		defer f.Close()
+
+		byt, _ := ioutil.ReadAll(f)
+		return string(byt)
+	}
+
+	write("/db/synced", "synced data", true)
+	write("/db/unsynced", "unsynced data", false)
+	fs.SyncDir("/db")
+
+	t.Run("files", func(t *testing.T) {
+		if _, err := fs.Create("/db/synced"); !os.IsExist(err) {
+			t.Errorf("Expected an existing file error, got %v", err)
+		}
+
+		if names, _ := fs.List("/db"); len(names) != 2 || names[0] != "synced" || names[1] != "unsynced" {
+			t.Errorf("Unexpected files %v", names)
+		}
+
+		if _, err := fs.Stat("/db/missing"); !os.IsNotExist(err) {
+			t.Errorf("Expected a missing file error, got %v", err)
+		}
+	})
+
+	t.Run("unsynced data lost", func(t *testing.T) {
+		crashed := fs.CrashClone()
+
+		if data := read(crashed, "/db/synced"); data != "synced data" {
+			t.Errorf("Expected the synced data to survive, got '%s'", data)
+		}
+
+		if data := read(crashed, "/db/unsynced"); data != "" {
+			t.Errorf("Expected an empty file, got '%s'", data)
+		}
+	})
+
+	t.Run("unsynced rename lost", func(t *testing.T) {
+		if err := fs.Rename("/db/synced", "/db/renamed"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fs.CrashClone().Stat("/db/renamed"); !os.IsNotExist(err) {
+			t.Errorf("Expected the rename to be lost, got %v", err)
+		}
+
+		fs.SyncDir("/db")
+		if data := read(fs.CrashClone(), "/db/renamed"); data != "synced data" {
+			t.Errorf("Expected the renamed file to survive, got '%s'", data)
+		}
+	})
+}
+
+func TestFaultFS(t *testing.T) {
+	mem := NewMemFS()
+	fs := NewFaultFS(mem)
+
+	f, err := fs.Create("/db/file")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer f.Close()
-	defer os.Remove(f.Name())
 
-	index, err := createIndexFile(f.Name(), "/tmp")
+	t.Run("failed write is torn", func(t *testing.T) {
+		fs.FailNthWrite(2)
+
+		if _, err := f.Write([]byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := f.Write([]byte("5678")); err != ErrInjectedFault || n != 2 {
+			t.Errorf("Expected a torn write of 2 bytes, got %d (%v)", n, err)
+		}
+
+		if _, err := f.Write([]byte("9")); err != nil {
+			t.Errorf("Expected the next write to succeed, got %v", err)
+		}
+
+		if info, _ := mem.Stat("/db/file"); info.Size() != 7 {
+			t.Errorf("Expected 7 bytes in the file, got %d", info.Size())
+		}
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		fs.CrashAtNthWrite(1)
+
+		if _, err := f.Write([]byte("ab")); err != ErrInjectedFault {
+			t.Errorf("Expected an injected fault, got %v", err)
+		}
+
+		if err := f.Sync(); err != ErrInjectedFault || !fs.Crashed() {
+			t.Errorf("Expected every operation to fail after the crash, got %v", err)
+		}
+
+		if _, err := fs.Open("/db/file"); err != ErrInjectedFault {
+			t.Errorf("Expected every operation to fail after the crash, got %v", err)
+		}
+	})
+}
+
+func TestFailedWALWrite(t *testing.T) {
+	mem := NewMemFS()
+	fs := NewFaultFS(mem)
+
+	db, err := Open("/db", &Options{FS: fs})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer index.Close()
-	defer os.Remove(index.Name())
 
-	if index.Name() != "/tmp/index12345" {
-		t.Errorf("File name was '%s'", index.Name())
+	db.Put("a", []byte("value"))
+
+	fs.FailNthWrite(1)
+	if err = db.Put("b", []byte("value")); errors.Cause(err) != ErrInjectedFault {
+		t.Fatalf("Expected the write to fail, got %v", err)
+	}
+
+	// The torn record must stay at the end of the WAL
+	if err = db.Put("c", []byte("value")); errors.Cause(err) != ErrInjectedFault {
+		t.Errorf("Expected the writes after the failed one to fail, got %v", err)
+	}
+	db.Close()
+
+	if db, err = Open("/db", &Options{FS: mem}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Get("a"); err != nil {
+		t.Errorf("Expected 'a' to be recovered, got %v", err)
+	}
+
+	for _, key := range []string{"b", "c"} {
+		if _, err = db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected '%s' not to be written, got %v", key, err)
+		}
+	}
+}
+
+func TestReadWALFileError(t *testing.T) {
+	opts, _ := (&Options{FS: NewMemFS()}).validate()
+
+	// A WAL that can't be opened fails the open of the DB instead of the process
+	err := readWALFileToMemTable(opts.FS, walFileName("/db", 1), newMemoryOnlyMemTable(opts))
+	if err == nil || !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("Expected the error opening the WAL file, got %v", err)
 	}
 }
@@ -0,0 +1,122 @@
+package doom
+
+import (
+	"encoding/binary"
+	"github.com/juju/errors"
+	"strings"
+)
+
+// An internal key is the key written by the user followed by a trailer of INTERNAL_KEY_TRAILER_SIZE bytes, little
+// endian, with the sequence number of the write shifted 8 bits to the left and its record type in the lowest byte.
+// Every write gets a sequence number higher than the previous one, so internal keys are sorted by user key and then
+// from the newest write to the oldest. WAL records and SSTable entries are stored with internal keys
+
+// makeInternalKey returns the internal key of a write of 'key' with sequence number 'seq' and record type 't'
+func makeInternalKey(key string, seq uint64, t byte) string {
+	b := make([]byte, len(key)+INTERNAL_KEY_TRAILER_SIZE)
+	copy(b, key)
+	binary.LittleEndian.PutUint64(b[len(key):], seq<<8|uint64(t))
+
+	return string(b)
+}
+
+// parseInternalKey splits an internal key in the user key, the sequence number and the record type
+func parseInternalKey(ik string) (key string, seq uint64, t byte, err error) {
+	if len(ik) < INTERNAL_KEY_TRAILER_SIZE {
+		return "", 0, 0, errors.Errorf("Internal key of %d bytes is shorter than its trailer", len(ik))
+	}
+
+	n := len(ik) - INTERNAL_KEY_TRAILER_SIZE
+	trailer := binary.LittleEndian.Uint64([]byte(ik[n:]))
+	if t = byte(trailer); !isValidRecordType(t) {
+		return "", 0, 0, errors.Errorf("Invalid record type %d in internal key", t)
+	}
+
+	return ik[:n], trailer >> 8, t, nil
+}
+
+// entryInternalKey returns the internal key of 'e'
+func entryInternalKey(e *Entry) string {
+	return makeInternalKey(e.Key, e.Seq, recordType(e))
+}
+
+// recordType returns the record type that stores 'e' in WAL files and SSTables
+func recordType(e *Entry) byte {
+	if e.Tombstone {
+		return RECORD_TOMBSTONE
+	}
+
+	if e.Merge {
+		return RECORD_MERGE
+	}
+
+	if e.ExpiresAt != 0 {
+		return RECORD_EXPIRING_VALUE
+	}
+
+	return RECORD_VALUE
+}
+
+// compareInternalKeys returns -1, 0 or 1 if the internal key 'a' sorts before, equal or after 'b' with the user keys
+// ordered by 'cmp'. Malformed keys are compared as plain strings
+func compareInternalKeys(cmp Comparator, a, b string) int {
+	ka, seqa, _, erra := parseInternalKey(a)
+	kb, seqb, _, errb := parseInternalKey(b)
+	if erra != nil || errb != nil {
+		return strings.Compare(a, b)
+	}
+
+	return compareKeys(cmp, ka, seqa, kb, seqb)
+}
+
+// compareEntries sorts entries the same way as their internal keys
+func compareEntries(cmp Comparator, a, b *Entry) int {
+	return compareKeys(cmp, a.Key, a.Seq, b.Key, b.Seq)
+}
+
+func compareKeys(cmp Comparator, ka string, seqa uint64, kb string, seqb uint64) int {
+	if c := cmp.Compare(ka, kb); c != 0 {
+		return c
+	}
+
+	switch {
+	case seqa > seqb:
+		return -1
+	case seqa < seqb:
+		return 1
+	}
+
+	return 0
+}
+
+// indexSeparator returns an internal key that sorts at or after the internal key 'a' and before 'b', with its user
+// key shortened by 'cmp' when it can be. It takes the highest sequence number, so it sorts before every version of
+// its user key
+func indexSeparator(cmp Comparator, a, b string) string {
+	ka, _, _, erra := parseInternalKey(a)
+	kb, _, _, errb := parseInternalKey(b)
+	if erra != nil || errb != nil || cmp.Compare(ka, kb) >= 0 {
+		return a
+	}
+
+	if s := cmp.Separator(ka, kb); len(s) < len(ka) && cmp.Compare(ka, s) < 0 && cmp.Compare(s, kb) < 0 {
+		return makeInternalKey(s, MAX_SEQUENCE, RECORD_VALUE)
+	}
+
+	return a
+}
+
+// indexSuccessor returns an internal key that sorts at or after the internal key 'a', with its user key shortened
+// by 'cmp' when it can be
+func indexSuccessor(cmp Comparator, a string) string {
+	ka, _, _, err := parseInternalKey(a)
+	if err != nil {
+		return a
+	}
+
+	if s := cmp.Successor(ka); len(s) < len(ka) && cmp.Compare(ka, s) < 0 {
+		return makeInternalKey(s, MAX_SEQUENCE, RECORD_VALUE)
+	}
+
+	return a
+}
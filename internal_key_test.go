@@ -0,0 +1,48 @@
+package doom
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestInternalKey(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		key, seq, typ, err := parseInternalKey(makeInternalKey("key\x00with zero", 42, RECORD_TOMBSTONE))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "key\x00with zero" || seq != 42 || typ != RECORD_TOMBSTONE {
+			t.Errorf("Unexpected internal key parts '%s', %d, %d", key, seq, typ)
+		}
+
+		if _, _, _, err = parseInternalKey("short"); err == nil {
+			t.Error("Expected an error parsing a key shorter than the trailer")
+		}
+	})
+
+	t.Run("order", func(t *testing.T) {
+		keys := []string{
+			makeInternalKey("b", 1, RECORD_VALUE),
+			makeInternalKey("a", 1, RECORD_VALUE),
+			makeInternalKey("a", 300, RECORD_TOMBSTONE),
+			makeInternalKey("ab", 2, RECORD_VALUE),
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return compareInternalKeys(BytewiseComparator, keys[i], keys[j]) < 0
+		})
+
+		expected := []string{
+			makeInternalKey("a", 300, RECORD_TOMBSTONE),
+			makeInternalKey("a", 1, RECORD_VALUE),
+			makeInternalKey("ab", 2, RECORD_VALUE),
+			makeInternalKey("b", 1, RECORD_VALUE),
+		}
+		for i := range keys {
+			if keys[i] != expected[i] {
+				t.Fatalf("Unexpected internal key at position %d: %q", i, keys[i])
+			}
+		}
+	})
+}
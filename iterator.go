@@ -0,0 +1,370 @@
+package doom
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// IterOptions restricts the keys and the writes that an Iterator sees
+type IterOptions struct {
+	// LowerBound is the smallest key returned by the iterator. An empty string means no lower bound
+	LowerBound string
+
+	// UpperBound is the first key not returned by the iterator, which stops before it. An empty string means no
+	// upper bound
+	UpperBound string
+
+	// Snapshot makes the iterator see the writes that the snapshot sees. Without it, the iterator sees the writes
+	// made before it was created
+	Snapshot *Snapshot
+
+	// DontFillCache keeps the blocks read by the iterator out of the block cache, so a long scan doesn't evict the
+	// blocks used by other reads. Blocks already in the cache are still used
+	DontFillCache bool
+}
+
+// Iterator walks the keys of the DB in order, in both directions, with the value of their latest version. It merges the
+// MemTables and every SSTable and hides tombstones, expired values and older versions. It must be closed when it isn't
+// needed
+//
+//	it := db.NewIterator(&IterOptions{LowerBound: "a", UpperBound: "b"})
+//	defer it.Close()
+//	for it.SeekToFirst(); it.Valid(); it.Next() {
+//		fmt.Println(it.Key(), string(it.Value()))
+//	}
+type Iterator struct {
+	cmp          Comparator
+	iter         *mergingIterator
+	tables       []*cachedTable
+	seq          uint64
+	lower, upper string
+
+	// now is the time when the iterator was created. Values that expired by then are hidden as if they were deleted
+	now int64
+
+	// mergeOp merges the operands of a key with its value
+	mergeOp MergeOperator
+
+	// Moving forward, the internal iterator is on the entry of the current key. Moving backward, it's on the entry
+	// before all the versions of the current key
+	reverse bool
+	valid   bool
+	key     string
+	value   []byte
+	err     error
+}
+
+// NewIterator returns an iterator over the keys of the DB between the bounds of 'opts', which can be nil. The
+// iterator isn't positioned until one of its Seek methods is called
+func (db *DB) NewIterator(opts *IterOptions) *Iterator {
+	return db.newIterator(db.defaultCF, opts)
+}
+
+// newIterator returns an iterator over the keys of the column family 'cf'
+func (db *DB) newIterator(cf *ColumnFamily, opts *IterOptions) *Iterator {
+	if opts == nil {
+		opts = &IterOptions{}
+	}
+
+	it := &Iterator{
+		cmp:   cf.opts.Comparator,
+		seq:   atomic.LoadUint64(&db.seq),
+		now:   time.Now().UnixNano(),
+		lower: opts.LowerBound,
+		upper: opts.UpperBound,
+
+		mergeOp: cf.opts.MergeOperator,
+	}
+
+	if opts.Snapshot != nil {
+		if atomic.LoadInt32(&opts.Snapshot.released) == 1 {
+			it.err = ErrSnapshotReleased
+			it.iter = newMergingIterator(it.cmp, nil)
+			return it
+		}
+
+		it.seq = opts.Snapshot.seq
+	}
+
+	// Tables are taken from the table cache until the iterator is closed, so neither evictions nor compactions close
+	// them while the iterator reads them
+	db.mu.RLock()
+	if cf.dropped {
+		it.err = ErrColumnFamilyDropped
+	}
+
+	children := make([]internalIterator, 0)
+	for _, mem := range []*MemTable{db.mem, db.imm} {
+		// The immutable MemTable has no room for the families created after it was frozen
+		if mem == nil {
+			continue
+		} else if mi := mem.newIterator(cf.id); mi != nil {
+			children = append(children, mi)
+		}
+	}
+	for _, tables := range cf.levels {
+		for _, m := range tables {
+			if it.beforeLower(m.largest) || it.atOrAfterUpper(m.smallest) {
+				continue
+			}
+
+			t, err := db.tables.get(m.number, cf.opts.Comparator)
+			if err != nil {
+				it.err = err
+				continue
+			}
+
+			it.tables = append(it.tables, t)
+			children = append(children, t.newIterator(!opts.DontFillCache))
+		}
+	}
+	db.mu.RUnlock()
+
+	it.iter = newMergingIterator(it.cmp, children)
+
+	return it
+}
+
+// beforeLower tells if 'key' sorts before the lower bound
+func (it *Iterator) beforeLower(key string) bool {
+	return it.lower != "" && it.cmp.Compare(key, it.lower) < 0
+}
+
+// atOrAfterUpper tells if 'key' sorts at or after the upper bound
+func (it *Iterator) atOrAfterUpper(key string) bool {
+	return it.upper != "" && it.cmp.Compare(key, it.upper) >= 0
+}
+
+// NewIterator returns an iterator that only sees the writes that the snapshot sees
+func (s *Snapshot) NewIterator(opts *IterOptions) *Iterator {
+	o := IterOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.Snapshot = s
+
+	return s.db.NewIterator(&o)
+}
+
+// Valid returns true if the iterator is positioned on a key
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the current key
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns a copy of the value of the current key
+func (it *Iterator) Value() []byte {
+	return append([]byte(nil), it.value...)
+}
+
+// SeekToFirst moves to the first key, and returns false if there is none
+func (it *Iterator) SeekToFirst() bool {
+	if it.lower != "" {
+		return it.Seek(it.lower)
+	}
+
+	it.reverse = false
+	it.iter.SeekToFirst()
+
+	return it.findNextUserEntry(false, "")
+}
+
+// SeekToLast moves to the last key, and returns false if there is none
+func (it *Iterator) SeekToLast() bool {
+	it.reverse = true
+
+	if it.upper == "" {
+		it.iter.SeekToLast()
+	} else if it.iter.Seek(it.upper, MAX_SEQUENCE); it.iter.Valid() {
+		it.iter.Prev()
+	} else {
+		it.iter.SeekToLast()
+	}
+
+	return it.findPrevUserEntry()
+}
+
+// Seek moves to the first key at or after 'key', and returns false if there is none
+func (it *Iterator) Seek(key string) bool {
+	if it.beforeLower(key) {
+		key = it.lower
+	}
+
+	it.reverse = false
+	it.iter.Seek(key, it.seq)
+
+	return it.findNextUserEntry(false, "")
+}
+
+// Next moves to the next key, and returns false if there is none
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+
+	if it.reverse {
+		it.reverse = false
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.SeekToFirst()
+		}
+	} else {
+		it.iter.Next()
+	}
+
+	return it.findNextUserEntry(true, it.key)
+}
+
+// Prev moves to the previous key, and returns false if there is none
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+
+	if !it.reverse {
+		for {
+			if it.iter.Prev(); !it.iter.Valid() {
+				it.valid = false
+				return false
+			}
+
+			if it.cmp.Compare(it.iter.Entry().Key, it.key) < 0 {
+				break
+			}
+		}
+
+		it.reverse = true
+	}
+
+	return it.findPrevUserEntry()
+}
+
+// findNextUserEntry moves forward to the newest visible version of the next key that isn't deleted. Versions of
+// 'skip' are hidden if 'skipping' is true
+func (it *Iterator) findNextUserEntry(skipping bool, skip string) bool {
+	for ; it.iter.Valid(); it.iter.Next() {
+		e := it.iter.Entry()
+		if it.atOrAfterUpper(e.Key) {
+			break
+		}
+
+		if e.Seq > it.seq || (skipping && it.cmp.Compare(e.Key, skip) <= 0) {
+			continue
+		}
+
+		if e.Tombstone || isExpired(e, it.now) {
+			skipping, skip = true, e.Key
+			continue
+		}
+
+		it.valid, it.key, it.value = true, e.Key, e.Data
+		if e.Merge {
+			return it.mergeForward(e)
+		}
+
+		return true
+	}
+
+	it.valid = false
+	return false
+}
+
+// mergeForward merges the operand 'e', the newest visible version of the current key, with the older versions that
+// it's stacked on. The internal iterator is left on the last entry of the key that it reads
+func (it *Iterator) mergeForward(e *Entry) bool {
+	operands := []*Entry{e}
+	var base *Entry
+	for {
+		if it.iter.Next(); !it.iter.Valid() {
+			it.iter.SeekToLast()
+			break
+		}
+
+		next := it.iter.Entry()
+		if it.cmp.Compare(next.Key, e.Key) != 0 {
+			it.iter.Prev()
+			break
+		}
+
+		if !next.Merge {
+			base = next
+			break
+		}
+		operands = append(operands, next)
+	}
+
+	return it.merge(base, operands)
+}
+
+// merge sets the value of the current key to the merge of 'operands', from the newest to the oldest, with 'base'
+func (it *Iterator) merge(base *Entry, operands []*Entry) bool {
+	if it.value, it.err = mergeValue(it.mergeOp, it.key, base, operands, it.now); it.err != nil {
+		it.valid = false
+	}
+
+	return it.valid
+}
+
+// findPrevUserEntry moves backward through the versions of the previous keys, which come from the oldest to the
+// newest, until it has the newest visible version of a key that isn't deleted
+func (it *Iterator) findPrevUserEntry() bool {
+	found := false
+	var base *Entry
+	operands := make([]*Entry, 0)
+	for ; it.iter.Valid(); it.iter.Prev() {
+		e := it.iter.Entry()
+		if it.beforeLower(e.Key) || (found && it.cmp.Compare(e.Key, it.key) < 0) {
+			break
+		}
+
+		if e.Seq > it.seq {
+			continue
+		}
+
+		// Merge operands are stacked over the last value or tombstone of the key, if any
+		if it.cmp.Compare(e.Key, it.key) != 0 {
+			base, operands = nil, operands[:0]
+		}
+		if e.Merge {
+			operands = append([]*Entry{e}, operands...)
+		} else {
+			base, operands = e, operands[:0]
+		}
+
+		found = e.Merge || (!e.Tombstone && !isExpired(e, it.now))
+		it.key, it.value = e.Key, e.Data
+	}
+
+	if it.valid = found; !found {
+		it.reverse = false
+	} else if len(operands) > 0 {
+		return it.merge(base, operands)
+	}
+
+	return found
+}
+
+// Error returns the error found reading the tables, if any
+func (it *Iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.iter.Error()
+}
+
+// Close releases the tables read by the iterator. Errors closing them are logged
+func (it *Iterator) Close() error {
+	for _, t := range it.tables {
+		t.release()
+	}
+
+	it.tables, it.valid = nil, false
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package doom
+
+import "container/heap"
+
+// internalIterator walks entries in order of internal keys, including tombstones and every version of a key. Next,
+// Prev and Entry can only be called when Valid returns true
+type internalIterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+
+	// Seek moves to the first entry at or after the internal key of 'key' and 'seq'
+	Seek(key string, seq uint64)
+	Next()
+	Prev()
+	Entry() *Entry
+	Error() error
+}
+
+// mergingIterator merges the entries of several internal iterators with a heap. Moving forward, the top of the heap
+// is the child with the smallest entry and moving backward the child with the largest one
+type mergingIterator struct {
+	cmp      Comparator
+	children []internalIterator
+	heap     iteratorHeap
+}
+
+func newMergingIterator(cmp Comparator, children []internalIterator) *mergingIterator {
+	return &mergingIterator{cmp: cmp, children: children, heap: iteratorHeap{cmp: cmp}}
+}
+
+type iteratorHeap struct {
+	cmp     Comparator
+	iters   []internalIterator
+	reverse bool
+}
+
+func (h iteratorHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h iteratorHeap) Less(i, j int) bool {
+	c := compareEntries(h.cmp, h.iters[i].Entry(), h.iters[j].Entry())
+	if h.reverse {
+		return c > 0
+	}
+
+	return c < 0
+}
+
+func (h iteratorHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iteratorHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(internalIterator))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+	last := h.iters[len(h.iters)-1]
+	h.iters = h.iters[:len(h.iters)-1]
+
+	return last
+}
+
+// rebuild fills the heap with the valid children for the direction of 'reverse'
+func (it *mergingIterator) rebuild(reverse bool) {
+	it.heap.iters = it.heap.iters[:0]
+	it.heap.reverse = reverse
+
+	for _, c := range it.children {
+		if c.Valid() {
+			it.heap.iters = append(it.heap.iters, c)
+		}
+	}
+
+	heap.Init(&it.heap)
+}
+
+func (it *mergingIterator) Valid() bool {
+	return len(it.heap.iters) > 0
+}
+
+func (it *mergingIterator) SeekToFirst() {
+	for _, c := range it.children {
+		c.SeekToFirst()
+	}
+
+	it.rebuild(false)
+}
+
+func (it *mergingIterator) SeekToLast() {
+	for _, c := range it.children {
+		c.SeekToLast()
+	}
+
+	it.rebuild(true)
+}
+
+func (it *mergingIterator) Seek(key string, seq uint64) {
+	for _, c := range it.children {
+		c.Seek(key, seq)
+	}
+
+	it.rebuild(false)
+}
+
+func (it *mergingIterator) Next() {
+	// Coming from Prev, every other child is behind the current entry. They're moved to the first entry after it
+	if it.heap.reverse {
+		cur, e := it.heap.iters[0], it.Entry()
+		for _, c := range it.children {
+			if c == cur {
+				continue
+			}
+
+			if c.Seek(e.Key, e.Seq); c.Valid() && compareEntries(it.cmp, c.Entry(), e) == 0 {
+				c.Next()
+			}
+		}
+
+		it.rebuild(false)
+	}
+
+	it.advance(internalIterator.Next)
+}
+
+func (it *mergingIterator) Prev() {
+	// Coming from Next, every other child is ahead of the current entry. They're moved to the last entry before it
+	if !it.heap.reverse {
+		cur, e := it.heap.iters[0], it.Entry()
+		for _, c := range it.children {
+			if c == cur {
+				continue
+			}
+
+			if c.Seek(e.Key, e.Seq); c.Valid() {
+				c.Prev()
+			} else {
+				c.SeekToLast()
+			}
+		}
+
+		it.rebuild(true)
+	}
+
+	it.advance(internalIterator.Prev)
+}
+
+// advance moves the child on top of the heap and puts it back in its place, or drops it if it's exhausted
+func (it *mergingIterator) advance(move func(internalIterator)) {
+	move(it.heap.iters[0])
+
+	if it.heap.iters[0].Valid() {
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+	}
+}
+
+func (it *mergingIterator) Entry() *Entry {
+	return it.heap.iters[0].Entry()
+}
+
+func (it *mergingIterator) Error() error {
+	for _, c := range it.children {
+		if err := c.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Writes are spread across several SSTables and the MemTable, with overwrites and deletes between them
+	model := make(map[string]string)
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", r.Intn(200))
+			if r.Intn(4) == 0 {
+				db.Delete(key)
+				delete(model, key)
+				continue
+			}
+
+			value := fmt.Sprintf("value of round %d", round)
+			db.Put(key, []byte(value))
+			model[key] = value
+		}
+
+		if round < 5 {
+			if err = db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expected := func(lower, upper string) []string {
+		keys := make([]string, 0)
+		for k := range model {
+			if k >= lower && (upper == "" || k < upper) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		return keys
+	}
+
+	check := func(t *testing.T, it *Iterator, keys []string, i int) {
+		if i < 0 || i >= len(keys) {
+			if it.Valid() {
+				t.Fatalf("Expected the iterator to be exhausted, it's on '%s'", it.Key())
+			}
+			return
+		}
+
+		if !it.Valid() || it.Key() != keys[i] || string(it.Value()) != model[keys[i]] {
+			t.Fatalf("Expected '%s' = '%s' at position %d, got '%s' = '%s' (valid %v)", keys[i], model[keys[i]], i,
+				it.Key(), it.Value(), it.Valid())
+		}
+	}
+
+	t.Run("forward and backward", func(t *testing.T) {
+		it := db.NewIterator(nil)
+		defer it.Close()
+
+		keys := expected("", "")
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			check(t, it, keys, i)
+			i++
+		}
+		if i != len(keys) {
+			t.Fatalf("Expected %d keys, got %d", len(keys), i)
+		}
+
+		i = len(keys) - 1
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			check(t, it, keys, i)
+			i--
+		}
+		if i != -1 {
+			t.Fatalf("Expected %d keys backward, %d were missing", len(keys), i+1)
+		}
+
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		it := db.NewIterator(&IterOptions{LowerBound: "key050", UpperBound: "key150"})
+		defer it.Close()
+
+		keys := expected("key050", "key150")
+
+		it.SeekToFirst()
+		check(t, it, keys, 0)
+
+		it.SeekToLast()
+		check(t, it, keys, len(keys)-1)
+
+		it.Seek("a")
+		check(t, it, keys, 0)
+
+		if it.Seek("key150") {
+			t.Errorf("Expected no key at the upper bound, got '%s'", it.Key())
+		}
+
+		n := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			n++
+		}
+		if n != len(keys) {
+			t.Errorf("Expected %d keys between the bounds, got %d", len(keys), n)
+		}
+	})
+
+	t.Run("changes of direction", func(t *testing.T) {
+		it := db.NewIterator(nil)
+		defer it.Close()
+
+		keys := expected("", "")
+		pos := sort.SearchStrings(keys, "key100")
+		it.Seek("key100")
+		check(t, it, keys, pos)
+
+		for step := 0; step < 200; step++ {
+			if r.Intn(2) == 0 {
+				it.Next()
+				pos++
+			} else {
+				it.Prev()
+				pos--
+			}
+			check(t, it, keys, pos)
+
+			if !it.Valid() {
+				pos = sort.SearchStrings(keys, "key100")
+				it.Seek("key100")
+			}
+		}
+	})
+
+	t.Run("snapshot and compactions", func(t *testing.T) {
+		snap := db.NewSnapshot()
+		defer snap.Release()
+
+		keys := expected("", "")
+		it := snap.NewIterator(nil)
+		defer it.Close()
+
+		// Writes after the snapshot and compactions of the tables under the iterator don't change what it reads
+		for round := 0; round < 2*DEFAULT_L0_COMPACTION_TRIGGER; round++ {
+			for i := 0; i < 200; i += 3 {
+				db.Put(fmt.Sprintf("key%03d", i), []byte("later"))
+			}
+			if err = db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitForCompactions(t, db)
+
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			check(t, it, keys, i)
+			i++
+		}
+		if i != len(keys) {
+			t.Fatalf("Expected %d keys, got %d", len(keys), i)
+		}
+
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
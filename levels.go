@@ -0,0 +1,97 @@
+package doom
+
+import "sort"
+
+// tableMeta describes a live SSTable: its column family, its level, its file number, the range of keys that it holds
+// and its highest sequence number. The table itself is opened through the table cache of its column family
+type tableMeta struct {
+	family            uint32
+	level             int
+	number            uint64
+	size              int64
+	smallest, largest string
+	maxSeq            uint64
+}
+
+func (m *tableMeta) contains(cmp Comparator, key string) bool {
+	return cmp.Compare(m.smallest, key) <= 0 && cmp.Compare(key, m.largest) <= 0
+}
+
+func (m *tableMeta) overlaps(cmp Comparator, smallest, largest string) bool {
+	return cmp.Compare(m.smallest, largest) <= 0 && cmp.Compare(smallest, m.largest) <= 0
+}
+
+// totalSize returns the number of bytes of the tables
+func totalSize(ms []*tableMeta) (size int64) {
+	for _, m := range ms {
+		size += m.size
+	}
+
+	return
+}
+
+// keyRange returns the smallest and largest keys of the tables in the order of 'cmp'
+func keyRange(cmp Comparator, ms ...[]*tableMeta) (smallest, largest string) {
+	first := true
+	for _, tables := range ms {
+		for _, m := range tables {
+			if first || cmp.Compare(m.smallest, smallest) < 0 {
+				smallest = m.smallest
+			}
+			if first || cmp.Compare(m.largest, largest) > 0 {
+				largest = m.largest
+			}
+			first = false
+		}
+	}
+
+	return
+}
+
+// overlappingTables returns the tables that have keys in the range between 'smallest' and 'largest'
+func overlappingTables(cmp Comparator, tables []*tableMeta, smallest, largest string) []*tableMeta {
+	res := make([]*tableMeta, 0)
+	for _, m := range tables {
+		if m.overlaps(cmp, smallest, largest) {
+			res = append(res, m)
+		}
+	}
+
+	return res
+}
+
+// tablesForKey returns the tables of a level that can hold 'key'. Tables in level 0 can overlap and are sorted from
+// the newest to the oldest. Tables in other levels don't overlap so only one can have the key
+func tablesForKey(cmp Comparator, level int, tables []*tableMeta, key string) []*tableMeta {
+	if level == 0 {
+		res := make([]*tableMeta, 0)
+		for _, m := range tables {
+			if m.contains(cmp, key) {
+				res = append(res, m)
+			}
+		}
+
+		return res
+	}
+
+	i := sort.Search(len(tables), func(i int) bool {
+		return cmp.Compare(tables[i].largest, key) >= 0
+	})
+	if i < len(tables) && tables[i].contains(cmp, key) {
+		return tables[i : i+1]
+	}
+
+	return nil
+}
+
+// sortLevel keeps level 0 sorted from the newest table to the oldest, by their highest sequence numbers, and the
+// rest of levels by their keys
+func sortLevel(cmp Comparator, level int, tables []*tableMeta) {
+	sort.Slice(tables, func(i, j int) bool {
+		if level == 0 {
+			return tables[i].maxSeq > tables[j].maxSeq
+		}
+
+		return cmp.Compare(tables[i].smallest, tables[j].smallest) < 0
+	})
+}
@@ -0,0 +1,139 @@
+package doom
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		fs   FS
+		dir  string
+	}{
+		{"os", OSFS, dir},
+		{"memory", NewMemFS(), "/db"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &Options{FS: test.fs}
+			db, err := Open(test.dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = Open(test.dir, opts); errors.Cause(err) != ErrLocked {
+				t.Errorf("Expected ErrLocked opening a DB that is open, got %v", err)
+			}
+
+			if err = db.Put("key", []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			if db, err = Open(test.dir, opts); err != nil {
+				t.Fatalf("Could not open the DB after closing it: %v", err)
+			}
+			defer db.Close()
+
+			if value, err := db.Get("key"); err != nil || string(value) != "value" {
+				t.Errorf("Unexpected value '%s' (%v)", value, err)
+			}
+		})
+	}
+
+	t.Run("released when open fails", func(t *testing.T) {
+		fs := NewMemFS()
+		f, _ := fs.Create("/db/" + CURRENT_FILE)
+		f.Write([]byte(MANIFEST_PREFIX + "000009\n"))
+		f.Close()
+
+		if _, err := Open("/db", &Options{FS: fs}); err == nil {
+			t.Fatal("Expected an error with a missing MANIFEST")
+		}
+
+		fs.Remove("/db/" + CURRENT_FILE)
+		db, err := Open("/db", &Options{FS: fs})
+		if err != nil {
+			t.Fatalf("Expected the lock to be released, got %v", err)
+		}
+		db.Close()
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Half of the keys are in a table and the rest only in the WAL
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			if err = db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Put(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value %d", i)))
+	}
+	db.Delete("key05")
+
+	files := func() []string {
+		names, err := OSFS.List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+
+		return names
+	}
+	before := files()
+
+	ro, err := Open(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Could not open a locked DB read-only: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		value, err := ro.Get(key)
+		if i == 5 && err != ErrNotFound {
+			t.Errorf("Expected '%s' to be deleted, got '%s' (%v)", key, value, err)
+		} else if i != 5 && string(value) != fmt.Sprintf("value %d", i) {
+			t.Errorf("Unexpected value '%s' of %s (%v)", value, key, err)
+		}
+	}
+
+	if err = ro.Put("key", []byte("value")); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly writing, got %v", err)
+	}
+	if err = ro.Flush(); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly flushing, got %v", err)
+	}
+
+	if err = ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := files(); !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected the files to be left as they were %v, got %v", before, after)
+	}
+
+	// The DB that has the lock is still usable
+	if err = db.Put("key", []byte("value")); err != nil {
+		t.Errorf("Unexpected error writing after the read-only DB was closed: %v", err)
+	}
+}
@@ -0,0 +1,446 @@
+package doom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/juju/errors"
+	"github.com/thehivecorporation/log"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrCorruptedManifest is returned when an edit of the MANIFEST that isn't the last one can't be decoded
+var ErrCorruptedManifest = errors.New("corrupted manifest")
+
+// versionEdit is a change to the set of live files, logged to the MANIFEST before it's applied. Every edit carries
+// the counters of the DB too: WAL files numbered below 'logNumber' are already stored in tables, 'nextFileNumber' is
+// the first file number not used yet and 'lastSeq' is the last sequence number given to a write. Only the level,
+// number, size, key range and highest sequence number of the tables are logged. The first edit of a MANIFEST names
+// the comparator of the DB too.
+//
+// Edits of a DB with column families carry 'lastFamily', the highest id given to one, so ids are never reused, the
+// families created and dropped, and the family of every table added. Tables of the default family don't need them
+type versionEdit struct {
+	logNumber, nextFileNumber, lastSeq uint64
+	added, removed                     []*tableMeta
+	comparator                         string
+
+	lastFamily uint32
+	created    []*familyMeta
+	dropped    []uint32
+}
+
+// encode writes the edit with the following layout, all numbers as unsigned varints:
+//
+//	log number | next file number | last sequence | removed count | (level | number)... |
+//	added count | (level | number | size | max sequence | smallest length | smallest | largest length | largest)... |
+//	[comparator length | comparator |
+//	[last family | created count | (id | name length | name | comparator length | comparator)... |
+//	dropped count | id... | family of each added table...]]
+//
+// The comparator is only written when it's set or when the column families are, which are only written once a family
+// has been created
+func (e *versionEdit) encode() []byte {
+	b := make([]byte, 0, 64)
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		b = append(b, scratch[:binary.PutUvarint(scratch[:], v)]...)
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		b = append(b, s...)
+	}
+
+	putUvarint(e.logNumber)
+	putUvarint(e.nextFileNumber)
+	putUvarint(e.lastSeq)
+
+	putUvarint(uint64(len(e.removed)))
+	for _, m := range e.removed {
+		putUvarint(uint64(m.level))
+		putUvarint(m.number)
+	}
+
+	putUvarint(uint64(len(e.added)))
+	for _, m := range e.added {
+		putUvarint(uint64(m.level))
+		putUvarint(m.number)
+		putUvarint(uint64(m.size))
+		putUvarint(m.maxSeq)
+		putString(m.smallest)
+		putString(m.largest)
+	}
+
+	if e.comparator != "" || e.lastFamily > 0 {
+		putString(e.comparator)
+	}
+
+	if e.lastFamily > 0 {
+		putUvarint(uint64(e.lastFamily))
+
+		putUvarint(uint64(len(e.created)))
+		for _, f := range e.created {
+			putUvarint(uint64(f.id))
+			putString(f.name)
+			putString(f.comparator)
+		}
+
+		putUvarint(uint64(len(e.dropped)))
+		for _, id := range e.dropped {
+			putUvarint(uint64(id))
+		}
+
+		for _, m := range e.added {
+			putUvarint(uint64(m.family))
+		}
+	}
+
+	return b
+}
+
+func decodeVersionEdit(b []byte) (e *versionEdit, err error) {
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			err = ErrCorruptedManifest
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	str := func() string {
+		l := uvarint()
+		if err != nil || l > uint64(len(b)) {
+			err = ErrCorruptedManifest
+			return ""
+		}
+		s := string(b[:l])
+		b = b[l:]
+		return s
+	}
+	level := func() int {
+		l := uvarint()
+		if err == nil && l >= MAX_LEVELS {
+			err = ErrCorruptedManifest
+		}
+		return int(l)
+	}
+	family := func() uint32 {
+		id := uvarint()
+		if err == nil && id > math.MaxUint32 {
+			err = ErrCorruptedManifest
+		}
+		return uint32(id)
+	}
+
+	e = &versionEdit{logNumber: uvarint(), nextFileNumber: uvarint(), lastSeq: uvarint()}
+
+	for n := uvarint(); err == nil && n > 0; n-- {
+		e.removed = append(e.removed, &tableMeta{level: level(), number: uvarint()})
+	}
+
+	for n := uvarint(); err == nil && n > 0; n-- {
+		m := &tableMeta{level: level(), number: uvarint(), size: int64(uvarint()), maxSeq: uvarint()}
+		m.smallest, m.largest = str(), str()
+		e.added = append(e.added, m)
+	}
+
+	if err == nil && len(b) > 0 {
+		e.comparator = str()
+	}
+
+	if err == nil && len(b) > 0 {
+		e.lastFamily = family()
+
+		for n := uvarint(); err == nil && n > 0; n-- {
+			f := &familyMeta{id: family()}
+			f.name, f.comparator = str(), str()
+			e.created = append(e.created, f)
+		}
+
+		for n := uvarint(); err == nil && n > 0; n-- {
+			e.dropped = append(e.dropped, family())
+		}
+
+		for _, m := range e.added {
+			if err == nil {
+				m.family = family()
+			}
+		}
+	}
+
+	if err == nil && len(b) > 0 {
+		err = ErrCorruptedManifest
+	}
+
+	if err != nil {
+		return nil, errors.Annotate(err, "Invalid version edit")
+	}
+
+	return
+}
+
+// manifest is the log of version edits of a DB. Each edit is framed as length (4 bytes) | CRC32C (4 bytes) | edit,
+// little endian, and synced before it's applied
+type manifest struct {
+	f      File
+	number uint64
+}
+
+// createManifest writes a new MANIFEST numbered 'number' in 'folder' of 'fs' starting with 'snapshot', the edit that
+// adds every live table, and points CURRENT to it
+func createManifest(fs FS, folder string, number uint64, snapshot *versionEdit) (m *manifest, err error) {
+	f, err := fs.Create(manifestFileName(folder, number))
+	if err != nil {
+		return nil, errors.Annotate(err, "Could not create MANIFEST")
+	}
+
+	m = &manifest{f: f, number: number}
+	if err = m.log(snapshot); err == nil {
+		err = setCurrent(fs, folder, number)
+	}
+
+	if err != nil {
+		f.Close()
+		removeFiles(fs, f.Name())
+		return nil, err
+	}
+
+	return
+}
+
+// log appends 'e' to the MANIFEST and syncs it
+func (m *manifest) log(e *versionEdit) (err error) {
+	payload := e.encode()
+
+	b := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.Checksum(payload, crcTable))
+	copy(b[8:], payload)
+
+	if _, err = m.f.Write(b); err == nil {
+		err = m.f.Sync()
+	}
+
+	if err != nil {
+		err = errors.Annotatef(err, "Could not write version edit to '%s'", m.f.Name())
+	}
+
+	return
+}
+
+func (m *manifest) Close() error {
+	return m.f.Close()
+}
+
+// readManifest returns the edits logged to the MANIFEST 'name'. An edit cut at the end of the file was being written
+// when the process died, so it was never applied and it's ignored
+func readManifest(fs FS, name string) (edits []*versionEdit, err error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Could not open MANIFEST '%s'", name)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(r, header); err == io.EOF {
+			return edits, nil
+		} else if err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "Could not read MANIFEST '%s'", name)
+		}
+
+		if binary.LittleEndian.Uint32(header[0:4]) > MAX_RECORD_PAYLOAD_SIZE {
+			return nil, errors.Annotatef(ErrCorruptedManifest, "Invalid edit length in MANIFEST '%s'", name)
+		}
+
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err = io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "Could not read MANIFEST '%s'", name)
+		}
+
+		_, peekErr := r.Peek(1)
+		isLast := peekErr == io.EOF
+
+		e, err := decodeVersionEdit(payload)
+		if err == nil && binary.LittleEndian.Uint32(header[4:8]) != crc32.Checksum(payload, crcTable) {
+			err = errors.Annotate(ErrCorruptedManifest, "Checksum mismatch")
+		}
+
+		if err != nil && isLast {
+			break
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "In MANIFEST '%s' after %d edits", name, len(edits))
+		}
+
+		edits = append(edits, e)
+	}
+
+	log.Warnf("Discarding torn version edit after %d edits of MANIFEST '%s'", len(edits), name)
+
+	return edits, nil
+}
+
+// setCurrent points CURRENT in 'folder' to the MANIFEST numbered 'number'. The new content is synced to a temporary
+// file that's renamed over CURRENT, so it's always found whole, and the folder is synced so the rename and the new
+// MANIFEST survive a power failure
+func setCurrent(fs FS, folder string, number uint64) (err error) {
+	// A temporary file left by a crash is replaced
+	tmp := filepath.Join(folder, CURRENT_FILE+TEMP_FILE_EXT)
+	if err = fs.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Annotate(err, "Could not remove temporary CURRENT file")
+	}
+
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return errors.Annotate(err, "Could not create CURRENT file")
+	}
+
+	if _, err = f.Write([]byte(filepath.Base(manifestFileName(folder, number)) + "\n")); err == nil {
+		err = f.Sync()
+	}
+
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = fs.Rename(tmp, filepath.Join(folder, CURRENT_FILE))
+	}
+
+	if err == nil {
+		err = fs.SyncDir(folder)
+	}
+
+	if err != nil {
+		removeFiles(fs, tmp)
+		return errors.Annotate(err, "Could not write CURRENT file")
+	}
+
+	return
+}
+
+// readCurrent returns the path of the MANIFEST in use in 'folder', or an empty string if the DB is new
+func readCurrent(fs FS, folder string) (name string, err error) {
+	f, err := fs.Open(filepath.Join(folder, CURRENT_FILE))
+	if os.IsNotExist(errors.Cause(err)) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Annotate(err, "Could not open CURRENT file")
+	}
+	defer f.Close()
+
+	byt, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", errors.Annotate(err, "Could not read CURRENT file")
+	}
+
+	name = strings.TrimSpace(string(byt))
+	if kind, _, ok := parseFileName(name); !ok || kind != manifestFileKind || name != filepath.Base(name) {
+		return "", errors.Annotatef(ErrCorruptedManifest, "CURRENT points to an invalid file '%s'", name)
+	}
+
+	return filepath.Join(folder, name), nil
+}
+
+// logAndApply writes 'e' to the MANIFEST and then applies it to the levels, running 'then' under the same lock so
+// reads see both changes at once. Edits are applied in the order that they're logged. A zero log number in 'e' keeps
+// the current one
+func (db *DB) logAndApply(e *versionEdit, then func()) (err error) {
+	db.manifestMu.Lock()
+	defer db.manifestMu.Unlock()
+
+	if e.logNumber == 0 {
+		e.logNumber = db.logNumber
+	}
+	e.nextFileNumber = atomic.LoadUint64(&db.nextFile)
+	e.lastSeq = atomic.LoadUint64(&db.seq)
+
+	// New tables must be found after a power failure once the edit that adds them is
+	if len(e.added) > 0 {
+		if err = db.fs.SyncDir(db.storageFolder); err != nil {
+			return errors.Annotate(err, "Could not sync the folder of new tables")
+		}
+	}
+
+	for _, f := range e.created {
+		if f.id > db.lastFamily {
+			db.lastFamily = f.id
+		}
+	}
+	e.lastFamily = db.lastFamily
+
+	if err = db.manifest.log(e); err != nil {
+		return
+	}
+	db.logNumber = e.logNumber
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.applyEdit(e)
+	if then != nil {
+		then()
+	}
+
+	return
+}
+
+// applyEdit removes and adds the tables of 'e' to the levels of their column families. Tables of families that were
+// dropped are ignored. Must be called with db.mu held
+func (db *DB) applyEdit(e *versionEdit) {
+	for _, m := range e.removed {
+		if cf := db.families[m.family]; cf != nil {
+			cf.levels[m.level] = withoutTables(cf.levels[m.level], []*tableMeta{m})
+		}
+	}
+
+	for _, m := range e.added {
+		if cf := db.families[m.family]; cf != nil {
+			cf.levels[m.level] = append(cf.levels[m.level], m)
+			sortLevel(cf.opts.Comparator, m.level, cf.levels[m.level])
+		}
+	}
+}
+
+// snapshotEdit returns the edit that creates every live column family and adds every live table, which starts a new
+// MANIFEST. Must be called with db.manifestMu held
+func (db *DB) snapshotEdit() *versionEdit {
+	e := &versionEdit{
+		logNumber:      db.logNumber,
+		nextFileNumber: atomic.LoadUint64(&db.nextFile),
+		lastSeq:        atomic.LoadUint64(&db.seq),
+		comparator:     db.opts.Comparator.Name(),
+		lastFamily:     db.lastFamily,
+	}
+
+	for _, cf := range db.sortedFamilies() {
+		if cf.id != DEFAULT_COLUMN_FAMILY_ID {
+			e.created = append(e.created, &familyMeta{id: cf.id, name: cf.name, comparator: cf.opts.Comparator.Name()})
+		}
+
+		db.mu.RLock()
+		for _, tables := range cf.levels {
+			e.added = append(e.added, tables...)
+		}
+		db.mu.RUnlock()
+	}
+
+	return e
+}
+
+// newFileNumber returns the next unused file number
+func (db *DB) newFileNumber() uint64 {
+	return atomic.AddUint64(&db.nextFile, 1) - 1
+}
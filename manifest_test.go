@@ -0,0 +1,226 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVersionEdit(t *testing.T) {
+	e := &versionEdit{
+		logNumber:      7,
+		nextFileNumber: 12,
+		lastSeq:        300,
+		added: []*tableMeta{
+			{level: 1, number: 9, size: 4096, maxSeq: 250, smallest: "a", largest: "m"},
+			{level: 1, number: 10, size: 2048, maxSeq: 300, smallest: "n", largest: "z"},
+		},
+		removed: []*tableMeta{{level: 0, number: 3}, {level: 1, number: 5}},
+	}
+
+	decoded, err := decodeVersionEdit(e.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(e, decoded) {
+		t.Errorf("Expected '%+v', got '%+v'", e, decoded)
+	}
+
+	if _, err = decodeVersionEdit(e.encode()[:10]); err == nil {
+		t.Error("Expected an error decoding a truncated edit")
+	}
+
+	t.Run("column families", func(t *testing.T) {
+		e.lastFamily = 4
+		e.created = []*familyMeta{{id: 3, name: "users", comparator: "test.ReverseComparator"}, {id: 4, name: "events"}}
+		e.dropped = []uint32{2}
+		e.added[1].family = 3
+
+		decoded, err := decodeVersionEdit(e.encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(e, decoded) {
+			t.Errorf("Expected '%+v', got '%+v'", e, decoded)
+		}
+	})
+}
+
+func TestFileNames(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		kind   int
+		number uint64
+	}{
+		{tableFileName("/tmp", 12), tableFileKind, 12},
+		{walFileName("/tmp", 3), walFileKind, 3},
+		{manifestFileName("/tmp", 1234567), manifestFileKind, 1234567},
+	} {
+		if kind, number, ok := parseFileName(c.name); !ok || kind != c.kind || number != c.number {
+			t.Errorf("Unexpected kind %d and number %d of '%s'", kind, number, c.name)
+		}
+	}
+
+	for _, name := range []string{CURRENT_FILE, "LOCK", "abc.sst", "write-ahead-log-123"} {
+		if _, _, ok := parseFileName(name); ok {
+			t.Errorf("'%s' isn't a numbered file", name)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 2*DEFAULT_L0_COMPACTION_TRIGGER; round++ {
+		for i := 0; i < 20; i++ {
+			db.Put(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("round %d", round)))
+		}
+
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForCompactions(t, db)
+	db.Put("unflushed", []byte("value"))
+
+	layout := func(db *DB) (levels [MAX_LEVELS][]uint64) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		for level, tables := range db.defaultCF.levels {
+			for _, m := range tables {
+				levels[level] = append(levels[level], m.number)
+			}
+		}
+
+		return
+	}
+
+	before := layout(db)
+	seq := db.seq
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("live files and counters recovered", func(t *testing.T) {
+		if db, err = Open(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if after := layout(db); !reflect.DeepEqual(before, after) {
+			t.Errorf("Expected levels '%v', got '%v'", before, after)
+		}
+
+		if db.seq != seq {
+			t.Errorf("Expected the last sequence to be %d, got %d", seq, db.seq)
+		}
+
+		for _, key := range []string{"key00", "key19", "unflushed"} {
+			if _, err := db.Get(key); err != nil {
+				t.Errorf("Expected '%s' after reopening: %v", key, err)
+			}
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("obsolete files removed on open", func(t *testing.T) {
+		live := make(map[uint64]bool)
+		for _, numbers := range before {
+			for _, number := range numbers {
+				live[number] = true
+			}
+		}
+
+		// A number given by the DB to a table that isn't live, and numbers that the DB never gave
+		orphan := uint64(1)
+		for live[orphan] {
+			orphan++
+		}
+		ioutil.WriteFile(tableFileName(dir, orphan), []byte("half written table"), 0644)
+		ioutil.WriteFile(tableFileName(dir, 999), []byte("table of someone else"), 0644)
+		ioutil.WriteFile(manifestFileName(dir, 998), nil, 0644)
+		ioutil.WriteFile(filepath.Join(dir, CURRENT_FILE+TEMP_FILE_EXT), nil, 0644)
+
+		if db, err = Open(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if db.nextFile <= 999 {
+			t.Errorf("Expected file numbers found on disk to be skipped, next one is %d", db.nextFile)
+		}
+
+		if _, err := os.Stat(tableFileName(dir, orphan)); err == nil {
+			t.Errorf("Expected table %d to be removed", orphan)
+		}
+		if _, err := os.Stat(tableFileName(dir, 999)); err != nil {
+			t.Errorf("Expected the table never given by the DB to be kept: %v", err)
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		tables, wals, manifests := 0, 0, 0
+		for _, cf := range files {
+			switch kind, _, _ := parseFileName(cf.Name()); {
+			case cf.Name() == CURRENT_FILE, cf.Name() == LOCK_FILE:
+			case kind == tableFileKind:
+				tables++
+			case kind == walFileKind:
+				wals++
+			case kind == manifestFileKind:
+				manifests++
+			default:
+				t.Errorf("Unexpected file '%s'", cf.Name())
+			}
+		}
+
+		n := 0
+		for _, numbers := range layout(db) {
+			n += len(numbers)
+		}
+
+		// The MemTable has a table file and a WAL file of its own, and the files never given by the DB are kept
+		if tables != n+2 || wals != 1 || manifests != 2 {
+			t.Errorf("Expected %d tables, 1 WAL and 2 MANIFESTs, got %d, %d and %d", n+2, tables, wals, manifests)
+		}
+	})
+
+	t.Run("torn edit at the end of the MANIFEST", func(t *testing.T) {
+		name, err := readCurrent(OSFS, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		edits, err := readManifest(OSFS, name)
+		if err != nil || len(edits) == 0 {
+			t.Fatalf("Expected the edits of '%s', got %d (%v)", name, len(edits), err)
+		}
+
+		f, _ := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+		f.Write([]byte{200, 0, 0, 0, 1, 2, 3})
+		f.Close()
+
+		torn, err := readManifest(OSFS, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(torn) != len(edits) {
+			t.Errorf("Expected %d edits, got %d", len(edits), len(torn))
+		}
+	})
+}
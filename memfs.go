@@ -0,0 +1,345 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS that keeps its files in memory. It remembers what was synced, so CrashClone can tell what a power
+// failure would leave on a disk: the data synced to the files that were in their folder when it was last synced
+type MemFS struct {
+	mu sync.Mutex
+
+	// files are the files as they're seen now, durable the ones found after a power failure
+	files   map[string]*memNode
+	durable map[string]*memNode
+
+	// locks are the files locked by Lock. They belong to the process, so CrashClone doesn't copy them
+	locks map[string]bool
+}
+
+type memNode struct {
+	data, synced []byte
+}
+
+// NewMemFS returns an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:   make(map[string]*memNode),
+		durable: make(map[string]*memNode),
+		locks:   make(map[string]bool),
+	}
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; ok {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+
+	n := &memNode{}
+	fs.files[name] = n
+
+	return &memFile{fs: fs, node: n, name: name}, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	n, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return &memFile{fs: fs, node: n, name: name, readOnly: true}, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+
+	delete(fs.files, name)
+
+	return nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	n, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+
+	delete(fs.files, oldname)
+	fs.files[newname] = n
+
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	n, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return memFileInfo{name: filepath.Base(name), size: int64(len(n.data))}, nil
+}
+
+func (fs *MemFS) List(dir string) (names []string, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// SyncDir makes the files that are now in 'dir' the ones found there after a power failure
+func (fs *MemFS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	for name := range fs.durable {
+		if filepath.Dir(name) == dir {
+			delete(fs.durable, name)
+		}
+	}
+
+	for name, n := range fs.files {
+		if filepath.Dir(name) == dir {
+			fs.durable[name] = n
+		}
+	}
+
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+
+	if _, ok := fs.files[name]; !ok {
+		fs.files[name] = &memNode{}
+	}
+	fs.locks[name] = true
+
+	return &memLock{fs: fs, name: name}, nil
+}
+
+// memLock is a lock taken on a file of a MemFS
+type memLock struct {
+	fs       *MemFS
+	name     string
+	released bool
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+
+	if l.released {
+		return os.ErrClosed
+	}
+	l.released = true
+	delete(l.fs.locks, l.name)
+
+	return nil
+}
+
+// CrashClone returns a copy of the files that would survive a power failure now. Data that wasn't synced is lost,
+// and so are the files created, renamed or removed since their folder was last synced
+func (fs *MemFS) CrashClone() *MemFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	clone := NewMemFS()
+	for name, n := range fs.durable {
+		synced := append([]byte{}, n.synced...)
+		clone.files[name] = &memNode{data: synced, synced: synced}
+		clone.durable[name] = clone.files[name]
+	}
+
+	return clone
+}
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	fs       *MemFS
+	node     *memNode
+	name     string
+	pos      int64
+	readOnly bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n = copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+
+	return
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if off < int64(len(f.node.data)) {
+		n = copy(p, f.node.data[off:])
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (f *memFile) Write(p []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	} else if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+
+	n = copy(f.node.data[f.pos:], p)
+	f.pos += int64(n)
+
+	return
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data))}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	f.node.synced = append([]byte{}, f.node.data...)
+
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
@@ -1,50 +1,94 @@
 package doom
 
 import (
-	"fmt"
 	"github.com/juju/errors"
 	"github.com/thehivecorporation/log"
 	"io"
-	"os"
-	"sort"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// New creates a new MemTable and its related WAL and SStable files on disk
-func New(tempFolder, storageFolder string) (s *MemTable, err error) {
+// newMemTable creates an empty MemTable with its WAL and SSTable files numbered 'number' on the FS of 'o'. The folder
+// of the WAL is synced, so the file is found after a power failure with whatever was synced to it
+func newMemTable(o *Options, tempFolder, storageFolder string, number uint64) (s *MemTable, err error) {
+	fs := o.FS
 	s = &MemTable{
-		Index:         make(map[string]*Entry),
+		opts:          o,
+		fs:            fs,
+		tables:        map[uint32]*skiplist{DEFAULT_COLUMN_FAMILY_ID: newSkiplist(o.Comparator)},
+		number:        number,
 		tempFolder:    tempFolder,
 		storageFolder: storageFolder,
 	}
 
-	cleanEmptyFilesOnFolder(tempFolder)
+	// Numbers are never used twice, so the files can't exist
+	if s.walFile, err = fs.Create(walFileName(tempFolder, number)); err != nil {
+		return nil, errors.Annotate(err, "Error trying to create WAL file")
+	}
+
+	if s.StorageFile, err = fs.Create(tableFileName(storageFolder, number)); err != nil {
+		s.walFile.Close()
+		return nil, errors.Annotate(err, "Could not create SSTable file")
+	}
 
-	if s.StorageFile, s.walFile, err = createDbFiles(storageFolder, tempFolder); err != nil {
-		log.WithError(err).Fatal("Error creating storage files")
+	if err = fs.SyncDir(tempFolder); err != nil {
+		s.walFile.Close()
+		s.StorageFile.Close()
+		return nil, errors.Annotate(err, "Could not sync WAL folder")
 	}
 
 	s.writer = io.MultiWriter(s.walFile, s)
 
-	if err := readWALFilesFromFolder(tempFolder, s); err != nil {
-		log.WithError(err).Fatal("Could not read WAL file")
+	return
+}
+
+// newMemoryOnlyMemTable creates an empty MemTable without files, which can only be filled by replaying WAL files
+// into it. Read-only DBs use it
+func newMemoryOnlyMemTable(o *Options) (s *MemTable) {
+	s = &MemTable{
+		opts:   o,
+		fs:     o.FS,
+		tables: map[uint32]*skiplist{DEFAULT_COLUMN_FAMILY_ID: newSkiplist(o.Comparator)},
 	}
+	s.writer = s
 
 	return
 }
 
+// MemTable keeps the latest writes in memory, sorted by internal key in a skiplist for each column family, and in a
+// WAL file shared by all of them until they are persisted in SSTables. It can be read concurrently but writes must
+// come from one goroutine at a time. Its methods without a column family work on the default one
 type MemTable struct {
+	opts                      *Options
+	fs                        FS
+	number                    uint64
 	tempFolder, storageFolder string
-	E                         []*Entry
-	AccBytes                  int64
-	Index                     map[string]*Entry
-	StorageFile               *os.File
-	walFile                   *os.File
+	tables                    map[uint32]*skiplist
+	LastSeq                   uint64
+	StorageFile               File
+	walFile                   File
 	writer                    io.Writer
+
+	// walSize is the number of bytes written to the WAL. syncMu protects syncedSize, the bytes of them that are
+	// known to be on stable storage, and closed. syncs counts the calls to fsync
+	walSize    int64
+	syncMu     sync.Mutex
+	syncedSize int64
+	syncs      int64
+	closed     bool
 }
 
-// Close closes the WAL and the sstable file
+// Close closes the WAL and the sstable file. Closing a closed MemTable, or one without files, does nothing
 func (s *MemTable) Close() (err error) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	if s.closed || s.walFile == nil {
+		return
+	}
+	s.closed = true
+
 	if err = s.walFile.Close(); err != nil {
 		log.WithError(err).Error("Error trying to close WAL file")
 	}
@@ -57,130 +101,235 @@ func (s *MemTable) Close() (err error) {
 	return err
 }
 
-// Set stored a new key-value in the MemTable index
-func (s *MemTable) Set(key string, value *Entry) {
-	s.Index[key] = value
+// Get returns a value taken from the MemTable. Deleted and expired keys are reported as not found. Use DB.Get to
+// search the SSTables too
+func (s *MemTable) Get(key string) *Entry {
+	e := s.lookup(DEFAULT_COLUMN_FAMILY_ID, key, MAX_SEQUENCE)
+	if e == nil || e.Tombstone || isExpired(e, time.Now().UnixNano()) {
+		return nil
+	}
+
+	return e
 }
 
-// Get returns a value taken from the MemTable
-// TODO It should also check and merge the indices stored in the disk
-func (s *MemTable) Get(key string) *Entry {
-	return s.Index[key]
+// lookup returns the newest entry of 'key' of the column family 'family' in the MemTable with a sequence number up to
+// 'seq', which can be a tombstone
+func (s *MemTable) lookup(family uint32, key string, seq uint64) *Entry {
+	if t := s.tables[family]; t != nil {
+		return t.get(key, seq)
+	}
+
+	return nil
 }
 
-// Insert writes 'd' into the WAL and the MemTable
-func (s *MemTable) Insert(d string) (err error) {
-	if _, err = s.writer.Write([]byte(fmt.Sprintf("%s\n", d))); err != nil {
-		err = errors.Annotate(err, "Error writing to pipe writer")
+// Len returns the number of entries of the MemTable, counting every version of a key, in every column family
+func (s *MemTable) Len() int {
+	n := 0
+	for _, t := range s.tables {
+		n += t.len()
+	}
+
+	return n
+}
+
+// ApproximateSize returns the bytes of memory taken by the entries of the MemTable, in every column family
+func (s *MemTable) ApproximateSize() (size int64) {
+	for _, t := range s.tables {
+		size += t.approximateSize()
 	}
 
 	return
 }
 
-// Write is the io.Writer implementation that inserts the incoming bytes into the WAL
-func (s *MemTable) Write(p []byte) (n int, err error) {
-	e := Entry{
-		Key:    getKey(string(p)),
-		Length: int64(len(p)),
-		Data:   p,
+// familyLen returns the number of entries of the column family 'family'
+func (s *MemTable) familyLen(family uint32) int {
+	if t := s.tables[family]; t != nil {
+		return t.len()
 	}
 
-	s.Add(e)
-	s.Set(e.Key, &e)
+	return 0
+}
 
-	if SORT_ON_INSERTION {
-		sort.Sort(s)
+// familySize returns the bytes of memory taken by the entries of the column family 'family'
+func (s *MemTable) familySize(family uint32) int64 {
+	if t := s.tables[family]; t != nil {
+		return t.approximateSize()
 	}
 
+	return 0
+}
 
-	return int(e.Length), nil
+// addFamily makes room for the entries of the column family 'family', sorted by 'cmp'. Entries of families that
+// weren't added, like dropped ones, are ignored. It must be called by the writer at the front of the queue of the DB,
+// with db.mu held
+func (s *MemTable) addFamily(family uint32, cmp Comparator) {
+	s.tables[family] = newSkiplist(cmp)
 }
 
-// Len is part of the sort.Interface implementation
-func (s MemTable) Len() int {
-	return len(s.E)
+// dropFamily discards the entries of the column family 'family' and ignores its writes from now on. It must be called
+// like addFamily
+func (s *MemTable) dropFamily(family uint32) {
+	delete(s.tables, family)
 }
 
-// Less is part of the sort.Interface implementation
-func (s MemTable) Less(i, j int) bool {
-	return s.E[i].Key < s.E[j].Key
+// Put writes 'key' with 'value' and the sequence number 'seq' into the WAL and the MemTable. Both can contain any
+// byte
+func (s *MemTable) Put(seq uint64, key string, value []byte) (err error) {
+	if err = s.insert(&Entry{Key: key, Data: value, Seq: seq}); err != nil {
+		err = errors.Annotatef(err, "Error writing value for key '%s'", key)
+	}
+
+	return
 }
 
-// Swap is part of the sort.Interface implementation
-func (s MemTable) Swap(i, j int) {
-	a := s.E[i]
-	s.E[i] = s.E[j]
-	s.E[j] = a
+// Delete writes a tombstone for 'key' with the sequence number 'seq' into the WAL and the MemTable so that it masks
+// any previous value
+func (s *MemTable) Delete(seq uint64, key string) (err error) {
+	if err = s.insert(&Entry{Key: key, Tombstone: true, Seq: seq}); err != nil {
+		err = errors.Annotatef(err, "Error writing tombstone for key '%s'", key)
+	}
+
+	return
 }
 
-// Add a new record to the write ahead log
-func (s *MemTable) Add(e Entry) *Entry {
-	s.E = append(s.E, &e)
-	s.AccBytes += e.Length
+// insert frames 'e' as a WAL record and writes it into the WAL and the MemTable. An entry of a column family other
+// than the default one is framed as a batch of one operation, whose key carries the family
+func (s *MemTable) insert(e *Entry) (err error) {
+	rec := encodeRecord(e)
+	if e.Family != DEFAULT_COLUMN_FAMILY_ID {
+		b := &WriteBatch{count: 1}
+		b.ops.add(RECORD_COLUMN_FAMILY, familyKey(e.Family, recordType(e), e.Key), encodeValue(e))
+		rec = encodeBatchRecord(e.Seq, b)
+	}
 
-	return &e
+	if err = s.writeRecord(rec); err != nil {
+		err = errors.Annotate(err, "Error writing to pipe writer")
+	}
+
+	return
 }
 
-// Persist writes the current write ahead log to disk in a new sstable file
-func (s *MemTable) Persist() (err error) {
-	defer s.Close()
+// Apply writes the operations of 'b' into the WAL as a single record and then into the MemTable. They take
+// consecutive sequence numbers from 'seq'
+func (s *MemTable) Apply(seq uint64, b *WriteBatch) (err error) {
+	if err = s.writeRecord(encodeBatchRecord(seq, b)); err != nil {
+		err = errors.Annotatef(err, "Error writing batch of %d operations", b.Count())
+	}
 
-	if !SORT_ON_INSERTION {
-		sort.Sort(s)
+	return
+}
+
+func (s *MemTable) writeRecord(rec []byte) error {
+	n, err := s.writer.Write(rec)
+	atomic.AddInt64(&s.walSize, int64(n))
+
+	return err
+}
+
+// Sync flushes the WAL to stable storage, so the records written before the call survive a power failure. It can be
+// called while the MemTable receives writes, and does nothing when the MemTable is closed, has no WAL or nothing was
+// written since the last sync
+func (s *MemTable) Sync() (err error) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	size := atomic.LoadInt64(&s.walSize)
+	if s.closed || s.walFile == nil || size == s.syncedSize {
+		return
 	}
 
-	var accBytes int64
-	for i := 0; i < len(s.E); i++ {
-		s.persistEntry(i, &accBytes)
+	atomic.AddInt64(&s.syncs, 1)
+	if err = s.walFile.Sync(); err != nil {
+		return errors.Annotatef(err, "Could not sync WAL file '%s'", s.walFile.Name())
 	}
+	s.syncedSize = size
 
 	return
 }
 
-func (s *MemTable) persistEntry(i int, accBytes *int64) (err error) {
-	e := s.E[i]
+// Write is the io.Writer implementation that inserts an incoming WAL record into the MemTable. Every entry of a
+// batch record is decoded before inserting any of them
+func (s *MemTable) Write(p []byte) (n int, err error) {
+	es, err := decodeRecord(p)
+	if err != nil {
+		return 0, errors.Annotate(err, "Could not decode WAL record")
+	}
+
+	// The same write can be found twice if the process died while an old WAL was being replayed
+	for _, e := range es {
+		t := s.tables[e.Family]
+		if t == nil {
+			continue
+		}
+		t.insert(e)
+
+		if e.Seq > s.LastSeq {
+			s.LastSeq = e.Seq
+		}
+	}
+
+	return len(p), nil
+}
+
+// newIterator returns an iterator over the skiplist of the column family 'family', or nil if the MemTable has no
+// room for it. It can be used while the MemTable receives writes and after it's persisted
+func (s *MemTable) newIterator(family uint32) *skiplistIterator {
+	if t := s.tables[family]; t != nil {
+		return t.newIterator()
+	}
+
+	return nil
+}
+
+// Persist writes the entries of the default column family to disk in the sstable file of the MemTable, synced before
+// returning, and closes its files. Older versions of a key are only kept if one of 'snapshots', in ascending order,
+// can read them or a merge operand needs them, and merge operands are collapsed as much as the merge operator can. The
+// WAL is kept until the table is logged in the MANIFEST
+func (s *MemTable) Persist(snapshots ...uint64) (err error) {
+	defer s.Close()
 
-	if _, err = s.StorageFile.Write(e.Data); err != nil {
+	if err = s.writeTable(s.StorageFile, DEFAULT_COLUMN_FAMILY_ID, s.opts, snapshots); err == nil {
+		err = s.StorageFile.Sync()
+	}
+
+	if err != nil {
 		err = errors.Annotatef(err, "Error trying to persist data on sstable file. Deleting sstable file")
 
-		err2 := deleteFile(s.StorageFile)
-		if err2 != nil {
-			err = errors.Annotatef(err, err2.Error())
+		if err2 := deleteFile(s.fs, s.StorageFile); err2 != nil {
+			err = errors.Annotate(err, err2.Error())
 		}
 
 		return
-	} else {
-		err = deleteFile(s.walFile)
-		if err != nil {
-			err = errors.Annotatef(err, "Could not delete WAL file. Data has been stored properly on a SSTable file.")
-		}
 	}
 
-	temp := s.Get(e.Key)
-	temp.Offset = *accBytes
-	temp.Data = nil
+	return
+}
 
-	*accBytes += e.Length
+// writeTable writes the entries of the column family 'family' to 'w' as an SSTable of level 0 with the settings
+// of 'o', keeping the versions that 'snapshots' can read
+func (s *MemTable) writeTable(w io.Writer, family uint32, o *Options, snapshots []uint64) (err error) {
+	es := make([]*Entry, 0)
+	if it := s.newIterator(family); it != nil {
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			es = append(es, it.Entry())
+		}
+	}
 
-	return
+	table := newSSTableWriter(w, o.tableOptions(0))
+	for _, e := range visibleVersions(es, snapshots, &versionMerger{op: o.MergeOperator}) {
+		if err = table.Add(e); err != nil {
+			return
+		}
+	}
+
+	return table.Finish()
 }
 
-func deleteFile(f *os.File) (err error) {
-	if err = os.Remove(f.Name()); err != nil {
+func deleteFile(fs FS, f File) (err error) {
+	if err = fs.Remove(f.Name()); err != nil {
 		err = errors.Annotatef(err, "Could not remove file. Data is still available in either the Write " +
 			"Ahead Log or the SStable file. It just couldn't be deleted. Maybe a permissions problem?")
 	}
 
 	return
 }
-
-//getKey returns the possible key of a string entry
-func getKey(s string) string {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Errorf("Recovered from panic: %v\n", r)
-			log.Errorf("Data: %s", s)
-		}
-	}()
-	return s[0:strings.Index(s, " ")]
-}
@@ -0,0 +1,209 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"strconv"
+)
+
+// ErrNoMergeOperator is returned by Merge, and by reads that find merge operands, when the DB has no merge operator
+var ErrNoMergeOperator = errors.New("no merge operator")
+
+// MergeOperator combines the operands written with Merge with the value of their key, so a read-modify-write doesn't
+// need a read. Operands are stacked over the value until a read combines them or a flush or a compaction collapses
+// them. The same operator must be used every time the DB is opened
+type MergeOperator interface {
+	// FullMerge returns the value that results of applying 'operands', from the oldest to the newest, to
+	// 'existing', which is nil if the key has no value
+	FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error)
+
+	// PartialMerge combines the operand 'left' with the newer 'right' into a single operand. It returns false if
+	// they can't be combined without the value of the key
+	PartialMerge(key string, left, right []byte) ([]byte, bool)
+}
+
+// Int64AddOperator adds integers written as decimal strings. A key without a value starts at 0
+var Int64AddOperator MergeOperator = int64AddOperator{}
+
+type int64AddOperator struct{}
+
+func (int64AddOperator) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		n, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Value of key '%s' isn't an integer", key)
+		}
+		sum = n
+	}
+
+	for _, o := range operands {
+		n, err := strconv.ParseInt(string(o), 10, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "Operand of key '%s' isn't an integer", key)
+		}
+		sum += n
+	}
+
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+func (int64AddOperator) PartialMerge(key string, left, right []byte) ([]byte, bool) {
+	l, err := strconv.ParseInt(string(left), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	r, err := strconv.ParseInt(string(right), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	return []byte(strconv.FormatInt(l+r, 10)), true
+}
+
+// NewStringAppendOperator returns an operator that appends operands to the value of their key with 'separator'
+// between them
+func NewStringAppendOperator(separator string) MergeOperator {
+	return stringAppendOperator{separator: separator}
+}
+
+type stringAppendOperator struct {
+	separator string
+}
+
+func (o stringAppendOperator) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	value := make([]byte, 0)
+	if existing != nil {
+		value = append(value, existing...)
+	}
+
+	for i, operand := range operands {
+		if existing != nil || i > 0 {
+			value = append(value, o.separator...)
+		}
+		value = append(value, operand...)
+	}
+
+	return value, nil
+}
+
+func (o stringAppendOperator) PartialMerge(key string, left, right []byte) ([]byte, bool) {
+	value := make([]byte, 0, len(left)+len(o.separator)+len(right))
+	value = append(value, left...)
+	value = append(value, o.separator...)
+
+	return append(value, right...), true
+}
+
+// Merge adds the merge of 'operand' into 'key' to the batch
+func (b *WriteBatch) Merge(key string, operand []byte) {
+	b.add(nil, RECORD_MERGE, key, operand)
+}
+
+// MergeCF adds the merge of 'operand' into 'key' of the column family 'cf' to the batch
+func (b *WriteBatch) MergeCF(cf *ColumnFamily, key string, operand []byte) {
+	b.add(cf, RECORD_MERGE, key, operand)
+}
+
+// Merge combines 'operand' with the value of 'key' through the merge operator of the DB, without reading the value
+func (db *DB) Merge(key string, operand []byte) error {
+	var b WriteBatch
+	b.Merge(key, operand)
+
+	return db.Write(&b)
+}
+
+// mergeValue returns the value of a key whose newest versions are the merge operands 'operands', from the newest to
+// the oldest, stacked over 'base', which is nil if the key has no older version. Tombstones and expired values are
+// bases without a value
+func mergeValue(op MergeOperator, key string, base *Entry, operands []*Entry, now int64) ([]byte, error) {
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+
+	var existing []byte
+	if base != nil && !base.Tombstone && !isExpired(base, now) {
+		existing = base.Data
+	}
+
+	values := make([][]byte, len(operands))
+	for i, o := range operands {
+		values[len(operands)-1-i] = o.Data
+	}
+
+	value, err := op.FullMerge(key, existing, values)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Could not merge %d operands of key '%s'", len(operands), key)
+	}
+
+	return value, nil
+}
+
+// versionMerger collapses the merge operands that flushes and compactions write. Without an operator, operands are
+// written as they are
+type versionMerger struct {
+	op MergeOperator
+
+	// isOldest returns true if no older version of a key can exist besides the entries being written. It can be nil
+	isOldest func(key string) bool
+}
+
+// collapse returns the entries that replace 'versions', the versions of a key read by the same snapshots, from the
+// newest to the oldest, when the newest is a merge operand. The operands are merged with the value below them into a
+// single value if that value is in 'versions', or if 'isLast' says that no older version follows and the key can't be
+// elsewhere. Otherwise they're combined into as few operands as the operator can. Operands over a value with a TTL are
+// never merged with it, as its value changes when it expires. An operand that can't be merged is written as it is
+func (m *versionMerger) collapse(versions []*Entry, isLast bool) []*Entry {
+	n := 0
+	for n < len(versions) && versions[n].Merge {
+		n++
+	}
+	operands := versions[:n]
+
+	var base *Entry
+	if n < len(versions) {
+		base = versions[n]
+	}
+
+	res := make([]*Entry, 0, n+1)
+	if m != nil && m.op != nil {
+		key := operands[0].Key
+		if (base != nil && base.ExpiresAt == 0) || (base == nil && isLast && m.isOldest != nil && m.isOldest(key)) {
+			if value, err := mergeValue(m.op, key, base, operands, 0); err == nil {
+				return append(res, &Entry{Key: key, Seq: operands[0].Seq, Data: value})
+			}
+		}
+
+		operands = m.partialMerge(operands)
+	}
+
+	res = append(res, operands...)
+	if base != nil {
+		res = append(res, base)
+	}
+
+	return res
+}
+
+// partialMerge combines consecutive operands, from the newest to the oldest, with the partial merge of the operator
+func (m *versionMerger) partialMerge(operands []*Entry) []*Entry {
+	res := make([]*Entry, 0, len(operands))
+
+	acc := operands[len(operands)-1]
+	for i := len(operands) - 2; i >= 0; i-- {
+		if value, ok := m.op.PartialMerge(acc.Key, acc.Data, operands[i].Data); ok {
+			acc = &Entry{Key: acc.Key, Seq: operands[i].Seq, Data: value, Merge: true}
+			continue
+		}
+
+		res = append(res, acc)
+		acc = operands[i]
+	}
+	res = append(res, acc)
+
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+
+	return res
+}
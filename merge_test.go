@@ -0,0 +1,287 @@
+package doom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeOperators(t *testing.T) {
+	t.Run("int64 add", func(t *testing.T) {
+		value, err := Int64AddOperator.FullMerge("key", []byte("10"), [][]byte{[]byte("5"), []byte("-3")})
+		if err != nil || string(value) != "12" {
+			t.Errorf("Expected '12', got '%s' (%v)", value, err)
+		}
+
+		value, err = Int64AddOperator.FullMerge("key", nil, [][]byte{[]byte("5")})
+		if err != nil || string(value) != "5" {
+			t.Errorf("Expected '5' without a value, got '%s' (%v)", value, err)
+		}
+
+		if _, err = Int64AddOperator.FullMerge("key", []byte("ten"), [][]byte{[]byte("5")}); err == nil {
+			t.Error("Expected an error merging a value that isn't an integer")
+		}
+
+		if value, ok := Int64AddOperator.PartialMerge("key", []byte("2"), []byte("3")); !ok || string(value) != "5" {
+			t.Errorf("Expected '5', got '%s' (%t)", value, ok)
+		}
+		if _, ok := Int64AddOperator.PartialMerge("key", []byte("2"), []byte("three")); ok {
+			t.Error("Expected operands that aren't integers not to be merged")
+		}
+	})
+
+	t.Run("string append", func(t *testing.T) {
+		op := NewStringAppendOperator(",")
+
+		value, err := op.FullMerge("key", []byte("a"), [][]byte{[]byte("b"), []byte("c")})
+		if err != nil || string(value) != "a,b,c" {
+			t.Errorf("Expected 'a,b,c', got '%s' (%v)", value, err)
+		}
+
+		value, err = op.FullMerge("key", nil, [][]byte{[]byte("b"), []byte("c")})
+		if err != nil || string(value) != "b,c" {
+			t.Errorf("Expected 'b,c' without a value, got '%s' (%v)", value, err)
+		}
+
+		if value, ok := op.PartialMerge("key", []byte("b"), []byte("c")); !ok || string(value) != "b,c" {
+			t.Errorf("Expected 'b,c', got '%s' (%t)", value, ok)
+		}
+	})
+}
+
+func TestMerge(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{FS: fs, MergeOperator: Int64AddOperator}
+
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("base", []byte("100"))
+	db.Put("deleted", []byte("100"))
+	db.Delete("deleted")
+	db.PutWithTTL("expired", []byte("100"), 0)
+	db.Put("plain", []byte("value"))
+	for i := 0; i < 10; i++ {
+		for _, key := range []string{"base", "counter", "deleted", "expired"} {
+			if err = db.Merge(key, []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	db.Merge("counter", []byte("5"))
+
+	expected := map[string]string{"base": "110", "counter": "15", "deleted": "10", "expired": "10", "plain": "value"}
+	check := func(t *testing.T, db *DB) {
+		for key, v := range expected {
+			if value, err := db.Get(key); err != nil || string(value) != v {
+				t.Errorf("Expected '%s' for '%s', got '%s' (%v)", v, key, value, err)
+			}
+		}
+
+		it := db.NewIterator(nil)
+		defer it.Close()
+
+		found := make([]string, 0)
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			found = append(found, it.Key()+"="+string(it.Value()))
+		}
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			found = append(found, it.Key()+"="+string(it.Value()))
+		}
+
+		// Moving back and forth on a key merged forward
+		it.Seek("counter")
+		it.Prev()
+		it.Next()
+		found = append(found, it.Key()+"="+string(it.Value()))
+
+		keys := []string{"base", "counter", "deleted", "expired", "plain", "plain", "expired", "deleted", "counter",
+			"base", "counter"}
+		for i, key := range keys {
+			keys[i] = key + "=" + expected[key]
+		}
+		if got := strings.Join(found, " "); got != strings.Join(keys, " ") {
+			t.Errorf("Unexpected keys of the iterator: %s", got)
+		}
+		if err := it.Error(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("operands merged on reads", func(t *testing.T) {
+		check(t, db)
+
+		if value, err := snap.Get("counter"); err != nil || string(value) != "10" {
+			t.Errorf("Expected '10' from the snapshot, got '%s' (%v)", value, err)
+		}
+	})
+
+	t.Run("operands collapsed by flushes", func(t *testing.T) {
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+
+		if value, err := snap.Get("counter"); err != nil || string(value) != "10" {
+			t.Errorf("Expected '10' from the snapshot, got '%s' (%v)", value, err)
+		}
+
+		db.mu.RLock()
+		table, err := db.tables.get(db.defaultCF.levels[0][0].number, BytewiseComparator)
+		db.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		es, err := table.Entries()
+		table.release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Operands over a value are merged with it, but the ones of 'counter' have no value and the snapshot reads
+		// the older ones, so they're combined in two operands
+		keys := make([]string, 0)
+		for _, e := range es {
+			keys = append(keys, fmt.Sprintf("%s:%t:%s", e.Key, e.Merge, e.Data))
+		}
+		if got := strings.Join(keys, " "); got != "base:false:110 counter:true:5 counter:true:10 deleted:false:10 "+
+			"expired:true:10 expired:false:100 plain:false:value" {
+			t.Errorf("Unexpected entries of the flushed table: %s", got)
+		}
+	})
+
+	t.Run("operands replayed from the WAL", func(t *testing.T) {
+		db.Merge("counter", []byte("7"))
+		expected["counter"] = "22"
+
+		snap.Release()
+		db.Close()
+		if db, err = Open("/db", opts); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		check(t, db)
+	})
+
+	t.Run("no merge operator", func(t *testing.T) {
+		db, err := Open("/other", &Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err = db.Merge("counter", []byte("1")); err != ErrNoMergeOperator {
+			t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+		}
+	})
+}
+
+func TestMergeCompaction(t *testing.T) {
+	db, err := Open("/db", &Options{FS: NewMemFS(), MergeOperator: NewStringAppendOperator(",")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for round := 0; round < DEFAULT_L0_COMPACTION_TRIGGER; round++ {
+		for i := 0; i < 20; i++ {
+			db.Merge(fmt.Sprintf("list%02d", i), []byte(fmt.Sprintf("%d", round)))
+		}
+
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForCompactions(t, db)
+
+	for i := 0; i < 20; i++ {
+		if value, err := db.Get(fmt.Sprintf("list%02d", i)); err != nil || string(value) != "0,1,2,3" {
+			t.Errorf("Expected '0,1,2,3' for list%02d, got '%s' (%v)", i, value, err)
+		}
+	}
+
+	// Nothing is older than the compacted tables, so the operands become values
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for level, tables := range db.defaultCF.levels {
+		for _, m := range tables {
+			table, err := db.tables.get(m.number, BytewiseComparator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			es, err := table.Entries()
+			table.release()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range es {
+				if e.Merge && level > 0 {
+					t.Errorf("Expected the operands of '%s' to be merged in level %d", e.Key, level)
+				}
+			}
+		}
+	}
+}
+
+func TestCollapseMergeOperands(t *testing.T) {
+	m := &versionMerger{op: Int64AddOperator}
+	es := []*Entry{
+		{Key: "a", Seq: 9, Data: []byte("1"), Merge: true}, {Key: "a", Seq: 8, Data: []byte("2"), Merge: true},
+		{Key: "a", Seq: 6, Data: []byte("3"), Merge: true}, {Key: "a", Seq: 4, Data: []byte("10")},
+		{Key: "a", Seq: 2, Data: []byte("20")},
+		{Key: "b", Seq: 5, Data: []byte("x"), Merge: true}, {Key: "b", Seq: 3, Data: []byte("4"), Merge: true},
+		{Key: "c", Seq: 7, Data: []byte("1"), Merge: true}, {Key: "c", Seq: 1, Data: []byte("2"), ExpiresAt: 1},
+	}
+
+	// The snapshot at 7 reads 'a' at 6, so 6 and 4 are merged on their own. The operands of 'b' can't be
+	// combined and the value of 'c' has a TTL
+	visible := visibleVersions(es, []uint64{7}, m)
+
+	expected := []string{"a:9:true:3", "a:6:false:13", "b:5:true:x", "b:3:true:4", "c:7:true:1", "c:1:false:2"}
+	got := make([]string, 0)
+	for _, e := range visible {
+		got = append(got, fmt.Sprintf("%s:%d:%t:%s", e.Key, e.Seq, e.Merge, e.Data))
+	}
+
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	t.Run("oldest versions", func(t *testing.T) {
+		m.isOldest = func(key string) bool { return true }
+		visible := visibleVersions(es[7:8], nil, m)
+		if len(visible) != 1 || visible[0].Merge || string(visible[0].Data) != "1" {
+			t.Errorf("Expected the operand to become a value, got %v", visible)
+		}
+	})
+}
+
+func TestMergeExpiredBase(t *testing.T) {
+	db, err := Open("/db", &Options{FS: NewMemFS(), MergeOperator: Int64AddOperator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.PutWithTTL("key", []byte("100"), 50*time.Millisecond)
+	db.Merge("key", []byte("1"))
+
+	if value, err := db.Get("key"); err != nil || string(value) != "101" {
+		t.Errorf("Expected '101' before the value expires, got '%s' (%v)", value, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if value, err := db.Get("key"); err != nil || string(value) != "1" {
+		t.Errorf("Expected '1' after the value expires, got '%s' (%v)", value, err)
+	}
+}
@@ -0,0 +1,215 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"math"
+	"time"
+)
+
+// ErrInvalidOptions is returned when a DB is opened with options that can't be used
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Options are the settings of a DB, fixed when it's opened. A field left with its zero value takes its default
+type Options struct {
+	// FS keeps the files of the DB. OSFS by default
+	FS FS
+
+	// WALDir is the folder of the WAL files. The folder of the DB by default
+	WALDir string
+
+	// ReadOnly opens the DB without taking its lock, so it can be read while another process has it open. The DB is
+	// read as it was when it was opened: nothing is written, flushed, compacted or removed and the WAL files are only
+	// replayed in memory
+	ReadOnly bool
+
+	// Comparator orders the keys. BytewiseComparator by default. A DB must always be opened with the comparator that
+	// it was created with
+	Comparator Comparator
+
+	// MergeOperator combines the operands written with Merge with the value of their key. Merge fails without one
+	MergeOperator MergeOperator
+
+	// ColumnFamilies are the options of the column families found when the DB is opened, and of the ones created
+	// without options, by name. Families without an entry take these options. FS, the WAL, the write groups, the block
+	// cache and the table cache are shared by the whole DB, so they're always taken from these
+	ColumnFamilies map[string]*Options
+
+	// WriteBufferSize is the size that the MemTable reaches before it's flushed, 4 MiB by default.
+	// MaxWriteGroupSize is the most bytes of batches committed together, 1 MiB by default
+	WriteBufferSize   int64
+	MaxWriteGroupSize int
+
+	// WALSyncPolicy is WAL_SYNC_ALWAYS, WAL_SYNC_PERIODIC or WAL_SYNC_NEVER, the default. WALSyncInterval is the
+	// interval of WAL_SYNC_PERIODIC, 100 ms by default
+	WALSyncPolicy   string
+	WALSyncInterval time.Duration
+
+	// TableFileSize is the size of the tables written by compactions, 2 MiB by default
+	TableFileSize int64
+
+	// BlockSize is the size that a data block reaches before it's written, 4 KiB by default
+	BlockSize int
+
+	// BloomBitsPerKey sizes the Bloom filter of every table, 10 by default. A negative value writes tables without
+	// filters
+	BloomBitsPerKey int
+
+	// BlockCompression is the compression of the blocks of each level, from level 0. Levels past its end take its
+	// last one. BLOCK_NO_COMPRESSION for levels 0 and 1 and BLOCK_FLATE_COMPRESSION for the rest by default
+	BlockCompression []byte
+
+	// BlockCacheSize is the capacity of the block cache, 8 MiB by default. A negative size disables it
+	BlockCacheSize int64
+
+	// MaxOpenFiles is the number of tables kept open by the DB, in every column family, 500 by default
+	MaxOpenFiles int
+
+	// CompactionStrategy is LEVELED_COMPACTION, the default, or SIZE_TIERED_COMPACTION
+	CompactionStrategy string
+
+	// L0CompactionTrigger is the number of tables of level 0 that triggers a leveled compaction, 4 by default.
+	// L1MaxSize is the size of level 1 that triggers one, 10 MiB by default, and each following level is
+	// LevelSizeMultiplier times bigger than the previous one, 10 by default
+	L0CompactionTrigger int
+	L1MaxSize           int64
+	LevelSizeMultiplier int
+
+	// A size-tiered compaction merges from TieredMinThreshold tables, 4 by default, to TieredMaxThreshold, 32 by
+	// default, whose sizes are between TieredBucketLow and TieredBucketHigh times their average, 0.5 and 1.5 by
+	// default
+	TieredMinThreshold int
+	TieredMaxThreshold int
+	TieredBucketLow    float64
+	TieredBucketHigh   float64
+}
+
+var defaultBlockCompression = []byte{BLOCK_NO_COMPRESSION, BLOCK_NO_COMPRESSION, BLOCK_FLATE_COMPRESSION}
+
+// validate returns a copy of 'o', which can be nil, with the defaults of the fields that aren't set, or an error
+// annotating ErrInvalidOptions if any of them can't be used
+func (o *Options) validate() (v *Options, err error) {
+	v = &Options{}
+	if o != nil {
+		*v = *o
+	}
+
+	if v.FS == nil {
+		v.FS = OSFS
+	}
+	if v.Comparator == nil {
+		v.Comparator = BytewiseComparator
+	}
+
+	setInt64(&v.WriteBufferSize, DEFAULT_WRITE_BUFFER_SIZE)
+	setInt(&v.MaxWriteGroupSize, DEFAULT_MAX_WRITE_GROUP_SIZE)
+	setInt64(&v.TableFileSize, DEFAULT_TABLE_FILE_SIZE)
+	setInt(&v.BlockSize, DEFAULT_BLOCK_SIZE)
+	setInt(&v.BloomBitsPerKey, DEFAULT_BLOOM_BITS_PER_KEY)
+	setInt64(&v.BlockCacheSize, DEFAULT_BLOCK_CACHE_SIZE)
+	setInt(&v.MaxOpenFiles, DEFAULT_MAX_OPEN_FILES)
+	setInt(&v.L0CompactionTrigger, DEFAULT_L0_COMPACTION_TRIGGER)
+	setInt64(&v.L1MaxSize, DEFAULT_L1_MAX_SIZE)
+	setInt(&v.LevelSizeMultiplier, DEFAULT_LEVEL_SIZE_MULTIPLIER)
+	setInt(&v.TieredMinThreshold, DEFAULT_TIERED_MIN_THRESHOLD)
+	setInt(&v.TieredMaxThreshold, DEFAULT_TIERED_MAX_THRESHOLD)
+
+	if v.WALSyncPolicy == "" {
+		v.WALSyncPolicy = WAL_SYNC_NEVER
+	}
+	if v.WALSyncInterval == 0 {
+		v.WALSyncInterval = DEFAULT_WAL_SYNC_INTERVAL
+	}
+	if v.CompactionStrategy == "" {
+		v.CompactionStrategy = LEVELED_COMPACTION
+	}
+	if v.TieredBucketLow == 0 {
+		v.TieredBucketLow = DEFAULT_TIERED_BUCKET_LOW
+	}
+	if v.TieredBucketHigh == 0 {
+		v.TieredBucketHigh = DEFAULT_TIERED_BUCKET_HIGH
+	}
+
+	// Every level gets its own compression so tables of any level can look it up
+	compression := v.BlockCompression
+	if len(compression) == 0 {
+		compression = defaultBlockCompression
+	}
+	v.BlockCompression = make([]byte, MAX_LEVELS)
+	for level := range v.BlockCompression {
+		v.BlockCompression[level] = compression[len(compression)-1]
+		if level < len(compression) {
+			v.BlockCompression[level] = compression[level]
+		}
+	}
+
+	switch {
+	case v.WriteBufferSize < 0, v.MaxWriteGroupSize < 0, v.TableFileSize < 0, v.BlockSize < 0, v.MaxOpenFiles < 0,
+		v.L0CompactionTrigger < 0, v.L1MaxSize < 0, v.WALSyncInterval < 0:
+		err = errors.New("Sizes, counts and intervals can't be negative")
+	case len(compression) > MAX_LEVELS:
+		err = errors.Errorf("Compression set for %d levels, there are %d", len(compression), MAX_LEVELS)
+	case v.LevelSizeMultiplier < 2:
+		err = errors.Errorf("Level size multiplier %d must be at least 2", v.LevelSizeMultiplier)
+	case v.TieredMinThreshold < 2 || v.TieredMaxThreshold < v.TieredMinThreshold:
+		err = errors.Errorf("Tiered thresholds %d and %d must be at least 2 and in order", v.TieredMinThreshold,
+			v.TieredMaxThreshold)
+	case v.TieredBucketLow <= 0 || v.TieredBucketLow > 1 || v.TieredBucketHigh < 1:
+		err = errors.Errorf("Tiered bucket bounds %g and %g must include 1", v.TieredBucketLow, v.TieredBucketHigh)
+	}
+
+	for _, c := range v.BlockCompression {
+		if err == nil && c != BLOCK_NO_COMPRESSION && c != BLOCK_FLATE_COMPRESSION && c != BLOCK_GZIP_COMPRESSION {
+			err = errors.Errorf("Unknown block compression %d", c)
+		}
+	}
+
+	if err == nil {
+		err = checkWALSyncPolicy(v.WALSyncPolicy)
+	}
+
+	if err == nil {
+		_, err = newCompactionStrategy(v.CompactionStrategy)
+	}
+
+	if err != nil {
+		return nil, errors.Annotate(ErrInvalidOptions, err.Error())
+	}
+
+	return
+}
+
+func setInt(field *int, def int) {
+	if *field == 0 {
+		*field = def
+	}
+}
+
+func setInt64(field *int64, def int64) {
+	if *field == 0 {
+		*field = def
+	}
+}
+
+// tableOptions are the settings of the SSTables of a level
+type tableOptions struct {
+	comparator  Comparator
+	blockSize   int
+	bitsPerKey  int
+	compression byte
+}
+
+func (o *Options) tableOptions(level int) tableOptions {
+	return tableOptions{
+		comparator:  o.Comparator,
+		blockSize:   o.BlockSize,
+		bitsPerKey:  o.BloomBitsPerKey,
+		compression: o.BlockCompression[level],
+	}
+}
+
+// maxBytesForLevel returns the size that triggers a leveled compaction of 'level', which is L1MaxSize for level 1 and
+// LevelSizeMultiplier times bigger than the level above it for the rest. Level 0 is compacted by number of files
+// instead
+func (o *Options) maxBytesForLevel(level int) int64 {
+	return int64(float64(o.L1MaxSize) * math.Pow(float64(o.LevelSizeMultiplier), float64(level-1)))
+}
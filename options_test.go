@@ -0,0 +1,104 @@
+package doom
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		o, err := (*Options)(nil).validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o.FS != OSFS || o.WriteBufferSize != DEFAULT_WRITE_BUFFER_SIZE || o.WALSyncPolicy != WAL_SYNC_NEVER ||
+			o.CompactionStrategy != LEVELED_COMPACTION || o.MaxOpenFiles != DEFAULT_MAX_OPEN_FILES {
+			t.Errorf("Unexpected defaults %+v", o)
+		}
+
+		if o.maxBytesForLevel(1) != DEFAULT_L1_MAX_SIZE || o.maxBytesForLevel(2) != 10*DEFAULT_L1_MAX_SIZE {
+			t.Errorf("Unexpected level sizes %d and %d", o.maxBytesForLevel(1), o.maxBytesForLevel(2))
+		}
+
+		if o.BlockCompression[1] != BLOCK_NO_COMPRESSION ||
+			o.BlockCompression[MAX_LEVELS-1] != BLOCK_FLATE_COMPRESSION {
+			t.Errorf("Unexpected compression per level %v", o.BlockCompression)
+		}
+	})
+
+	t.Run("compression of the last level repeated", func(t *testing.T) {
+		given := []byte{BLOCK_NO_COMPRESSION, BLOCK_GZIP_COMPRESSION}
+		o, err := (&Options{BlockCompression: given}).validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(o.BlockCompression) != MAX_LEVELS || o.BlockCompression[MAX_LEVELS-1] != BLOCK_GZIP_COMPRESSION {
+			t.Errorf("Unexpected compression per level %v", o.BlockCompression)
+		}
+
+		if o.BlockCompression[0] = BLOCK_FLATE_COMPRESSION; given[0] != BLOCK_NO_COMPRESSION {
+			t.Error("Expected the options to be copied")
+		}
+	})
+
+	invalid := []*Options{
+		{WriteBufferSize: -1},
+		{MaxOpenFiles: -1},
+		{WALSyncPolicy: "sometimes"},
+		{CompactionStrategy: "random"},
+		{BlockCompression: []byte{9}},
+		{BlockCompression: make([]byte, MAX_LEVELS+1)},
+		{L1MaxSize: -1},
+		{LevelSizeMultiplier: 1},
+		{TieredMinThreshold: 8, TieredMaxThreshold: 4},
+		{TieredBucketLow: 2},
+	}
+
+	for _, o := range invalid {
+		if _, err := o.validate(); errors.Cause(err) != ErrInvalidOptions {
+			t.Errorf("Expected ErrInvalidOptions for %+v, got %v", o, err)
+		}
+	}
+}
+
+func TestIndependentDBs(t *testing.T) {
+	// Both DBs live in the same folder of different file systems, each with its own settings
+	opts := []*Options{
+		{FS: NewMemFS(), WriteBufferSize: 1024, BlockCompression: []byte{BLOCK_GZIP_COMPRESSION}},
+		{FS: NewMemFS(), CompactionStrategy: SIZE_TIERED_COMPACTION, BlockCacheSize: -1},
+	}
+
+	for i, o := range opts {
+		i, o := i, o
+		t.Run(fmt.Sprintf("db %d", i), func(t *testing.T) {
+			t.Parallel()
+
+			db, err := Open("/db", o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for j := 0; j < 200; j++ {
+				db.Put(fmt.Sprintf("key%03d", j), []byte(fmt.Sprintf("value %d of db %d", j, i)))
+			}
+			if err = db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			for j := 0; j < 200; j++ {
+				value, err := db.Get(fmt.Sprintf("key%03d", j))
+				if err != nil || string(value) != fmt.Sprintf("value %d of db %d", j, i) {
+					t.Fatalf("Unexpected value '%s' of key%03d (%v)", value, j, err)
+				}
+			}
+
+			if strategy := db.CompactionStats().Strategy; strategy != db.opts.CompactionStrategy {
+				t.Errorf("Expected strategy '%s', got '%s'", db.opts.CompactionStrategy, strategy)
+			}
+		})
+	}
+}
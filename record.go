@@ -0,0 +1,280 @@
+package doom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/juju/errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+var (
+	// ErrTornRecord is returned when the last record of a file was only partially written, usually because the
+	// process died in the middle of a write. Every record before it is valid
+	ErrTornRecord = errors.New("torn record at the end of file")
+
+	// ErrCorruptedRecord is returned when a complete record doesn't match its checksum and it isn't the last one
+	// of the file, so the damage can't be explained by an interrupted write
+	ErrCorruptedRecord = errors.New("corrupted record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errShortExpiringValue = errors.New("expiring value shorter than its expiry")
+	errInvalidFamilyKey   = errors.New("invalid column family key")
+)
+
+// encodeRecord frames an entry as a record with the following layout, all integers little endian:
+//
+//	type (1 byte) | key length (4 bytes) | value length (4 bytes) | CRC32C (4 bytes) | internal key | value
+//
+// The internal key carries the sequence number of the entry. The checksum covers the type, both lengths and the
+// payload
+func encodeRecord(e *Entry) []byte {
+	key := entryInternalKey(e)
+
+	value := encodeValue(e)
+
+	b := make([]byte, RECORD_HEADER_SIZE+len(key)+len(value))
+	b[0] = recordType(e)
+	binary.LittleEndian.PutUint32(b[1:5], uint32(len(key)))
+	binary.LittleEndian.PutUint32(b[5:9], uint32(len(value)))
+	copy(b[RECORD_HEADER_SIZE:], key)
+	copy(b[RECORD_HEADER_SIZE+len(key):], value)
+	binary.LittleEndian.PutUint32(b[9:13], recordChecksum(b))
+
+	return b
+}
+
+// encodeBatchRecord frames the operations of a batch as a single record of type RECORD_BATCH, so they are found
+// all together in the WAL or not at all. The key of the record holds the sequence number of the first operation
+// (8 bytes) and the number of operations (4 bytes). Its value holds the operations, encoded as the entries of an
+// SSTable block with user keys. They take consecutive sequence numbers
+func encodeBatchRecord(seq uint64, wb *WriteBatch) []byte {
+	b := make([]byte, RECORD_HEADER_SIZE+RECORD_BATCH_HEADER_SIZE+len(wb.ops.buf))
+	b[0] = RECORD_BATCH
+	binary.LittleEndian.PutUint32(b[1:5], RECORD_BATCH_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(b[5:9], uint32(len(wb.ops.buf)))
+	binary.LittleEndian.PutUint64(b[RECORD_HEADER_SIZE:], seq)
+	binary.LittleEndian.PutUint32(b[RECORD_HEADER_SIZE+8:], uint32(wb.count))
+	copy(b[RECORD_HEADER_SIZE+RECORD_BATCH_HEADER_SIZE:], wb.ops.buf)
+	binary.LittleEndian.PutUint32(b[9:13], recordChecksum(b))
+
+	return b
+}
+
+// decodeRecord parses a single and complete record in 'b'. It returns one entry, or every operation of a batch
+func decodeRecord(b []byte) (es []*Entry, err error) {
+	if len(b) < RECORD_HEADER_SIZE {
+		return nil, errors.Annotatef(ErrCorruptedRecord, "Record of %d bytes is shorter than its header", len(b))
+	}
+
+	if !isValidFrameType(b[0]) || int64(len(b)) != RECORD_HEADER_SIZE+recordPayloadSize(b) {
+		return nil, errors.Annotate(ErrCorruptedRecord, "Invalid record header")
+	}
+
+	if binary.LittleEndian.Uint32(b[9:13]) != recordChecksum(b) {
+		return nil, errors.Annotate(ErrCorruptedRecord, "Checksum mismatch")
+	}
+
+	keyLength := binary.LittleEndian.Uint32(b[1:5])
+	if b[0] == RECORD_BATCH {
+		return decodeBatch(b[RECORD_HEADER_SIZE:RECORD_HEADER_SIZE+keyLength], b[RECORD_HEADER_SIZE+keyLength:])
+	}
+
+	key, seq, t, err := parseInternalKey(string(b[RECORD_HEADER_SIZE : RECORD_HEADER_SIZE+keyLength]))
+	if err != nil || t != b[0] {
+		return nil, errors.Annotate(ErrCorruptedRecord, "Invalid internal key")
+	}
+
+	e := &Entry{Key: key, Seq: seq, Length: int64(len(b))}
+	if err = decodeValue(e, t, b[RECORD_HEADER_SIZE+keyLength:]); err != nil {
+		return nil, errors.Annotate(ErrCorruptedRecord, "Invalid value")
+	}
+
+	return []*Entry{e}, nil
+}
+
+func decodeBatch(header, ops []byte) (es []*Entry, err error) {
+	if len(header) != RECORD_BATCH_HEADER_SIZE {
+		return nil, errors.Annotate(ErrCorruptedRecord, "Invalid batch header")
+	}
+
+	if es, err = decodeBlock(ops); err != nil {
+		return nil, errors.Annotate(ErrCorruptedRecord, "Invalid batch operations")
+	}
+
+	if len(es) != int(binary.LittleEndian.Uint32(header[8:])) {
+		return nil, errors.Annotatef(ErrCorruptedRecord, "Batch has %d operations instead of %d", len(es),
+			binary.LittleEndian.Uint32(header[8:]))
+	}
+
+	seq := binary.LittleEndian.Uint64(header)
+	for i, e := range es {
+		e.Seq = seq + uint64(i)
+	}
+
+	return
+}
+
+// encodeValue returns the value that stores 'e' in WAL records and SSTable blocks
+func encodeValue(e *Entry) []byte {
+	if recordType(e) != RECORD_EXPIRING_VALUE {
+		return e.Data
+	}
+
+	b := make([]byte, EXPIRY_SIZE+len(e.Data))
+	binary.LittleEndian.PutUint64(b, uint64(e.ExpiresAt))
+	copy(b[EXPIRY_SIZE:], e.Data)
+
+	return b
+}
+
+// decodeValue fills 'e' from the value 'b' of a record of type 't'
+func decodeValue(e *Entry, t byte, b []byte) error {
+	switch t {
+	case RECORD_TOMBSTONE:
+		e.Tombstone = true
+	case RECORD_MERGE:
+		e.Merge, e.Data = true, b
+	case RECORD_EXPIRING_VALUE:
+		if len(b) < EXPIRY_SIZE {
+			return errShortExpiringValue
+		}
+		e.ExpiresAt = int64(binary.LittleEndian.Uint64(b))
+		e.Data = b[EXPIRY_SIZE:]
+	default:
+		e.Data = b
+	}
+
+	return nil
+}
+
+// familyKey returns the key of a batch operation of type 't' on 'key' of the column family 'id'
+func familyKey(id uint32, t byte, key string) string {
+	b := make([]byte, binary.MaxVarintLen32+1+len(key))
+	n := binary.PutUvarint(b, uint64(id))
+	b[n] = t
+	n += copy(b[n+1:], key) + 1
+
+	return string(b[:n])
+}
+
+// parseFamilyKey splits the key of 'e', from a RECORD_COLUMN_FAMILY operation, into its column family and its user
+// key, and returns the record type of the operation
+func parseFamilyKey(e *Entry) (t byte, err error) {
+	id, n := binary.Uvarint([]byte(e.Key))
+	if n <= 0 || id > math.MaxUint32 || n >= len(e.Key) || !isValidRecordType(e.Key[n]) {
+		return 0, errInvalidFamilyKey
+	}
+
+	t = e.Key[n]
+	e.Family, e.Key = uint32(id), e.Key[n+1:]
+
+	return t, nil
+}
+
+func recordChecksum(b []byte) uint32 {
+	c := crc32.Checksum(b[:9], crcTable)
+	return crc32.Update(c, crcTable, b[RECORD_HEADER_SIZE:])
+}
+
+func recordPayloadSize(header []byte) int64 {
+	return int64(binary.LittleEndian.Uint32(header[1:5])) + int64(binary.LittleEndian.Uint32(header[5:9]))
+}
+
+func isValidRecordType(t byte) bool {
+	return t == RECORD_VALUE || t == RECORD_TOMBSTONE || t == RECORD_EXPIRING_VALUE || t == RECORD_MERGE
+}
+
+// isValidFrameType returns true for the types of record that can be found in a WAL file
+func isValidFrameType(t byte) bool {
+	return isValidRecordType(t) || t == RECORD_BATCH
+}
+
+// newRecordReader returns a reader of the records stored in 'r' from its current position
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: bufio.NewReader(r)}
+}
+
+type recordReader struct {
+	r *bufio.Reader
+
+	// pending are the entries of the last batch record that haven't been returned yet
+	pending []*Entry
+
+	// Offset is the position of the next record to read, relative to the position of the reader when it was created
+	Offset int64
+}
+
+// Next returns the next entry. A batch record is checked as a whole before returning its entries one by one. It
+// returns io.EOF when the file ends cleanly after a record, ErrTornRecord when the last record is incomplete and
+// ErrCorruptedRecord when a record is damaged but more data follows it. Use errors.Cause to compare them
+func (r *recordReader) Next() (e *Entry, err error) {
+	if len(r.pending) > 0 {
+		e, r.pending = r.pending[0], r.pending[1:]
+		return
+	}
+
+	header := make([]byte, RECORD_HEADER_SIZE)
+	if _, err = io.ReadFull(r.r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, errors.Annotatef(ErrTornRecord, "Incomplete header at offset %d", r.Offset)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "Error reading record header at offset %d", r.Offset)
+	}
+
+	if !isValidFrameType(header[0]) || recordPayloadSize(header) > MAX_RECORD_PAYLOAD_SIZE {
+		return nil, errors.Annotatef(r.classifyGarbage(), "Invalid record header at offset %d", r.Offset)
+	}
+
+	b := make([]byte, RECORD_HEADER_SIZE+recordPayloadSize(header))
+	copy(b, header)
+	if _, err = io.ReadFull(r.r, b[RECORD_HEADER_SIZE:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errors.Annotatef(ErrTornRecord, "Incomplete payload at offset %d", r.Offset)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "Error reading record payload at offset %d", r.Offset)
+	}
+
+	es, err := decodeRecord(b)
+	if err != nil {
+		// A checksum mismatch on the very last record is an interrupted write, anywhere else it's corruption
+		if _, peekErr := r.r.Peek(1); peekErr == io.EOF {
+			return nil, errors.Annotatef(ErrTornRecord, "Checksum mismatch on last record at offset %d", r.Offset)
+		}
+
+		return nil, errors.Annotatef(err, "At offset %d", r.Offset)
+	}
+
+	r.Offset += int64(len(b))
+
+	// An empty batch has nothing to return
+	if len(es) == 0 {
+		return r.Next()
+	}
+
+	e, r.pending = es[0], es[1:]
+
+	return
+}
+
+// classifyGarbage consumes the rest of the input after a header that can't be decoded. If only zeroes follow, the
+// file was preallocated or partially flushed when the process died so it's a torn write
+func (r *recordReader) classifyGarbage() error {
+	rest, err := ioutil.ReadAll(r.r)
+	if err != nil {
+		return errors.Annotate(ErrCorruptedRecord, err.Error())
+	}
+
+	for _, c := range rest {
+		if c != 0 {
+			return ErrCorruptedRecord
+		}
+	}
+
+	return ErrTornRecord
+}
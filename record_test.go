@@ -0,0 +1,72 @@
+package doom
+
+import (
+	"bytes"
+	"github.com/juju/errors"
+	"io"
+	"testing"
+)
+
+func TestRecordReader(t *testing.T) {
+	first := encodeRecord(&Entry{Key: "binary", Data: []byte{0, '\n', 255, ' '}})
+	second := encodeRecord(&Entry{Key: "deleted", Tombstone: true})
+
+	t.Run("clean EOF", func(t *testing.T) {
+		r := newRecordReader(bytes.NewReader(append(append([]byte{}, first...), second...)))
+
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != "binary" || !bytes.Equal(e.Data, []byte{0, '\n', 255, ' '}) || e.Tombstone {
+			t.Errorf("Unexpected first record '%s'", e.String())
+		}
+
+		if e, err = r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != "deleted" || !e.Tombstone {
+			t.Errorf("Unexpected second record '%s'", e.String())
+		}
+
+		if _, err = r.Next(); err != io.EOF {
+			t.Errorf("Expected io.EOF, got '%v'", err)
+		}
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		cases := map[string][]byte{
+			"incomplete header":  first[:RECORD_HEADER_SIZE-3],
+			"incomplete payload": first[:len(first)-1],
+			"zeroed tail":        make([]byte, 64),
+			"bad checksum":       flipLastByte(first),
+		}
+
+		for name, tail := range cases {
+			r := newRecordReader(bytes.NewReader(append(append([]byte{}, second...), tail...)))
+			if _, err := r.Next(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			if _, err := r.Next(); errors.Cause(err) != ErrTornRecord {
+				t.Errorf("%s: expected ErrTornRecord, got '%v'", name, err)
+			}
+		}
+	})
+
+	t.Run("mid-file corruption", func(t *testing.T) {
+		data := append(append(flipLastByte(first), second...), second...)
+
+		r := newRecordReader(bytes.NewReader(data))
+		if _, err := r.Next(); errors.Cause(err) != ErrCorruptedRecord {
+			t.Errorf("Expected ErrCorruptedRecord, got '%v'", err)
+		}
+	})
+}
+
+func flipLastByte(b []byte) []byte {
+	c := append([]byte{}, b...)
+	c[len(c)-1] ^= 0xff
+
+	return c
+}
@@ -0,0 +1,211 @@
+package doom
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// skiplist keeps the entries of a MemTable sorted by internal key, with the user keys ordered by its comparator, as
+// they are inserted. Every node has a tower of links to the following nodes of its height. A new node is one level
+// higher than the previous one with probability 1/SKIPLIST_BRANCHING, so a search skips most of the nodes from the top
+// level down. Entries are never removed, so readers only need a read lock on every step
+type skiplist struct {
+	cmp    Comparator
+	mu     sync.RWMutex
+	head   *skiplistNode
+	height int
+	rnd    *rand.Rand
+	count  int
+	size   int64
+}
+
+type skiplistNode struct {
+	entry *Entry
+	next  []*skiplistNode
+}
+
+func newSkiplist(cmp Comparator) *skiplist {
+	return &skiplist{
+		cmp:    cmp,
+		head:   &skiplistNode{next: make([]*skiplistNode, SKIPLIST_MAX_HEIGHT)},
+		height: 1,
+		rnd:    rand.New(rand.NewSource(0xdeadbeef)),
+	}
+}
+
+func (l *skiplist) randomHeight() int {
+	h := 1
+	for h < SKIPLIST_MAX_HEIGHT && l.rnd.Intn(SKIPLIST_BRANCHING) == 0 {
+		h++
+	}
+
+	return h
+}
+
+// findGreaterOrEqual returns the first node at or after the internal key of 'key' and 'seq', or nil. If 'prev' isn't
+// nil, it's filled with the last node before it at every level. Must be called with l.mu held
+func (l *skiplist) findGreaterOrEqual(key string, seq uint64, prev []*skiplistNode) *skiplistNode {
+	x := l.head
+	for level := l.height - 1; level >= 0; level-- {
+		for next := x.next[level]; next != nil; next = x.next[level] {
+			if compareKeys(l.cmp, next.entry.Key, next.entry.Seq, key, seq) >= 0 {
+				break
+			}
+			x = next
+		}
+
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+
+	return x.next[0]
+}
+
+// findLessThan returns the last node before 'e', or the head if there is none. Must be called with l.mu held
+func (l *skiplist) findLessThan(e *Entry) *skiplistNode {
+	x := l.head
+	for level := l.height - 1; level >= 0; level-- {
+		for next := x.next[level]; next != nil && compareEntries(l.cmp, next.entry, e) < 0; next = x.next[level] {
+			x = next
+		}
+	}
+
+	return x
+}
+
+// findLast returns the last node, or the head if the list is empty. Must be called with l.mu held
+func (l *skiplist) findLast() *skiplistNode {
+	x := l.head
+	for level := l.height - 1; level >= 0; level-- {
+		for x.next[level] != nil {
+			x = x.next[level]
+		}
+	}
+
+	return x
+}
+
+// insert adds 'e' to the list. It returns false if the list already has an entry with the same key and sequence
+// number
+func (l *skiplist) insert(e *Entry) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	prev := make([]*skiplistNode, SKIPLIST_MAX_HEIGHT)
+	if x := l.findGreaterOrEqual(e.Key, e.Seq, prev); x != nil && compareEntries(l.cmp, x.entry, e) == 0 {
+		return false
+	}
+
+	h := l.randomHeight()
+	for level := l.height; level < h; level++ {
+		prev[level] = l.head
+	}
+	if h > l.height {
+		l.height = h
+	}
+
+	n := &skiplistNode{entry: e, next: make([]*skiplistNode, h)}
+	for level := 0; level < h; level++ {
+		n.next[level] = prev[level].next[level]
+		prev[level].next[level] = n
+	}
+
+	l.count++
+	l.size += int64(len(e.Key)+len(e.Data)+8*h) + SKIPLIST_NODE_OVERHEAD
+
+	return true
+}
+
+// get returns the newest entry of 'key' with a sequence number up to 'seq', or nil
+func (l *skiplist) get(key string, seq uint64) *Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if x := l.findGreaterOrEqual(key, seq, nil); x != nil && x.entry.Key == key {
+		return x.entry
+	}
+
+	return nil
+}
+
+func (l *skiplist) len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.count
+}
+
+// approximateSize returns the bytes taken by the entries and the nodes of the list
+func (l *skiplist) approximateSize() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.size
+}
+
+// skiplistIterator walks the entries of a skiplist in order. Entries inserted while it's open can be found
+type skiplistIterator struct {
+	list *skiplist
+	node *skiplistNode
+}
+
+func (l *skiplist) newIterator() *skiplistIterator {
+	return &skiplistIterator{list: l}
+}
+
+func (it *skiplistIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skiplistIterator) SeekToFirst() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.list.head.next[0]
+}
+
+func (it *skiplistIterator) SeekToLast() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.setNode(it.list.findLast())
+}
+
+func (it *skiplistIterator) Seek(key string, seq uint64) {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.list.findGreaterOrEqual(key, seq, nil)
+}
+
+func (it *skiplistIterator) Next() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.node = it.node.next[0]
+}
+
+func (it *skiplistIterator) Prev() {
+	it.list.mu.RLock()
+	defer it.list.mu.RUnlock()
+
+	it.setNode(it.list.findLessThan(it.node.entry))
+}
+
+// setNode moves to 'n', where the head means that there is no entry
+func (it *skiplistIterator) setNode(n *skiplistNode) {
+	if n == it.list.head {
+		n = nil
+	}
+
+	it.node = n
+}
+
+func (it *skiplistIterator) Entry() *Entry {
+	return it.node.entry
+}
+
+func (it *skiplistIterator) Error() error {
+	return nil
+}
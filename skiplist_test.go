@@ -0,0 +1,76 @@
+package doom
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	l := newSkiplist(BytewiseComparator)
+
+	es := make([]*Entry, 0)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(1000) {
+		e := &Entry{Key: fmt.Sprintf("key%03d", i%300), Data: []byte("value"), Seq: uint64(i + 1)}
+		es = append(es, e)
+
+		if !l.insert(e) {
+			t.Fatalf("Entry '%v' wasn't inserted", e)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return compareEntries(BytewiseComparator, es[i], es[j]) < 0 })
+
+	t.Run("size", func(t *testing.T) {
+		if l.len() != len(es) {
+			t.Errorf("Expected %d entries, got %d", len(es), l.len())
+		}
+
+		size := l.approximateSize()
+		if l.insert(&Entry{Key: es[0].Key, Seq: es[0].Seq}) {
+			t.Error("Expected a duplicated key and sequence to be ignored")
+		}
+		if l.approximateSize() != size || size < int64(len(es))*SKIPLIST_NODE_OVERHEAD {
+			t.Errorf("Unexpected approximate size %d", size)
+		}
+	})
+
+	t.Run("order", func(t *testing.T) {
+		it := l.newIterator()
+
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if it.Entry() != es[i] {
+				t.Fatalf("Unexpected entry '%v' at position %d", it.Entry(), i)
+			}
+			i++
+		}
+
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			i--
+			if it.Entry() != es[i] {
+				t.Fatalf("Unexpected entry '%v' at position %d backward", it.Entry(), i)
+			}
+		}
+
+		if i != 0 {
+			t.Errorf("Expected to walk back to the first entry, stopped at %d", i)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		for _, e := range es {
+			if got := l.get(e.Key, e.Seq); got != e {
+				t.Fatalf("Expected '%v', got '%v'", e, got)
+			}
+		}
+
+		if e := l.get("key000", 0); e != nil {
+			t.Errorf("Expected no entry before the first sequence, got '%v'", e)
+		}
+
+		if e := l.get("missing", MAX_SEQUENCE); e != nil {
+			t.Errorf("Expected no entry for a missing key, got '%v'", e)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSnapshotReleased is returned when a snapshot is read after calling its Release method
+var ErrSnapshotReleased = errors.New("snapshot released")
+
+// Snapshot is a consistent view of the DB at the moment it was taken. Reads through it only see the writes with a
+// sequence number at or before the one that it pins. Compactions keep the versions of keys that a snapshot can read,
+// so it must be released once it isn't needed
+type Snapshot struct {
+	db       *DB
+	seq      uint64
+	released int32
+}
+
+// NewSnapshot pins the sequence number of the last write
+func (db *DB) NewSnapshot() *Snapshot {
+	return &Snapshot{db: db, seq: db.snapshots.addCurrent(&db.seq)}
+}
+
+// Get returns the value that 'key' had when the snapshot was taken. It returns ErrNotFound if the key didn't exist
+// or it was deleted at that moment
+func (s *Snapshot) Get(key string) (value []byte, err error) {
+	return s.GetCF(s.db.defaultCF, key)
+}
+
+// GetCF returns the value that 'key' had in the column family 'cf' when the snapshot was taken
+func (s *Snapshot) GetCF(cf *ColumnFamily, key string) (value []byte, err error) {
+	if atomic.LoadInt32(&s.released) == 1 {
+		return nil, ErrSnapshotReleased
+	}
+
+	return s.db.get(cf, key, s.seq)
+}
+
+// Sequence returns the sequence number pinned by the snapshot
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+// Release lets compactions drop the versions that only this snapshot could read. Calling it more than once is a
+// no-op
+func (s *Snapshot) Release() {
+	if atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		s.db.snapshots.remove(s.seq)
+	}
+}
+
+// snapshotList counts the live snapshots of each sequence number
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs map[uint64]int
+}
+
+// addCurrent adds a snapshot of the sequence number loaded from 'seq' and returns it. It's loaded with the list
+// locked, so a flush or a compaction that takes the live snapshots either sees it or reads no version newer than it
+func (l *snapshotList) addCurrent(seq *uint64) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seqs == nil {
+		l.seqs = make(map[uint64]int)
+	}
+
+	current := atomic.LoadUint64(seq)
+	l.seqs[current]++
+
+	return current
+}
+
+func (l *snapshotList) remove(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seqs[seq]--; l.seqs[seq] <= 0 {
+		delete(l.seqs, seq)
+	}
+}
+
+// sorted returns the sequence numbers of the live snapshots in ascending order
+func (l *snapshotList) sorted() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(l.seqs))
+	for seq := range l.seqs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs
+}
+
+// visibleVersions returns the entries of 'es', sorted by internal key, that a read can still find: the newest
+// version of each key and the older ones that a snapshot of 'snapshots', in ascending order, reads. When one of them
+// is a merge operand, the older versions that it's merged with are kept too, after 'm' collapses them
+func visibleVersions(es []*Entry, snapshots []uint64, m *versionMerger) []*Entry {
+	res := make([]*Entry, 0, len(es))
+	for i := 0; i < len(es); {
+		// The versions from 'i' to 'j' are read by the same snapshots
+		j := i + 1
+		for j < len(es) && es[j].Key == es[i].Key && !isReadBySnapshot(es[j].Seq, es[j-1].Seq, snapshots) {
+			j++
+		}
+
+		if es[i].Merge {
+			res = append(res, m.collapse(es[i:j], j == len(es) || es[j].Key != es[i].Key)...)
+		} else {
+			res = append(res, es[i])
+		}
+
+		i = j
+	}
+
+	return res
+}
+
+// isReadBySnapshot returns true if a snapshot pins a sequence number between 'seq', included, and 'newer', which
+// is the sequence number of the next version of the same key
+func isReadBySnapshot(seq, newer uint64, snapshots []uint64) bool {
+	i := sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+
+	return i < len(snapshots) && snapshots[i] < newer
+}
@@ -0,0 +1,129 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key", []byte("old"))
+	db.Put("deleted", []byte("value"))
+	snap := db.NewSnapshot()
+	oldSeq := snap.Sequence()
+
+	db.Put("key", []byte("new"))
+	db.Delete("deleted")
+	db.Put("added", []byte("value"))
+
+	check := func(t *testing.T) {
+		if value, err := snap.Get("key"); err != nil || string(value) != "old" {
+			t.Errorf("Expected 'old' from the snapshot, got '%s' (%v)", value, err)
+		}
+		if value, err := snap.Get("deleted"); err != nil || string(value) != "value" {
+			t.Errorf("Expected the deleted key from the snapshot, got '%s' (%v)", value, err)
+		}
+		if _, err := snap.Get("added"); err != ErrNotFound {
+			t.Errorf("Expected a key added after the snapshot to be missing, got %v", err)
+		}
+
+		if value, err := db.Get("key"); err != nil || string(value) != "new" {
+			t.Errorf("Expected 'new', got '%s' (%v)", value, err)
+		}
+		if _, err := db.Get("deleted"); err != ErrNotFound {
+			t.Errorf("Expected the key to be deleted, got %v", err)
+		}
+	}
+
+	t.Run("from the MemTable", check)
+
+	t.Run("from SSTables", func(t *testing.T) {
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t)
+	})
+
+	flushRounds := func(t *testing.T) {
+		for round := 0; round < 2*DEFAULT_L0_COMPACTION_TRIGGER; round++ {
+			db.Put("key", []byte("new"))
+			db.Put(fmt.Sprintf("round%03d", round), []byte("value"))
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		waitForCompactions(t, db)
+	}
+
+	t.Run("after compactions", func(t *testing.T) {
+		flushRounds(t)
+		check(t)
+	})
+
+	t.Run("released", func(t *testing.T) {
+		snap.Release()
+		snap.Release()
+
+		if _, err := snap.Get("key"); err != ErrSnapshotReleased {
+			t.Errorf("Expected ErrSnapshotReleased, got %v", err)
+		}
+
+		flushRounds(t)
+
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		for level, tables := range db.defaultCF.levels {
+			for _, m := range tables {
+				table, err := db.tables.get(m.number, BytewiseComparator)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				es, err := table.Entries()
+				table.release()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, e := range es {
+					if e.Key == "key" && e.Seq <= oldSeq {
+						t.Errorf("Version %d of 'key' wasn't dropped from level %d", e.Seq, level)
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestVisibleVersions(t *testing.T) {
+	es := []*Entry{
+		{Key: "a", Seq: 9}, {Key: "a", Seq: 7}, {Key: "a", Seq: 4}, {Key: "a", Seq: 2},
+		{Key: "b", Seq: 3},
+	}
+
+	visible := visibleVersions(es, []uint64{5, 8}, nil)
+
+	expected := []uint64{9, 7, 4, 3}
+	if len(visible) != len(expected) {
+		t.Fatalf("Unexpected visible versions '%v'", visible)
+	}
+
+	for i := range visible {
+		if visible[i].Seq != expected[i] {
+			t.Errorf("Expected sequence %d at position %d, got %d", expected[i], i, visible[i].Seq)
+		}
+	}
+}
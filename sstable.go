@@ -0,0 +1,670 @@
+package doom
+
+import (
+	"encoding/binary"
+	"github.com/juju/errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrCorruptedSSTable is returned when a block or the footer of an SSTable doesn't pass its checks
+var ErrCorruptedSSTable = errors.New("corrupted sstable")
+
+// An SSTable file has the following layout:
+//
+//	data block 0 | trailer
+//	...
+//	data block N | trailer
+//	filter block | trailer (optional)
+//	properties block | trailer
+//	metaindex block | trailer
+//	index block | trailer
+//	footer
+//
+// Every block is a sequence of entries encoded as 'type | uvarint key length | uvarint value length | key | value' with
+// the same record types of the WAL. Keys of data blocks are internal keys, so a table can hold several versions of a
+// key sorted from the newest to the oldest, with the keys ordered by the comparator of the table. A block is flushed
+// once it reaches the block size of the writer.
+//
+// The trailer of each block has a byte for its compression type and the CRC32C of the stored block plus that byte.
+// Blocks are compressed with the codec chosen for the level of the table, unless that saves less than an eighth of
+// their size, so each block records the codec it was written with.
+//
+// The index block has an entry per data block whose key sorts at or after the last key stored in that block and before
+// the first key of the next one, shortened by the comparator, and whose value is the handle (uvarint offset and uvarint
+// size) of the block. The metaindex block maps names of meta blocks to handles. The meta blocks are the Bloom filter of
+// the user keys of the table, stored raw under SSTABLE_FILTER_BLOCK_NAME, and the properties block under
+// SSTABLE_PROPERTIES_BLOCK_NAME, which maps names of properties such as the highest sequence number of the table or the
+// name of its comparator to their values.
+//
+// The footer has a fixed size: the handles of the metaindex and index blocks as fixed 64 bit integers, the format
+// version as a 32 bit integer and the magic number
+
+type blockHandle struct {
+	offset, size int64
+}
+
+func (h blockHandle) encode() []byte {
+	b := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, uint64(h.offset))
+	n += binary.PutUvarint(b[n:], uint64(h.size))
+
+	return b[:n]
+}
+
+func decodeBlockHandle(b []byte) (h blockHandle, err error) {
+	offset, n := binary.Uvarint(b)
+	if n <= 0 {
+		return h, errors.Annotate(ErrCorruptedSSTable, "Invalid block handle offset")
+	}
+
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return h, errors.Annotate(ErrCorruptedSSTable, "Invalid block handle size")
+	}
+
+	return blockHandle{offset: int64(offset), size: int64(size)}, nil
+}
+
+// blockBuilder accumulates the encoded entries of a block
+type blockBuilder struct {
+	buf []byte
+}
+
+func (b *blockBuilder) add(t byte, key string, value []byte) {
+	var lengths [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lengths[:], uint64(len(key)))
+	n += binary.PutUvarint(lengths[n:], uint64(len(value)))
+
+	b.buf = append(b.buf, t)
+	b.buf = append(b.buf, lengths[:n]...)
+	b.buf = append(b.buf, key...)
+	b.buf = append(b.buf, value...)
+}
+
+func (b *blockBuilder) len() int {
+	return len(b.buf)
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+}
+
+// decodeBlock returns the entries stored in the contents of a block, without its trailer
+func decodeBlock(b []byte) (es []*Entry, err error) {
+	es = make([]*Entry, 0)
+
+	for pos := 0; pos < len(b); {
+		start := pos
+		t := b[pos]
+		pos++
+
+		keyLength, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return nil, errors.Annotatef(ErrCorruptedSSTable, "Invalid key length at block offset %d", start)
+		}
+		pos += n
+
+		valueLength, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return nil, errors.Annotatef(ErrCorruptedSSTable, "Invalid value length at block offset %d", start)
+		}
+		pos += n
+
+		if !(isValidRecordType(t) || t == RECORD_COLUMN_FAMILY) || uint64(len(b)-pos) < keyLength+valueLength {
+			return nil, errors.Annotatef(ErrCorruptedSSTable, "Invalid entry at block offset %d", start)
+		}
+
+		e := &Entry{Key: string(b[pos : pos+int(keyLength)])}
+		pos += int(keyLength)
+
+		if t == RECORD_COLUMN_FAMILY {
+			if t, err = parseFamilyKey(e); err != nil {
+				return nil, errors.Annotatef(ErrCorruptedSSTable, "Invalid column family at block offset %d", start)
+			}
+		}
+
+		if err = decodeValue(e, t, b[pos:pos+int(valueLength)]); err != nil {
+			return nil, errors.Annotatef(ErrCorruptedSSTable, "Invalid value at block offset %d", start)
+		}
+		pos += int(valueLength)
+
+		e.Length = int64(pos - start)
+		es = append(es, e)
+	}
+
+	return
+}
+
+// decodeDataBlock returns the entries stored in the contents of a data block with their sequence numbers
+func decodeDataBlock(b []byte) (es []*Entry, err error) {
+	if es, err = decodeBlock(b); err != nil {
+		return
+	}
+
+	for _, e := range es {
+		key, seq, t, err := parseInternalKey(e.Key)
+		if err != nil || t != recordType(e) {
+			return nil, errors.Annotatef(ErrCorruptedSSTable, "Invalid internal key in data block")
+		}
+
+		e.Key, e.Seq = key, seq
+	}
+
+	return
+}
+
+// newSSTableWriter returns a writer that builds an SSTable into 'w' with the comparator, block size and compression
+// of 'o'. Nothing is complete on disk until Finish returns successfully. A Bloom filter is added to the table unless
+// the bits per key of 'o' aren't positive
+func newSSTableWriter(w io.Writer, o tableOptions) *sstableWriter {
+	return &sstableWriter{
+		w:           w,
+		cmp:         o.comparator,
+		compression: o.compression,
+		blockSize:   o.blockSize,
+		bitsPerKey:  o.bitsPerKey,
+	}
+}
+
+type sstableWriter struct {
+	w           io.Writer
+	cmp         Comparator
+	compression byte
+	offset      int64
+	block       blockBuilder
+	index       blockBuilder
+	lastKey     string
+	maxSeq      uint64
+	entries     int
+	blockSize   int
+	bitsPerKey  int
+	keys        []string
+
+	// The index entry of the last data block written waits for the first key of the next one, so its key can be
+	// shortened to a separator between both
+	pendingIndex  bool
+	pendingHandle blockHandle
+}
+
+// Add appends an entry to the table. Entries must be added in strictly increasing order of internal keys, that is,
+// by key and then from the highest sequence number to the lowest
+func (w *sstableWriter) Add(e *Entry) (err error) {
+	key := entryInternalKey(e)
+	if w.entries > 0 && compareInternalKeys(w.cmp, key, w.lastKey) <= 0 {
+		return errors.Errorf("Key '%s' with sequence %d added to sstable out of order", e.Key, e.Seq)
+	}
+
+	if w.pendingIndex {
+		w.index.add(RECORD_VALUE, indexSeparator(w.cmp, w.lastKey, key), w.pendingHandle.encode())
+		w.pendingIndex = false
+	}
+
+	w.block.add(recordType(e), key, encodeValue(e))
+	w.lastKey = key
+	w.entries++
+
+	if e.Seq > w.maxSeq {
+		w.maxSeq = e.Seq
+	}
+
+	if w.bitsPerKey > 0 {
+		w.keys = append(w.keys, e.Key)
+	}
+
+	if w.block.len() >= w.blockSize {
+		err = w.flushBlock()
+	}
+
+	return
+}
+
+// Size returns the number of bytes of the table so far, including the data block that is being built
+func (w *sstableWriter) Size() int64 {
+	return w.offset + int64(w.block.len())
+}
+
+// Finish writes the pending data block, the filter, properties, metaindex and index blocks and the footer
+func (w *sstableWriter) Finish() (err error) {
+	if err = w.flushBlock(); err != nil {
+		return
+	}
+
+	if w.pendingIndex {
+		w.index.add(RECORD_VALUE, indexSuccessor(w.cmp, w.lastKey), w.pendingHandle.encode())
+		w.pendingIndex = false
+	}
+
+	var metaindex blockBuilder
+	if w.bitsPerKey > 0 {
+		filterHandle, err := w.writeBlock(newBloomFilter(w.keys, w.bitsPerKey))
+		if err != nil {
+			return errors.Annotate(err, "Could not write filter block")
+		}
+
+		metaindex.add(RECORD_VALUE, SSTABLE_FILTER_BLOCK_NAME, filterHandle.encode())
+	}
+
+	var properties blockBuilder
+	maxSeq := make([]byte, 8)
+	binary.LittleEndian.PutUint64(maxSeq, w.maxSeq)
+	properties.add(RECORD_VALUE, SSTABLE_COMPARATOR_PROPERTY, []byte(w.cmp.Name()))
+	properties.add(RECORD_VALUE, SSTABLE_MAX_SEQUENCE_PROPERTY, maxSeq)
+
+	propertiesHandle, err := w.writeBlock(properties.buf)
+	if err != nil {
+		return errors.Annotate(err, "Could not write properties block")
+	}
+	metaindex.add(RECORD_VALUE, SSTABLE_PROPERTIES_BLOCK_NAME, propertiesHandle.encode())
+
+	metaindexHandle, err := w.writeBlock(metaindex.buf)
+	if err != nil {
+		return errors.Annotate(err, "Could not write metaindex block")
+	}
+
+	indexHandle, err := w.writeBlock(w.index.buf)
+	if err != nil {
+		return errors.Annotate(err, "Could not write index block")
+	}
+
+	footer := make([]byte, SSTABLE_FOOTER_SIZE)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(metaindexHandle.offset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(metaindexHandle.size))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(indexHandle.offset))
+	binary.LittleEndian.PutUint64(footer[24:], uint64(indexHandle.size))
+	binary.LittleEndian.PutUint32(footer[32:], SSTABLE_FORMAT_VERSION)
+	binary.LittleEndian.PutUint64(footer[36:], SSTABLE_MAGIC)
+
+	if _, err = w.w.Write(footer); err != nil {
+		err = errors.Annotate(err, "Could not write sstable footer")
+	}
+
+	return
+}
+
+func (w *sstableWriter) flushBlock() (err error) {
+	if w.block.len() == 0 {
+		return
+	}
+
+	h, err := w.writeBlock(w.block.buf)
+	if err != nil {
+		return errors.Annotate(err, "Could not write data block")
+	}
+
+	w.pendingIndex, w.pendingHandle = true, h
+	w.block.reset()
+
+	return
+}
+
+func (w *sstableWriter) writeBlock(raw []byte) (h blockHandle, err error) {
+	b, compression, err := compressBlock(raw, w.compression)
+	if err != nil {
+		return
+	}
+
+	trailer := make([]byte, BLOCK_TRAILER_SIZE)
+	trailer[0] = compression
+	binary.LittleEndian.PutUint32(trailer[1:], blockChecksum(b, trailer[0]))
+
+	if _, err = w.w.Write(b); err != nil {
+		return
+	}
+	if _, err = w.w.Write(trailer); err != nil {
+		return
+	}
+
+	h = blockHandle{offset: w.offset, size: int64(len(b))}
+	w.offset += int64(len(b) + BLOCK_TRAILER_SIZE)
+
+	return
+}
+
+func blockChecksum(b []byte, compression byte) uint32 {
+	c := crc32.Checksum(b, crcTable)
+	return crc32.Update(c, crcTable, []byte{compression})
+}
+
+// SSTable is an open, immutable and sorted table file. Its index and filter are kept in memory so a lookup only
+// needs to read one data block, or none if the filter tells that the key isn't in the table
+type SSTable struct {
+	f      File
+	cmp    Comparator
+	index  []indexEntry
+	meta   map[string]blockHandle
+	filter bloomFilter
+	maxSeq uint64
+
+	// Data blocks are kept in 'cache' under 'cacheID', if there is one
+	cache   *blockCache
+	cacheID uint64
+
+	// filterStats counts the lookups answered by the filter, if the table is read by a DB
+	filterStats *FilterStats
+}
+
+// indexEntry points to a data block. 'lastKey' is an internal key that sorts at or after the last entry of the block
+// and before the first entry of the next one
+type indexEntry struct {
+	lastKey string
+	handle  blockHandle
+}
+
+// OpenSSTable opens the SSTable file 'name', written with BytewiseComparator, and loads its index
+func OpenSSTable(name string) (t *SSTable, err error) {
+	return openSSTable(OSFS, name, nil, BytewiseComparator)
+}
+
+// openSSTable opens the SSTable file 'name' of 'fs' and keeps the data blocks that it reads in 'cache', which can be
+// nil. It fails with ErrComparatorMismatch if the table was written with another comparator than 'cmp'. Tables that
+// don't record theirs were written with BytewiseComparator
+func openSSTable(fs FS, name string, cache *blockCache, cmp Comparator) (t *SSTable, err error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Could not open sstable file '%s'", name)
+	}
+
+	t = &SSTable{f: f, cmp: cmp, meta: make(map[string]blockHandle), cache: cache, cacheID: cache.newID()}
+	if err = t.readFooter(); err != nil {
+		f.Close()
+		return nil, errors.Annotatef(err, "Could not open sstable file '%s'", name)
+	}
+
+	return
+}
+
+func (t *SSTable) readFooter() (err error) {
+	stat, err := t.f.Stat()
+	if err != nil {
+		return
+	}
+
+	if stat.Size() < SSTABLE_FOOTER_SIZE {
+		return errors.Annotatef(ErrCorruptedSSTable, "File of %d bytes is too short", stat.Size())
+	}
+
+	footer := make([]byte, SSTABLE_FOOTER_SIZE)
+	if _, err = t.f.ReadAt(footer, stat.Size()-SSTABLE_FOOTER_SIZE); err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint64(footer[36:]) != SSTABLE_MAGIC {
+		return errors.Annotate(ErrCorruptedSSTable, "Bad magic number")
+	}
+
+	if v := binary.LittleEndian.Uint32(footer[32:]); v != SSTABLE_FORMAT_VERSION {
+		return errors.Errorf("Unsupported sstable format version %d", v)
+	}
+
+	metaindex, err := t.readBlock(blockHandle{
+		offset: int64(binary.LittleEndian.Uint64(footer[0:])),
+		size:   int64(binary.LittleEndian.Uint64(footer[8:])),
+	})
+	if err != nil {
+		return errors.Annotate(err, "Could not read metaindex block")
+	}
+
+	for _, e := range metaindex {
+		if t.meta[e.Key], err = decodeBlockHandle(e.Data); err != nil {
+			return
+		}
+	}
+
+	index, err := t.readBlock(blockHandle{
+		offset: int64(binary.LittleEndian.Uint64(footer[16:])),
+		size:   int64(binary.LittleEndian.Uint64(footer[24:])),
+	})
+	if err != nil {
+		return errors.Annotate(err, "Could not read index block")
+	}
+
+	t.index = make([]indexEntry, len(index))
+	for i, e := range index {
+		t.index[i].lastKey = e.Key
+		if t.index[i].handle, err = decodeBlockHandle(e.Data); err != nil {
+			return
+		}
+	}
+
+	if h, ok := t.meta[SSTABLE_FILTER_BLOCK_NAME]; ok {
+		if t.filter, err = t.readBlockContents(h); err != nil {
+			return errors.Annotate(err, "Could not read filter block")
+		}
+	}
+
+	comparator := BytewiseComparator.Name()
+	if h, ok := t.meta[SSTABLE_PROPERTIES_BLOCK_NAME]; ok {
+		properties, err := t.readBlock(h)
+		if err != nil {
+			return errors.Annotate(err, "Could not read properties block")
+		}
+
+		for _, p := range properties {
+			switch {
+			case p.Key == SSTABLE_MAX_SEQUENCE_PROPERTY && len(p.Data) == 8:
+				t.maxSeq = binary.LittleEndian.Uint64(p.Data)
+			case p.Key == SSTABLE_COMPARATOR_PROPERTY:
+				comparator = string(p.Data)
+			}
+		}
+	}
+
+	if comparator != t.cmp.Name() {
+		return errors.Annotatef(ErrComparatorMismatch, "Table written with comparator '%s', read with '%s'",
+			comparator, t.cmp.Name())
+	}
+
+	return
+}
+
+func (t *SSTable) readBlock(h blockHandle) (es []*Entry, err error) {
+	b, err := t.readBlockContents(h)
+	if err != nil {
+		return
+	}
+
+	return decodeBlock(b)
+}
+
+// readDataBlock returns the entries of a data block from the cache or from the file. Blocks read from the file are
+// added to the cache if 'fillCache' is true. The entries can be shared with other reads so they must not be modified
+func (t *SSTable) readDataBlock(h blockHandle, fillCache bool) (es []*Entry, err error) {
+	k := cacheKey{id: t.cacheID, offset: h.offset}
+	if t.cache != nil {
+		if es, ok := t.cache.get(k); ok {
+			return es, nil
+		}
+	}
+
+	b, err := t.readBlockContents(h)
+	if err != nil {
+		return
+	}
+
+	if es, err = decodeDataBlock(b); err == nil && t.cache != nil && fillCache {
+		t.cache.insert(k, es, int64(len(b)))
+	}
+
+	return
+}
+
+// readBlockContents returns the uncompressed contents of a block after checking its trailer
+func (t *SSTable) readBlockContents(h blockHandle) (data []byte, err error) {
+	b := make([]byte, h.size+BLOCK_TRAILER_SIZE)
+	if _, err = t.f.ReadAt(b, h.offset); err != nil {
+		return nil, errors.Annotatef(err, "Could not read block at offset %d", h.offset)
+	}
+
+	data, trailer := b[:h.size], b[h.size:]
+	if binary.LittleEndian.Uint32(trailer[1:]) != blockChecksum(data, trailer[0]) {
+		return nil, errors.Annotatef(ErrCorruptedSSTable, "Checksum mismatch in block at offset %d", h.offset)
+	}
+
+	if data, err = decompressBlock(data, trailer[0]); err != nil {
+		return nil, errors.Annotatef(err, "Could not decompress block at offset %d", h.offset)
+	}
+
+	return data, nil
+}
+
+// Get returns the entry with the highest sequence number stored for 'key', which can be a tombstone, or nil if the
+// table doesn't have it
+func (t *SSTable) Get(key string) (e *Entry, err error) {
+	return t.get(key, MAX_SEQUENCE)
+}
+
+// get returns the newest entry of 'key' with a sequence number up to 'seq'
+func (t *SSTable) get(key string, seq uint64) (e *Entry, err error) {
+	seek := makeInternalKey(key, seq, RECORD_VALUE)
+	i := sort.Search(len(t.index), func(i int) bool {
+		return compareInternalKeys(t.cmp, t.index[i].lastKey, seek) >= 0
+	})
+	if i == len(t.index) {
+		return
+	}
+
+	counted := t.filter != nil && t.filterStats != nil
+	if t.filter != nil && !t.filter.MayContain(key) {
+		if counted {
+			atomic.AddInt64(&t.filterStats.Misses, 1)
+		}
+		return
+	}
+
+	es, err := t.readDataBlock(t.index[i].handle, true)
+	if err != nil {
+		return
+	}
+
+	// Versions of a key are sorted from the newest, so the first one found at or before 'seq' is the one to read
+	for _, e := range es {
+		if e.Key == key && e.Seq <= seq {
+			if counted {
+				atomic.AddInt64(&t.filterStats.Hits, 1)
+			}
+
+			return e, nil
+		}
+	}
+
+	if counted {
+		atomic.AddInt64(&t.filterStats.FalsePositives, 1)
+	}
+
+	return
+}
+
+// Entries returns every entry of the table sorted by internal key. The blocks read aren't added to the cache
+func (t *SSTable) Entries() (es []*Entry, err error) {
+	es = make([]*Entry, 0)
+
+	for _, i := range t.index {
+		block, err := t.readDataBlock(i.handle, false)
+		if err != nil {
+			return nil, err
+		}
+
+		es = append(es, block...)
+	}
+
+	return
+}
+
+// sstableIterator walks the entries of a table in order of internal keys, reading one data block at a time
+type sstableIterator struct {
+	t         *SSTable
+	fillCache bool
+	block     int
+	entries   []*Entry
+	pos       int
+	err       error
+}
+
+// newIterator returns an iterator over the table that adds the blocks that it reads to the cache if 'fillCache' is
+// true
+func (t *SSTable) newIterator(fillCache bool) *sstableIterator {
+	return &sstableIterator{t: t, fillCache: fillCache}
+}
+
+// loadBlock reads the data block 'i' and returns false if it doesn't exist or it can't be read
+func (it *sstableIterator) loadBlock(i int) bool {
+	it.block, it.entries = i, nil
+	if i < 0 || i >= len(it.t.index) {
+		return false
+	}
+
+	if it.entries, it.err = it.t.readDataBlock(it.t.index[i].handle, it.fillCache); it.err != nil {
+		it.entries = nil
+		return false
+	}
+
+	return true
+}
+
+func (it *sstableIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sstableIterator) SeekToFirst() {
+	it.loadBlock(0)
+	it.pos = 0
+}
+
+func (it *sstableIterator) SeekToLast() {
+	it.loadBlock(len(it.t.index) - 1)
+	it.pos = len(it.entries) - 1
+}
+
+func (it *sstableIterator) Seek(key string, seq uint64) {
+	seek := makeInternalKey(key, seq, RECORD_VALUE)
+	it.loadBlock(sort.Search(len(it.t.index), func(i int) bool {
+		return compareInternalKeys(it.t.cmp, it.t.index[i].lastKey, seek) >= 0
+	}))
+
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return compareKeys(it.t.cmp, it.entries[i].Key, it.entries[i].Seq, key, seq) >= 0
+	})
+
+	// The index key of the block can sort after its last entry, so the key sought may be at the start of the next one
+	if it.pos == len(it.entries) && it.loadBlock(it.block+1) {
+		it.pos = 0
+	}
+}
+
+func (it *sstableIterator) Next() {
+	if it.pos++; it.pos >= len(it.entries) && it.loadBlock(it.block+1) {
+		it.pos = 0
+	}
+}
+
+func (it *sstableIterator) Prev() {
+	if it.pos--; it.pos < 0 && it.loadBlock(it.block-1) {
+		it.pos = len(it.entries) - 1
+	}
+}
+
+func (it *sstableIterator) Entry() *Entry {
+	return it.entries[it.pos]
+}
+
+func (it *sstableIterator) Error() error {
+	return it.err
+}
+
+// MaxSequence returns the highest sequence number of the entries of the table
+func (t *SSTable) MaxSequence() uint64 {
+	return t.maxSeq
+}
+
+// Name returns the name of the file of the table
+func (t *SSTable) Name() string {
+	return t.f.Name()
+}
+
+// Close closes the file of the table
+func (t *SSTable) Close() error {
+	return t.f.Close()
+}
@@ -0,0 +1,241 @@
+package doom
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testTableOptions are the default settings of the tables of level 0
+var testTableOptions = tableOptions{
+	comparator: BytewiseComparator,
+	blockSize:  DEFAULT_BLOCK_SIZE,
+	bitsPerKey: DEFAULT_BLOOM_BITS_PER_KEY,
+}
+
+func writeTestSSTable(t *testing.T, es []*Entry) string {
+	f, err := ioutil.TempFile("/tmp", SSTABLES_PREFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := newSSTableWriter(f, testTableOptions)
+	for _, e := range es {
+		if err = w.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestSSTable(t *testing.T) {
+	es := make([]*Entry, 0)
+	for i := 0; i < 1000; i++ {
+		e := &Entry{Key: fmt.Sprintf("key%04d", i), Data: []byte(fmt.Sprintf("value %d\nof key %d", i, i))}
+		if i%10 == 0 {
+			e.Data, e.Tombstone = nil, true
+		}
+		es = append(es, e)
+	}
+
+	name := writeTestSSTable(t, es)
+	defer os.Remove(name)
+
+	table, err := OpenSSTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if len(table.index) < 2 {
+		t.Fatalf("Expected several data blocks, got '%d'", len(table.index))
+	}
+
+	t.Run("get", func(t *testing.T) {
+		e, err := table.Get("key0123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil || string(e.Data) != "value 123\nof key 123" {
+			t.Errorf("Unexpected entry '%v'", e)
+		}
+
+		if e, _ = table.Get("key0120"); e == nil || !e.Tombstone {
+			t.Errorf("Expected a tombstone, got '%v'", e)
+		}
+
+		for _, missing := range []string{"a", "key0123a", "zzz"} {
+			if e, _ = table.Get(missing); e != nil {
+				t.Errorf("Key '%s' shouldn't exist, got '%v'", missing, e)
+			}
+		}
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		all, err := table.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(all) != len(es) {
+			t.Fatalf("Expected %d entries, got '%d'", len(es), len(all))
+		}
+
+		for i := range all {
+			if all[i].Key != es[i].Key || all[i].Tombstone != es[i].Tombstone {
+				t.Fatalf("Unexpected entry '%v' at position %d", all[i], i)
+			}
+		}
+	})
+
+	t.Run("unordered keys", func(t *testing.T) {
+		w := newSSTableWriter(ioutil.Discard, testTableOptions)
+		w.Add(&Entry{Key: "b"})
+		if err := w.Add(&Entry{Key: "a"}); err == nil {
+			t.Error("Expected an error adding keys out of order")
+		}
+
+		w.Add(&Entry{Key: "c", Seq: 1})
+		if err := w.Add(&Entry{Key: "c", Seq: 2}); err == nil {
+			t.Error("Expected an error adding an older version before a newer one")
+		}
+	})
+}
+
+func TestSSTableVersions(t *testing.T) {
+	name := writeTestSSTable(t, []*Entry{
+		{Key: "a", Data: []byte("new"), Seq: 7},
+		{Key: "a", Data: []byte("old"), Seq: 3},
+		{Key: "b", Tombstone: true, Seq: 9},
+		{Key: "b", Data: []byte("old"), Seq: 2},
+	})
+	defer os.Remove(name)
+
+	table, err := OpenSSTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if table.MaxSequence() != 9 {
+		t.Errorf("Expected max sequence 9, got %d", table.MaxSequence())
+	}
+
+	if e, _ := table.Get("a"); e == nil || e.Seq != 7 || string(e.Data) != "new" {
+		t.Errorf("Expected the newest version of 'a', got '%v'", e)
+	}
+
+	if e, _ := table.Get("b"); e == nil || !e.Tombstone {
+		t.Errorf("Expected the tombstone of 'b', got '%v'", e)
+	}
+}
+
+func TestSSTableCompression(t *testing.T) {
+	es := make([]*Entry, 0)
+	for i := 0; i < 500; i++ {
+		es = append(es, &Entry{
+			Key:  fmt.Sprintf("key%04d", i),
+			Data: []byte(fmt.Sprintf(`{"id": %d, "name": "user %d", "active": true, "tags": ["a", "b"]}`, i, i)),
+			Seq:  uint64(i + 1),
+		})
+	}
+
+	sizes := make(map[byte]int64)
+	for _, compression := range []byte{BLOCK_NO_COMPRESSION, BLOCK_FLATE_COMPRESSION, BLOCK_GZIP_COMPRESSION} {
+		f, _ := ioutil.TempFile("/tmp", SSTABLES_PREFIX)
+		defer os.Remove(f.Name())
+
+		o := testTableOptions
+		o.compression = compression
+		w := newSSTableWriter(f, o)
+		for _, e := range es {
+			if err := w.Add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		sizes[compression] = w.Size()
+		f.Close()
+
+		table, err := OpenSSTable(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := table.Entries()
+		table.Close()
+		if err != nil || len(read) != len(es) {
+			t.Fatalf("Expected %d entries with compression %d, got %d (%v)", len(es), compression, len(read), err)
+		}
+
+		for i, e := range read {
+			if e.Key != es[i].Key || string(e.Data) != string(es[i].Data) || e.Seq != es[i].Seq {
+				t.Fatalf("Expected '%s', got '%s' with compression %d", es[i].String(), e.String(), compression)
+			}
+		}
+	}
+
+	for _, compression := range []byte{BLOCK_FLATE_COMPRESSION, BLOCK_GZIP_COMPRESSION} {
+		if sizes[compression] >= sizes[BLOCK_NO_COMPRESSION]/2 {
+			t.Errorf("Expected compression %d to halve %d bytes, got %d", compression,
+				sizes[BLOCK_NO_COMPRESSION], sizes[compression])
+		}
+	}
+
+	t.Run("incompressible block stored raw", func(t *testing.T) {
+		random := []byte{0x8f, 0x13, 0xe2, 0x4a, 0x77, 0x01, 0xc9, 0x5d}
+		if b, used, err := compressBlock(random, BLOCK_FLATE_COMPRESSION); err != nil || used != BLOCK_NO_COMPRESSION ||
+			string(b) != string(random) {
+			t.Errorf("Expected the block to be stored raw, got compression %d (%v)", used, err)
+		}
+	})
+
+	t.Run("unknown compression type", func(t *testing.T) {
+		if _, err := decompressBlock([]byte("block"), 9); errors.Cause(err) != ErrCorruptedSSTable {
+			t.Errorf("Expected ErrCorruptedSSTable, got %v", err)
+		}
+	})
+}
+
+func TestSSTableCorruption(t *testing.T) {
+	name := writeTestSSTable(t, []*Entry{{Key: "hello", Data: []byte("world")}})
+	defer os.Remove(name)
+
+	byt, _ := ioutil.ReadFile(name)
+
+	t.Run("data block", func(t *testing.T) {
+		corrupted := append([]byte{}, byt...)
+		corrupted[2] ^= 0xff
+		ioutil.WriteFile(name, corrupted, 0644)
+
+		table, err := OpenSSTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer table.Close()
+
+		if _, err = table.Get("hello"); errors.Cause(err) != ErrCorruptedSSTable {
+			t.Errorf("Expected ErrCorruptedSSTable, got '%v'", err)
+		}
+	})
+
+	t.Run("footer", func(t *testing.T) {
+		corrupted := append([]byte{}, byt...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		ioutil.WriteFile(name, corrupted, 0644)
+
+		if _, err := OpenSSTable(name); errors.Cause(err) != ErrCorruptedSSTable {
+			t.Errorf("Expected ErrCorruptedSSTable, got '%v'", err)
+		}
+	})
+}
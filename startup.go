@@ -1,98 +1,206 @@
 package doom
 
 import (
-	"engo.io/engo/math"
 	"github.com/juju/errors"
 	"github.com/thehivecorporation/log"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
-func startup() error {
-	// Cleanup empty filesStats first
-	cleanEmptyFilesOnFolder(STORAGE_PATH)
-	cleanEmptyFilesOnFolder(TEMP_PATH)
-
-	// Retrieve small SSTable files into a big slice
-	orderedLines, _, err := contentOfFilesLessThanSizeAndWithFilenames(STORAGE_PATH, SSTABLES_PREFIX, MAX_SSTABLES_SIZE)
+// recover replays the MANIFEST named by CURRENT, creates the live column families and opens the live tables in their
+// levels. A DB without CURRENT starts empty, and one written with another comparator than the one of the options isn't
+// opened. MANIFEST files that don't name theirs were written with BytewiseComparator. Column families take their
+// options from Options.ColumnFamilies and must be opened with the comparator that they were created with
+func (db *DB) recover() (err error) {
+	name, err := readCurrent(db.fs, db.storageFolder)
 	if err != nil {
-		err = errors.Annotate(err, "Could not get content of small SSTable files")
-		return err
+		return
 	}
 
-	//  1. Create WAL file
-WAL:
-	wal, err := NewWAL()
-	if err != nil {
-		err = errors.Annotate(err, "Could not create WAL file")
-		return err
-	}
+	live := make(map[uint64]*tableMeta)
+	families := make(map[uint32]*familyMeta)
+	if name != "" {
+		edits, err := readManifest(db.fs, name)
+		if err != nil {
+			return err
+		}
+
+		comparator := BytewiseComparator.Name()
+		for _, e := range edits {
+			if e.comparator != "" {
+				comparator = e.comparator
+			}
+
+			for _, f := range e.created {
+				families[f.id] = f
+			}
+			for _, id := range e.dropped {
+				delete(families, id)
+			}
+			if e.lastFamily > db.lastFamily {
+				db.lastFamily = e.lastFamily
+			}
+
+			for _, m := range e.removed {
+				delete(live, m.number)
+			}
+			for _, m := range e.added {
+				live[m.number] = m
+			}
 
-	var accBytes int64
-	if len(orderedLines) == 0 {
-		goto checkOldWAL
+			db.logNumber, db.nextFile, db.seq = e.logNumber, e.nextFileNumber, e.lastSeq
+		}
+
+		if comparator != db.opts.Comparator.Name() {
+			return errors.Annotatef(ErrComparatorMismatch, "DB written with comparator '%s', opened with '%s'",
+				comparator, db.opts.Comparator.Name())
+		}
 	}
 
-	for i, l := range orderedLines {
-		if accBytes >= MAX_SSTABLES_SIZE {
-			wal.refFile.Close()
-			orderedLines = orderedLines[i:]
-			goto WAL
+	for _, f := range families {
+		opts, err := db.familyOptions(f.name, nil)
+		if err != nil {
+			return errors.Annotatef(err, "Invalid options for column family '%s'", f.name)
 		}
 
-		if n, err := wal.Write([]byte(l)); err != nil {
-			err = errors.Annotatef(err, "Could not write to WAL file '%s'", wal.refFile.Name())
+		if f.comparator != opts.Comparator.Name() {
+			return errors.Annotatef(ErrComparatorMismatch, "Column family '%s' written with comparator '%s', "+
+				"opened with '%s'", f.name, f.comparator, opts.Comparator.Name())
+		}
+
+		if db.families[f.id], err = db.newColumnFamily(f.id, f.name, opts); err != nil {
 			return err
-		} else {
-			accBytes += int64(n)
 		}
 	}
 
-	// Check for old WAL filesStats
-checkOldWAL:
-	orderedLines, n, err := contentOfFilesLessThanSizeAndWithFilenames(TEMP_PATH, WAL_PREFIX, math.MaxInt64)
-	if err != nil {
-		err = errors.Annotate(err, "Could not get content of small SSTable files")
-		return err
+	// Tables are opened by the table cache when they're read, but a missing one means that data was lost. Tables of
+	// dropped families aren't live anymore
+	for _, m := range live {
+		cf := db.families[m.family]
+		if cf == nil {
+			continue
+		}
+
+		if _, err = db.fs.Stat(tableFileName(db.storageFolder, m.number)); err != nil {
+			return errors.Annotatef(err, "Could not find live table %d of level %d", m.number, m.level)
+		}
+
+		cf.levels[m.level] = append(cf.levels[m.level], m)
+	}
+
+	for _, cf := range db.families {
+		for level := range cf.levels {
+			sortLevel(cf.opts.Comparator, level, cf.levels[level])
+		}
+	}
+
+	return
+}
+
+// skipFileNumbersOnDisk makes the file numbers found on disk but not logged yet, like the WAL of the last MemTable,
+// never be reused
+func (db *DB) skipFileNumbersOnDisk() error {
+	for _, folder := range []string{db.storageFolder, db.tempFolder} {
+		files, err := db.fs.List(folder)
+		if err != nil {
+			return errors.Annotatef(err, "Could not read folder %s", folder)
+		}
+
+		for _, name := range files {
+			if _, number, ok := parseFileName(name); ok && number >= db.nextFile {
+				db.nextFile = number + 1
+			}
+		}
 	}
 
-	if n >= MAX_SSTABLES_SIZE {
-		//Enough data to write another SSTable file
+	if db.nextFile == 0 {
+		db.nextFile = 1
 	}
 
-	// WAL filesStats found, join into the opened one and delete them
-	// Load indexes into memory
 	return nil
 }
 
-func contentOfFilesLessThanSizeAndWithFilenames(path, containing string, size int64) ([]string, int64, error) {
-	filesStats, err := ioutil.ReadDir(path)
+// replayWALs inserts into the MemTable the WAL files that aren't stored in tables yet, the ones numbered from
+// db.logNumber on. The WAL of the MemTable is synced after them, so they can be removed once the MANIFEST says that it
+// holds their records
+func (db *DB) replayWALs() (err error) {
+	files, err := db.fs.List(db.tempFolder)
 	if err != nil {
-		err = errors.Annotatef(err, "Could not read path '%s'", path)
-		return nil, 0, err
+		return errors.Annotatef(err, "Could not read folder %s", db.tempFolder)
+	}
+
+	// WAL files can be replayed in any order because the MemTable keeps the entry with the highest sequence number
+	// of each key
+	for _, name := range files {
+		kind, number, ok := parseFileName(name)
+		if !ok || kind != walFileKind || number < db.logNumber || number == db.mem.number {
+			continue
+		}
+
+		log.Infof("Indexing WAL file '%s' into MemTable", name)
+
+		if err = readWALFileToMemTable(db.fs, walFileName(db.tempFolder, number), db.mem); err != nil {
+			return
+		}
+	}
+
+	// The MemTable of a read-only DB has no WAL to sync, its records are only kept in memory
+	if err = db.mem.Sync(); err != nil {
+		return errors.Annotate(err, "Could not store the records of the old WAL files")
+	}
+
+	return
+}
+
+// removeObsoleteFiles deletes the tables that aren't live, like the outputs of a flush or a compaction interrupted by
+// a crash or the tables of dropped column families, the WAL files already stored in tables, the previous MANIFEST
+// files and a CURRENT file that was never completed. Only numbers below 'issued', the next file number logged in the
+// MANIFEST, are removed: files with higher ones weren't given by the DB, or not logged yet, so they could belong to
+// someone else. It must be called when opening the DB, before any flush or compaction runs
+func (db *DB) removeObsoleteFiles(issued uint64) {
+	live := make(map[uint64]bool)
+	for _, cf := range db.families {
+		for _, tables := range cf.levels {
+			for _, m := range tables {
+				live[m.number] = true
+			}
+		}
 	}
 
-	//Get content of SSTables which are too small
-	var totalContentSize int64
-	content := make([]string, 0)
-	for _, cf := range filesStats {
-		if cf.Size() != 0 && cf.Size() < MAX_SSTABLES_SIZE {
-			f, err := os.Open(cf.Name())
-			if err != nil {
-				log.WithError(err).Error("Could not read table file")
+	remove := func(name string) {
+		log.Warnf("Removing obsolete file '%s'", name)
+		if err := db.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Errorf("Error deleting file '%s'", name)
+		}
+	}
+
+	for _, folder := range []string{db.storageFolder, db.tempFolder} {
+		files, err := db.fs.List(folder)
+		if err != nil {
+			log.WithError(err).Errorf("Could not read folder %s", folder)
+			continue
+		}
+
+		for _, base := range files {
+			name := filepath.Join(folder, base)
+			if folder == db.storageFolder && base == CURRENT_FILE+TEMP_FILE_EXT {
+				remove(name)
 				continue
 			}
 
-			ls, n, _ := readFileLineByLine(f)
-			if err != nil {
-				log.WithError(err).Errorf("Error reading content of file '%s'", cf.Name())
+			kind, number, ok := parseFileName(base)
+			if !ok || number >= issued {
 				continue
 			}
 
-			totalContentSize += n
-			content = append(content, ls...)
+			switch {
+			case kind == tableFileKind && folder == db.storageFolder && !live[number] && number != db.mem.number:
+				remove(name)
+			case kind == walFileKind && folder == db.tempFolder && number < db.logNumber:
+				remove(name)
+			case kind == manifestFileKind && folder == db.storageFolder && number != db.manifest.number:
+				remove(name)
+			}
 		}
 	}
-
-	return content, totalContentSize, nil
 }
@@ -0,0 +1,168 @@
+package doom
+
+import (
+	"container/list"
+	"github.com/juju/errors"
+	"github.com/thehivecorporation/log"
+	"sync"
+	"sync/atomic"
+)
+
+// tableCache keeps up to a number of SSTables open, with their index and filter loaded, and closes the least recently
+// used when it needs room for another one. Tables are found by file number, which is unique in the DB, so the tables of
+// every column family share the cache. A table taken from the cache stays open until it's released, even if it's
+// evicted meanwhile, so evictions never close a table that is being read
+type tableCache struct {
+	fs       FS
+	folder   string
+	blocks   *blockCache
+	capacity int
+
+	// filters counts the lookups answered by the filters of every table of the cache
+	filters FilterStats
+
+	mu    sync.Mutex
+	items map[uint64]*list.Element
+	lru   *list.List
+}
+
+// cachedTable is an open table of the cache. The cache holds one reference while the table is in it and every user
+// holds another one until it calls release
+type cachedTable struct {
+	*SSTable
+	number uint64
+	refs   int32
+}
+
+// newTableCache returns a cache of up to 'capacity' open tables of 'folder' of 'fs' that keep their blocks in 'blocks'
+func newTableCache(fs FS, folder string, capacity int, blocks *blockCache) *tableCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &tableCache{
+		fs:       fs,
+		folder:   folder,
+		blocks:   blocks,
+		capacity: capacity,
+		items:    make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the table numbered 'number', written with 'cmp', opening it if it isn't in the cache. It must be released
+// after use. Tables are opened with the cache locked, so the same file is never opened twice
+func (c *tableCache) get(number uint64, cmp Comparator) (t *cachedTable, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[number]; ok {
+		c.lru.MoveToFront(el)
+		t = el.Value.(*cachedTable)
+		atomic.AddInt32(&t.refs, 1)
+		return
+	}
+
+	sst, err := openSSTable(c.fs, tableFileName(c.folder, number), c.blocks, cmp)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Could not open table %d", number)
+	}
+
+	sst.filterStats = &c.filters
+	t = &cachedTable{SSTable: sst, number: number, refs: 2}
+	c.items[number] = c.lru.PushFront(t)
+
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+
+	return
+}
+
+// release gives back a table taken from the cache, and closes it if it was evicted and this was its last user
+func (t *cachedTable) release() {
+	if atomic.AddInt32(&t.refs, -1) == 0 {
+		if err := t.Close(); err != nil {
+			log.WithError(err).Errorf("Error closing SSTable '%s'", t.Name())
+		}
+	}
+}
+
+// evict removes the table numbered 'number' from the cache, usually because its file is deleted. It's closed once
+// its current users release it
+func (c *tableCache) evict(number uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[number]; ok {
+		c.remove(el)
+	}
+}
+
+// remove drops the reference of the cache to a table. Must be called with c.mu held
+func (c *tableCache) remove(el *list.Element) {
+	t := c.lru.Remove(el).(*cachedTable)
+	delete(c.items, t.number)
+	t.release()
+}
+
+// len returns the number of tables in the cache
+func (c *tableCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// close evicts every table. Tables that are still in use are closed when they're released
+func (c *tableCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// tableMeta opens the table numbered 'number', written with 'cmp', through the cache and reads the metadata that places
+// it in 'level'
+func (c *tableCache) tableMeta(number uint64, level int, cmp Comparator) (m *tableMeta, err error) {
+	t, err := c.get(number, cmp)
+	if err != nil {
+		return
+	}
+	defer t.release()
+
+	stat, err := t.f.Stat()
+	if err != nil {
+		return nil, errors.Annotatef(err, "Could not stat sstable file '%s'", t.Name())
+	}
+
+	m = &tableMeta{
+		level:  level,
+		number: number,
+		size:   stat.Size(),
+		maxSeq: t.MaxSequence(),
+	}
+
+	if len(t.index) == 0 {
+		return
+	}
+
+	first, err := t.readDataBlock(t.index[0].handle, false)
+	if err != nil || len(first) == 0 {
+		return nil, errors.Annotatef(ErrCorruptedSSTable, "Could not read the first block of sstable file '%s'",
+			t.Name())
+	}
+
+	// The key of the last index entry can be past the last key of the table, so it's read from its block
+	last, err := t.readDataBlock(t.index[len(t.index)-1].handle, false)
+	if err != nil || len(last) == 0 {
+		return nil, errors.Annotatef(ErrCorruptedSSTable, "Could not read the last block of sstable file '%s'",
+			t.Name())
+	}
+
+	m.smallest, m.largest = first[0].Key, last[len(last)-1].Key
+
+	return
+}
@@ -0,0 +1,74 @@
+package doom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTableCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, &Options{MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Fewer tables than the compaction trigger, so all of them stay in level 0
+	const tables = 3
+	for i := 0; i < tables; i++ {
+		db.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value %d", i)))
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("open tables bounded", func(t *testing.T) {
+		for round := 0; round < 2; round++ {
+			for i := 0; i < tables; i++ {
+				value, err := db.Get(fmt.Sprintf("key%d", i))
+				if err != nil || string(value) != fmt.Sprintf("value %d", i) {
+					t.Fatalf("Unexpected value '%s' of key%d (%v)", value, i, err)
+				}
+			}
+		}
+
+		if n := db.tables.len(); n != 2 {
+			t.Errorf("Expected 2 open tables, got %d", n)
+		}
+	})
+
+	t.Run("iterators keep evicted tables open", func(t *testing.T) {
+		it := db.NewIterator(nil)
+		defer it.Close()
+
+		n := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			n++
+		}
+
+		if n != tables || it.Error() != nil {
+			t.Errorf("Expected %d keys, got %d (%v)", tables, n, it.Error())
+		}
+	})
+
+	t.Run("evicted table closed when released", func(t *testing.T) {
+		table, err := db.tables.get(db.defaultCF.levels[0][0].number, BytewiseComparator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db.tables.evict(table.number)
+		if _, err = table.Get("key0"); err != nil {
+			t.Errorf("Expected the table to be readable until it's released: %v", err)
+		}
+
+		table.release()
+		if _, err = table.f.Stat(); err == nil {
+			t.Error("Expected the table to be closed")
+		}
+	})
+}
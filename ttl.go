@@ -0,0 +1,40 @@
+package doom
+
+import "time"
+
+// Values written with a TTL carry the time when they expire, so it's persisted with them in the WAL and the
+// SSTables. Reads hide expired values as if they were deleted and compaction turns them into tombstones, which are
+// dropped like any other
+
+// PutWithTTL adds the write of 'value' for 'key' to the batch. The value expires 'ttl' after the call, or right away
+// if 'ttl' isn't positive
+func (b *WriteBatch) PutWithTTL(key string, value []byte, ttl time.Duration) {
+	b.PutWithTTLCF(nil, key, value, ttl)
+}
+
+// PutWithTTLCF is PutWithTTL on the column family 'cf'
+func (b *WriteBatch) PutWithTTLCF(cf *ColumnFamily, key string, value []byte, ttl time.Duration) {
+	e := &Entry{Data: value, ExpiresAt: expiresAt(ttl)}
+	b.add(cf, RECORD_EXPIRING_VALUE, key, encodeValue(e))
+}
+
+// PutWithTTL writes 'value' for 'key', which is reported as not found once 'ttl' has passed
+func (db *DB) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	var b WriteBatch
+	b.PutWithTTL(key, value, ttl)
+
+	return db.Write(&b)
+}
+
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return time.Now().UnixNano()
+	}
+
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// isExpired returns true if 'e' is a value that expired at or before 'now', in unix nanoseconds
+func isExpired(e *Entry, now int64) bool {
+	return !e.Tombstone && e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
@@ -0,0 +1,132 @@
+package doom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	fs := NewMemFS()
+	db, err := Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("a", []byte("older value"))
+	db.PutWithTTL("a", []byte("expiring"), time.Millisecond)
+	db.PutWithTTL("b", []byte("lasting"), time.Hour)
+	db.PutWithTTL("c", []byte("expired"), 0)
+	db.Put("d", []byte("value"))
+	db.PutWithTTL("e", []byte("expiring later"), 200*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	check := func(t *testing.T, db *DB, expected map[string]string) {
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			value, err := db.Get(key)
+			if v, ok := expected[key]; !ok && err != ErrNotFound {
+				t.Errorf("Expected '%s' to be expired, got '%s' (%v)", key, value, err)
+			} else if ok && string(value) != v {
+				t.Errorf("Expected '%s' for '%s', got '%s' (%v)", v, key, value, err)
+			}
+		}
+
+		keys := make([]string, 0)
+		it := db.NewIterator(nil)
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		reversed := make([]string, 0)
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			reversed = append([]string{it.Key()}, reversed...)
+		}
+		it.Close()
+
+		if len(keys) != len(expected) || strings.Join(keys, ",") != strings.Join(reversed, ",") {
+			t.Errorf("Expected the iterator to return the %d keys of %v in both directions, got %v and %v",
+				len(expected), expected, keys, reversed)
+		}
+	}
+
+	t.Run("expired keys hidden", func(t *testing.T) {
+		check(t, db, map[string]string{"b": "lasting", "d": "value", "e": "expiring later"})
+	})
+
+	// The first reopen replays the WAL, the second reads the table written by the flush
+	t.Run("expiry survives a restart", func(t *testing.T) {
+		db.Close()
+		if db, err = Open("/db", &Options{FS: fs}); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		time.Sleep(200 * time.Millisecond)
+		if db, err = Open("/db", &Options{FS: fs}); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		check(t, db, map[string]string{"b": "lasting", "d": "value"})
+	})
+}
+
+func TestTTLCompaction(t *testing.T) {
+	db, err := Open("/db", &Options{FS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for round := 0; round < DEFAULT_L0_COMPACTION_TRIGGER; round++ {
+		for i := 0; i < 20; i++ {
+			db.Put(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value %d", round)))
+			db.PutWithTTL(fmt.Sprintf("session%02d", i), []byte("data"), time.Millisecond)
+		}
+
+		// Every value with a TTL has expired before its table is flushed and compacted
+		time.Sleep(5 * time.Millisecond)
+		if err = db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForCompactions(t, db)
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(db.defaultCF.levels[0]) >= DEFAULT_L0_COMPACTION_TRIGGER {
+		t.Fatalf("Level 0 wasn't compacted, it has %d tables", len(db.defaultCF.levels[0]))
+	}
+
+	keys := 0
+	for level, tables := range db.defaultCF.levels {
+		for _, m := range tables {
+			table, err := db.tables.get(m.number, BytewiseComparator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			es, err := table.Entries()
+			table.release()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range es {
+				if strings.HasPrefix(e.Key, "session") && level > 0 {
+					t.Errorf("Expected expired key '%s' to be dropped from level %d", e.Key, level)
+				} else if strings.HasPrefix(e.Key, "key") {
+					keys++
+				}
+			}
+		}
+	}
+
+	if keys < 20 {
+		t.Errorf("Expected every key without a TTL to be kept, found %d entries", keys)
+	}
+}
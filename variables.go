@@ -1,6 +0,0 @@
-package doom
-
-var MAX_SSTABLES_SIZE int64 = 2048
-var SORT_ON_INSERTION = true
-var STORAGE_PATH = "/tmp"
-var TEMP_PATH = "/tmp"
@@ -1,45 +1,52 @@
 package doom
 
 import (
-	"bufio"
-	"fmt"
-	"github.com/gogo/protobuf/proto"
 	"github.com/juju/errors"
 	"github.com/thehivecorporation/log"
 	"io"
-	"io/ioutil"
-	"os"
 	"sort"
-	"strings"
 )
 
-func NewWAL() (*wal, error) {
-	walFile, err := ioutil.TempFile(TEMP_PATH, WAL_PREFIX)
+// NewWAL creates a WAL file in 'folder' of 'fs'
+func NewWAL(fs FS, folder string) (*wal, error) {
+	walFile, err := createTempFile(fs, folder, WAL_PREFIX)
 	if err != nil {
 		err = errors.Annotate(err, "Error creating file for WAL")
 	}
 
-	return &wal{walFile}, err
+	return &wal{fs: fs, refFile: walFile}, err
 }
 
 type wal struct {
-	refFile *os.File
+	fs      FS
+	refFile File
 }
 
+// Write appends raw bytes to the WAL file. They must be framed records
 func (w *wal) Write(p []byte) (n int, err error) {
-	return w.refFile.Write(append(p, '\n'))
+	return w.refFile.Write(p)
 }
 
-//Persist should flush the ordered content of a WAL file to disk
-func (w *wal) Persist() (fs []string, err error) {
+// Append frames 'e' as a record and writes it to the WAL file
+func (w *wal) Append(e *Entry) (n int, err error) {
+	return w.Write(encodeRecord(e))
+}
+
+//Persist should flush the ordered content of a WAL file to disk, in tables of 'folder', on the FS of the WAL, of the
+//size set in 'o', which can be nil to take the defaults
+func (w *wal) Persist(folder string, o *Options) (fs []string, err error) {
 	fs = make([]string, 0)
 
+	if o, err = o.validate(); err != nil {
+		return
+	}
+
 	s, _ := w.refFile.Stat()
 	log.WithField("size", s.Size()).Debug("Flusing WAL file")
 
-	lines, _, err := readFileLineByLine(w.refFile)
+	entries, _, err := readRecords(w.refFile)
 	if err != nil {
-		err = errors.Annotate(err, "Error trying to read lines from file")
+		err = errors.Annotate(err, "Error trying to read records from file")
 		return
 	}
 
@@ -47,160 +54,122 @@ func (w *wal) Persist() (fs []string, err error) {
 		log.WithError(err).Errorf("Error closing '%s' file", w.refFile.Name())
 	}
 
-	sort.Strings(lines)
-	log.WithField("lines", len(lines)).Debug("Total lines found")
+	entries = latestEntriesByKey(o.Comparator, o.MergeOperator, entries)
+	log.WithField("records", len(entries)).Debug("Total records found")
 
-	var lastLineWritten int
+	var lastEntryWritten int
 
 startFlush:
 
-	//Now we need to store the contents of the slice and create an index with its keys plus their offsets
-	ssTableFile, err := ioutil.TempFile(STORAGE_PATH, SSTABLES_PREFIX)
+	//Now we need to store the contents of the slice in a table that carries the index of its own blocks
+	ssTableFile, err := createTempFile(w.fs, folder, SSTABLES_PREFIX)
 	if err != nil {
-		err = errors.Annotatef(err, "Could not create sstable file on '%s' to write WAL file to", STORAGE_PATH)
+		err = errors.Annotatef(err, "Could not create sstable file on '%s' to write WAL file to", folder)
+		return
 	}
 	log.WithField("name", ssTableFile.Name()).Debug("File created")
-	defer ssTableFile.Close()
 	fs = append(fs, ssTableFile.Name())
 
-	// Create an index object
-	indexFilename := fileNameBasedOnTempFile(ssTableFile.Name(), STORAGE_PATH, SSTABLES_PREFIX, INDEX_PREFIX)
-	sstableIndex := SSTableIndex{
-		Indices: make([]*SSTableSingleIndex, 0),
-	}
-
-	//Iterate over each line from WAL to create an index entry and write the contents to the SSTable file
-	var accBytes int64
-	var n int
-	for i := lastLineWritten; i < len(lines); i++ {
-
-		if accBytes >= MAX_SSTABLES_SIZE {
-			//We need to create a new SSTable and Index files
+	//Iterate over each record from WAL adding it to the table until the table is big enough
+	table := newSSTableWriter(ssTableFile, o.tableOptions(0))
+	for ; lastEntryWritten < len(entries); lastEntryWritten++ {
+		if table.Size() >= o.TableFileSize {
+			//We need to create a new SSTable file
 			break
 		}
 
-		// Write to in-memory index
-		writeStringToSSTableIndex(lines[i], &sstableIndex, accBytes, indexFilename)
-
-		// Write to the SSTable file too
-		if n, err = writeStringToSSTableDisk(lines[i], ssTableFile); err != nil {
-			err = errors.Annotatef(err, "Could not write Index and SSTable files")
-			removeFiles(indexFilename, ssTableFile.Name())
+		if err = table.Add(entries[lastEntryWritten]); err != nil {
+			err = errors.Annotate(err, "Could not write SSTable file. Aborting. Removing sstable files, leaving WAL")
+			ssTableFile.Close()
+			removeFiles(w.fs, fs...)
 			return
 		}
-
-		accBytes += int64(n)
-		lastLineWritten = i
 	}
 
-	lastLineWritten++
+	if err = table.Finish(); err != nil {
+		err = errors.Annotate(err, "Could not write SSTable file. Aborting. Removing sstable files, leaving WAL")
+		ssTableFile.Close()
+		removeFiles(w.fs, fs...)
+		return
+	}
 
 	//Close SSTable file
 	if err := ssTableFile.Close(); err != nil {
 		log.WithError(err).Errorf("Error closing SStable file '%s'", ssTableFile.Name())
 	}
 
-	//Write index to disk and close it
-	if err = writeSSTableIndexToDisk(&sstableIndex, indexFilename); err != nil {
-		err = errors.Annotate(err, "Could not write index to disk")
-		removeFiles(append(fs, indexFilename)...)
-		return
-	}
-
-	//Create a new file if more lines are left
-	if lastLineWritten < len(lines) {
+	//Create a new file if more records are left
+	if lastEntryWritten < len(entries) {
 		goto startFlush
 	}
 
-	//Finally, delete the WAL file. It is already stored as sstable and has an index file associated
+	//Finally, delete the WAL file. It is already stored as sstable files
 	log.WithField("name", w.refFile.Name()).Debug("Removing WAL file")
-	if err := os.Remove(w.refFile.Name()); err != nil {
+	if err = w.fs.Remove(w.refFile.Name()); err != nil {
 		err = errors.Annotate(err, "Could not delete WAL file")
 	}
 
 	return
 }
 
-func removeFiles(fs ...string) {
-	for _, f := range fs {
-		if err := os.Remove(f); err != nil {
-			log.WithError(err).Errorf("Error deleting file '%s'", f)
-		}
-	}
-}
+//latestEntriesByKey sorts the records of a WAL by key, in the order of 'cmp', keeping only the one with the highest
+//sequence number for each key, so that a tombstone isn't shadowed by the value it deleted. Merge operands on top of a
+//key are collapsed with 'op' into the newest version below them that isn't an operand, like in a flush. Without an
+//operator they're kept as they are, together with that version
+func latestEntriesByKey(cmp Comparator, op MergeOperator, es []*Entry) []*Entry {
+	sort.Slice(es, func(i, j int) bool {
+		return compareEntries(cmp, es[i], es[j]) < 0
+	})
 
-func writeSSTableIndexToDisk(index *SSTableIndex, indexFilename string) (err error) {
-	var indexFile *os.File
-	indexFile, err = os.Create(indexFilename)
-	if err != nil {
-		err = errors.Annotatef(err, "Could not create index file '%s'", indexFilename)
-		return
-	}
-	log.WithField("name", indexFile.Name()).Debug("File created")
-	defer indexFile.Close()
-
-	var byt []byte
-	if byt, err = proto.Marshal(index); err != nil {
-		err = errors.Annotatef(err, "Cannot marshal indices into bytes")
-	} else {
-		if _, err = indexFile.Write(byt); err != nil {
-			err = errors.Annotatef(err, "Could not write to index file '%s'", indexFile.Name())
+	m := &versionMerger{op: op}
+	latest := make([]*Entry, 0, len(es))
+	for i := 0; i < len(es); {
+		j := i + 1
+		for j < len(es) && es[j].Key == es[i].Key {
+			j++
 		}
-	}
-
-	return
-}
 
-func writeStringToSSTableDisk(line string, sstableFile *os.File) (n int, err error) {
-	if n, err = sstableFile.WriteString(line); err != nil {
-		err = errors.Annotatef(err, "Error writing line '%s' to sstable file. Aborting. Removing index and sstable file, leaving WAL")
-
-		defer os.Remove(sstableFile.Name())
+		if es[i].Merge {
+			latest = append(latest, m.collapse(es[i:j], true)...)
+		} else {
+			latest = append(latest, es[i])
+		}
+		i = j
 	}
 
-	return
+	return latest
 }
 
-func writeStringToSSTableIndex(line string, index *SSTableIndex, accBytes int64, indexFileName string) {
-	index.Indices = append(index.Indices, &SSTableSingleIndex{
-		Key:      getKey(line),
-		Offset:   accBytes,
-		FileName: indexFileName,
-	})
-}
-
-//readFileLineByLine returns an slice with the contents of the file divided by line
-func readFileLineByLine(f io.ReadSeeker) (ls []string, size int64, err error) {
+//readRecords returns the records stored in a WAL file. A torn record at the end of the file is the
+//trace of an interrupted write so it's discarded, keeping everything before it. Corruption anywhere else is an error
+func readRecords(f io.ReadSeeker) (es []*Entry, size int64, err error) {
 	//Return to beginning of file to start reading
 	if _, err = f.Seek(0, 0); err != nil {
 		err = errors.Annotate(err, "Error seeking beginning of file")
 		return
 	}
 
-	reader := bufio.NewReader(f)
-	ls = make([]string, 0)
+	reader := newRecordReader(f)
+	es = make([]*Entry, 0)
 
-	var line string
+	var e *Entry
 	for {
-		line, err = reader.ReadString('\n')
-		if err != nil {
+		if e, err = reader.Next(); err != nil {
 			break
 		}
 
-		// Proper WAL lines has syntax 'key value\n' so the minimum possible characters to try insertion are four 'k v\n'
-		// Omit 'corrupted' line if it doesn't pass this check
-		if !(strings.Contains(line, " ") && len(line) > 4) {
-			continue
-		}
-
-		size += int64(len(line))
-		ls = append(ls, line)
+		size += e.Length
+		es = append(es, e)
 	}
 
-	if err != io.EOF {
-		fmt.Printf(" > Failed!: %v\n", err)
-	} else {
+	switch errors.Cause(err) {
+	case io.EOF:
+		err = nil
+	case ErrTornRecord:
+		log.WithError(err).Warnf("Discarding torn record after %d valid records", len(es))
 		err = nil
+	default:
+		err = errors.Annotatef(err, "Could not read records after %d valid ones", len(es))
 	}
 
 	return
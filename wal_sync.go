@@ -0,0 +1,55 @@
+package doom
+
+import (
+	"github.com/juju/errors"
+	"github.com/thehivecorporation/log"
+	"time"
+)
+
+// WriteOptions control how a write is committed
+type WriteOptions struct {
+	// Sync makes the write wait until the WAL is synced to stable storage, together with every write committed
+	// before it. Otherwise a power failure can lose the write, unless Options.WALSyncPolicy syncs it. A crash of the
+	// process alone never does
+	Sync bool
+}
+
+func checkWALSyncPolicy(policy string) error {
+	switch policy {
+	case WAL_SYNC_ALWAYS, WAL_SYNC_PERIODIC, WAL_SYNC_NEVER:
+		return nil
+	}
+
+	return errors.Errorf("Unknown WAL sync policy '%s'", policy)
+}
+
+// syncLoop syncs the WAL of the MemTable every Options.WALSyncInterval until the DB is closed, and a last time when it
+// is, so writes are on stable storage at most an interval after they are done with the WAL_SYNC_PERIODIC policy
+func (db *DB) syncLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.opts.WALSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		closing := false
+		select {
+		case <-db.closing:
+			closing = true
+		case <-ticker.C:
+		}
+
+		// The WAL of the immutable MemTable was synced when it was replaced
+		db.mu.RLock()
+		mem := db.mem
+		db.mu.RUnlock()
+
+		if err := mem.Sync(); err != nil {
+			log.WithError(err).Error("Error syncing WAL")
+		}
+
+		if closing {
+			return
+		}
+	}
+}
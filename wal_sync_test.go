@@ -0,0 +1,178 @@
+package doom
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// powerFailure closes 'db' and leaves the WAL of its MemTable as a power failure could: without the bytes that
+// weren't synced
+func powerFailure(t *testing.T, db *DB) {
+	mem := db.mem
+	mem.syncMu.Lock()
+	synced := mem.syncedSize
+	mem.syncMu.Unlock()
+
+	db.Close()
+
+	if err := os.Truncate(walFileName(db.tempFolder, mem.number), synced); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALSyncPolicies(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	// write returns the keys that must survive a power failure right after it
+	tests := []struct {
+		policy string
+		write  func(t *testing.T, db *DB) (synced, lost []string)
+	}{
+		{WAL_SYNC_ALWAYS, func(t *testing.T, db *DB) (synced, lost []string) {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key%d", i)
+				if err := db.Put(key, []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+				synced = append(synced, key)
+			}
+
+			return
+		}},
+		{WAL_SYNC_PERIODIC, func(t *testing.T, db *DB) (synced, lost []string) {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key%d", i)
+				if err := db.Put(key, []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+				synced = append(synced, key)
+			}
+
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				db.mem.syncMu.Lock()
+				done := db.mem.syncedSize == atomic.LoadInt64(&db.mem.walSize)
+				db.mem.syncMu.Unlock()
+
+				if done {
+					return
+				}
+				time.Sleep(interval)
+			}
+
+			t.Fatal("Expected the WAL to be synced in background")
+			return
+		}},
+		{WAL_SYNC_NEVER, func(t *testing.T, db *DB) (synced, lost []string) {
+			db.Put("a", []byte("value"))
+			db.Put("b", []byte("value"))
+
+			// A synced write syncs the ones before it too
+			var b WriteBatch
+			b.Put("c", []byte("value"))
+			if err := db.WriteWithOptions(&b, &WriteOptions{Sync: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			db.Put("d", []byte("value"))
+
+			return []string{"a", "b", "c"}, []string{"d"}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("/tmp", "doomdb")
+			defer os.RemoveAll(dir)
+
+			opts := &Options{WALSyncPolicy: test.policy, WALSyncInterval: interval}
+			db, err := Open(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			synced, lost := test.write(t, db)
+			powerFailure(t, db)
+
+			if db, err = Open(dir, opts); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for _, key := range synced {
+				if _, err := db.Get(key); err != nil {
+					t.Errorf("Expected '%s' to survive the power failure, got %v", key, err)
+				}
+			}
+
+			for _, key := range lost {
+				if _, err := db.Get(key); err != ErrNotFound {
+					t.Errorf("Expected '%s' to be lost, got %v", key, err)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown policy", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("/tmp", "doomdb")
+		defer os.RemoveAll(dir)
+
+		if _, err := Open(dir, &Options{WALSyncPolicy: "sometimes"}); errors.Cause(err) != ErrInvalidOptions {
+			t.Error("Expected an error with an unknown policy")
+		}
+	})
+}
+
+func TestGroupCommitSync(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "doomdb")
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The first writer takes its group and waits for db.mu while the rest queue behind it, so they're committed
+	// as a second group
+	const writers = 10
+	db.mu.Lock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var b WriteBatch
+			b.Put(fmt.Sprintf("key%d", i), []byte("value"))
+			if err := db.WriteWithOptions(&b, &WriteOptions{Sync: true}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	for queued := 0; queued < writers; time.Sleep(time.Millisecond) {
+		db.writeMu.Lock()
+		queued = len(db.writers)
+		db.writeMu.Unlock()
+	}
+
+	db.mu.Unlock()
+	wg.Wait()
+
+	if syncs := atomic.LoadInt64(&db.mem.syncs); syncs != 2 {
+		t.Errorf("Expected 2 syncs for %d writes, got %d", writers, syncs)
+	}
+
+	for i := 0; i < writers; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Unexpected error reading key%d: %v", i, err)
+		}
+	}
+}
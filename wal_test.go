@@ -3,175 +3,166 @@ package doom
 import (
 	"io/ioutil"
 	"os"
-	"strings"
 	"testing"
 )
 
-func TestReadFileLineByLine(t *testing.T) {
+func TestReadRecords(t *testing.T) {
 	f, _ := ioutil.TempFile("/tmp", "delete")
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	f.WriteString("Hello world\n")
+	f.Write(encodeRecord(&Entry{Key: "Hello", Data: []byte("world\nwith a new line")}))
 
-	longLine := make([]byte, 4096*1024)
-	longLine = append(longLine, " \n"...)
+	longValue := make([]byte, 4096*1024)
+	f.Write(encodeRecord(&Entry{Key: "long", Data: longValue}))
 
-	f.Write(longLine)
+	// A torn write at the end of the file must be discarded without losing the previous records
+	torn := encodeRecord(&Entry{Key: "torn", Data: []byte("value")})
+	f.Write(torn[:len(torn)-2])
 	f.Sync()
-	f.Seek(0, 0)
 
-	ls, _, err := readFileLineByLine(f)
+	es, _, err := readRecords(f)
 	if err != nil {
 		t.Fatalf("Unexpected error '%s'", err.Error())
 	}
 
-	if len(ls) != 2 {
-		t.Fatalf("Unexpected number of lines: '%d'", len(ls))
+	if len(es) != 2 {
+		t.Fatalf("Unexpected number of records: '%d'", len(es))
 	}
 
-	if ls[0] != "Hello world\n" {
-		t.Errorf("Unexpected first line '%s'", ls[0])
+	if es[0].Key != "Hello" || string(es[0].Data) != "world\nwith a new line" {
+		t.Errorf("Unexpected first record '%s'", es[0].String())
 	}
 
-	if ls[1] != string(longLine) {
-		t.Errorf("Unexpected second line")
+	if es[1].Key != "long" || len(es[1].Data) != len(longValue) {
+		t.Errorf("Unexpected second record")
 	}
 }
 
+func TestLatestEntriesByKey(t *testing.T) {
+	records := func() []*Entry {
+		return []*Entry{
+			{Key: "mario", Tombstone: true, Seq: 3},
+			{Key: "ula", Data: []byte("korn"), Seq: 2},
+			{Key: "sum", Data: []byte("2"), Merge: true, Seq: 7},
+			{Key: "mario", Data: []byte("caster"), Seq: 1},
+			{Key: "sum", Data: []byte("10"), Seq: 5},
+			{Key: "Hello", Data: []byte("world"), Seq: 4},
+			{Key: "sum", Data: []byte("3"), Merge: true, Seq: 6},
+			{Key: "sum", Data: []byte("1"), Seq: 0},
+		}
+	}
+
+	t.Run("merge operands are merged with the value below them", func(t *testing.T) {
+		es := latestEntriesByKey(BytewiseComparator, Int64AddOperator, records())
+
+		if len(es) != 4 {
+			t.Fatalf("Unexpected number of records: '%d'", len(es))
+		}
+
+		if es[0].Key != "Hello" || es[2].Key != "sum" || es[3].Key != "ula" {
+			t.Errorf("Unexpected order of records '%v'", es)
+		}
+
+		if !es[1].Tombstone {
+			t.Errorf("Expected a tombstone for key 'mario', got '%s'", es[1].String())
+		}
+
+		if es[2].Merge || string(es[2].Data) != "15" || es[2].Seq != 7 {
+			t.Errorf("Expected the value '15' for key 'sum', got '%s'", es[2].String())
+		}
+	})
+
+	t.Run("merge operands are kept without a merge operator", func(t *testing.T) {
+		es := latestEntriesByKey(BytewiseComparator, nil, records())
+
+		if len(es) != 6 {
+			t.Fatalf("Unexpected number of records: '%d'", len(es))
+		}
+
+		sum := es[2:5]
+		if !sum[0].Merge || sum[0].Seq != 7 || !sum[1].Merge || sum[1].Seq != 6 || sum[2].Merge || sum[2].Seq != 5 {
+			t.Errorf("Expected both operands of key 'sum' over its value, got '%v'", sum)
+		}
+	})
+}
+
 func TestPersist(t *testing.T) {
-	t.Run("asdfadf", func(t *testing.T) {
-		w, _ := NewWAL()
+	mem := NewMemFS()
 
-		//Remove the expected index and sstable files if they exist
+	t.Run("WAL is replaced by one table", func(t *testing.T) {
+		w, _ := NewWAL(mem, "/tmp")
 
-		w.Write([]byte("mario caster"))
-		w.Write([]byte("Hello world"))
-		w.Write([]byte("ula korn"))
+		w.Append(&Entry{Key: "mario", Data: []byte("caster")})
+		w.Append(&Entry{Key: "Hello", Data: []byte("world")})
+		w.Append(&Entry{Key: "ula", Data: []byte("korn")})
 
-		_, err := w.Persist()
+		_, err := w.Persist("/tmp", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
+
+		if names, _ := mem.List("/tmp"); len(names) != 1 {
+			t.Errorf("Expected the WAL file to be replaced by a table, found %v", names)
+		}
 	})
-	//
-	//t.Run("check index file", func(t *testing.T) {
-	//	f, _ := os.Open(expectedIndexFileName)
-	//	byt, _ := ioutil.ReadAll(f)
-	//	var indices SSTableIndex
-	//	if err := proto.Unmarshal(byt, &indices); err != nil {
-	//		t.Fatal(err)
-	//	}
-	//
-	//	if len(indices.Indices) != 3 {
-	//		t.Errorf("Expecting 3 items, got '%d'", len(indices.Indices))
-	//	}
-	//
-	//	if indices.Indices[0].Key != "Hello" {
-	//		t.Fail()
-	//	}
-	//
-	//	if indices.Indices[1].Key != "mario" {
-	//		t.Fail()
-	//	}
-	//
-	//	if indices.Indices[2].Key != "ula" {
-	//		t.Fail()
-	//	}
-	//})
-	//
-	//t.Run("check SSTable file", func(t *testing.T) {
-	//	fileNameBasedOnTempFile(expectedIndexFileName)
-	//	f, err := os.Open(expectedSSTableFileName)
-	//	if err != nil {
-	//		log.WithError(err).Error("Error reading expected SSTable file")
-	//		t.Fatal()
-	//	}
-	//
-	//	lines, _, err := readFileLineByLine(f)
-	//	if err != nil {
-	//		t.Fatal(err)
-	//	}
-	//
-	//	if len(lines) != 3 {
-	//		t.Fatalf("Number of lines expected in 3. Got '%d'", len(lines))
-	//	}
-	//
-	//	if lines[0] != "Hello world\n" {
-	//		t.Fail()
-	//	}
-	//
-	//	if lines[1] != "mario caster\n" {
-	//		t.Fail()
-	//	}
-	//
-	//	if lines[2] != "ula korn\n" {
-	//		t.Fail()
-	//	}
-	//})
 
 	t.Run("check that an big WAL file is splitted into two SSTable files", func(t *testing.T) {
-		w, _ := NewWAL()
+		w, _ := NewWAL(mem, "/tmp")
 
 		byt := make([]byte, 1024)
 		for i := 0; i < 1024; i++ {
 			byt[i] = byte(78)
 		}
-		byt[10] = ' '
-		byt[0] = 'A'
-
-		w.Write(byt)
 
-		byt[0] = 'B'
-		w.Write(byt)
+		w.Append(&Entry{Key: "A", Data: byt})
+		w.Append(&Entry{Key: "B", Data: byt})
+		w.Append(&Entry{Key: "C", Data: byt})
 
-		byt[0] = 'C'
-		w.Write(byt)
-
-		fs, err := w.Persist()
+		fs, err := w.Persist("/tmp", &Options{TableFileSize: 2048})
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer func() {
-			for _, s := range fs {
-				os.Remove(s)
-			}
-		}()
+		defer removeFiles(mem, fs...)
 
 		if len(fs) != 2 {
 			t.Fail()
 		}
 
-		t.Run("2 files must have been created in case of MAX_SSTABLES_SIZE=2048", func(t *testing.T) {
+		t.Run("2 files must have been created in case of TableFileSize=2048", func(t *testing.T) {
 			t.Run("file 1", func(t *testing.T) {
-				f, _ := os.Open(fs[0])
-
-				byt, _ := ioutil.ReadAll(f)
+				table, err := openSSTable(mem, fs[0], nil, BytewiseComparator)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer table.Close()
 
-				lines := strings.Split(strings.TrimSpace(string(byt)), "\n")
-				if len(lines) != 2 {
-					t.Fail()
+				es, _ := table.Entries()
+				if len(es) != 2 {
+					t.FailNow()
 				}
 
-				if lines[0][0] != 'A' {
+				if es[0].Key != "A" {
 					t.Fail()
 				}
-				if lines[1][0] != 'B' {
+				if es[1].Key != "B" {
 					t.Fail()
 				}
 			})
 
 			t.Run("file 2", func(t *testing.T) {
-				f, _ := os.Open(fs[1])
-
-				byt, _ := ioutil.ReadAll(f)
+				table, err := openSSTable(mem, fs[1], nil, BytewiseComparator)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer table.Close()
 
-				lines := strings.Split(strings.TrimSpace(string(byt)), "\n")
-				if len(lines) != 1 {
-					t.Fail()
+				es, _ := table.Entries()
+				if len(es) != 1 {
+					t.FailNow()
 				}
 
-				if lines[0][0] != 'C' {
+				if es[0].Key != "C" {
 					t.Fail()
 				}
 			})
@@ -0,0 +1,131 @@
+package doom
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// writer is a write, a flush or a change to the column families, made by 'apply', waiting in the queue of the DB
+type writer struct {
+	batch *WriteBatch
+	sync  bool
+	flush bool
+	apply func() error
+
+	done bool
+	err  error
+	cond *sync.Cond
+}
+
+// enqueue waits until 'w' is done by another writer or it reaches the front of the queue. The writer at the front
+// takes the batches of the writers behind it, up to Options.MaxWriteGroupSize bytes, and commits them as one record of
+// the WAL. Flushes and changes to the column families are never grouped
+func (db *DB) enqueue(w *writer) error {
+	w.cond = sync.NewCond(&db.writeMu)
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		w.cond.Wait()
+	}
+
+	if w.done {
+		return w.err
+	}
+
+	group := db.writeGroup()
+
+	// New writers can queue while the group is written
+	db.writeMu.Unlock()
+	var err error
+	if w.flush {
+		err = db.flush()
+	} else if w.apply != nil {
+		err = w.apply()
+	} else if err = db.makeRoomForWrite(false); err == nil {
+		err = db.commit(group)
+	}
+	db.writeMu.Lock()
+
+	for _, g := range group {
+		g.err, g.done = err, true
+		g.cond.Signal()
+	}
+
+	db.writers = db.writers[len(group):]
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+	}
+
+	return err
+}
+
+// writeGroup returns the writers at the front of the queue that are committed together. Must be called with
+// db.writeMu held
+func (db *DB) writeGroup() []*writer {
+	first := db.writers[0]
+	if first.flush || first.apply != nil {
+		return db.writers[:1]
+	}
+
+	size, n := first.batch.size(), 1
+	for ; n < len(db.writers); n++ {
+		w := db.writers[n]
+		if w.flush || w.apply != nil || size+w.batch.size() > db.opts.MaxWriteGroupSize {
+			break
+		}
+
+		size += w.batch.size()
+	}
+
+	return db.writers[:n]
+}
+
+// commit writes the batches of 'group' to the WAL and the MemTable and then makes them visible to reads. The WAL is
+// synced once for the whole group if the policy is WAL_SYNC_ALWAYS or any of its writers asked for it. It must only
+// be called by the writer at the front of the queue
+func (db *DB) commit(group []*writer) error {
+	b, mustSync := group[0].batch, db.opts.WALSyncPolicy == WAL_SYNC_ALWAYS
+	if len(group) > 1 {
+		b = &WriteBatch{}
+		for _, w := range group {
+			b.append(w.batch)
+		}
+	}
+
+	for _, w := range group {
+		mustSync = mustSync || w.sync
+	}
+
+	// After a failed write the WAL can end with part of a record, and after a failed sync it's unknown which records
+	// are on disk, so nothing else can be written to it
+	seq := atomic.LoadUint64(&db.seq) + 1
+	if err := db.mem.Apply(seq, b); err != nil {
+		db.stopWrites(err)
+		return err
+	}
+
+	if mustSync {
+		if err := db.mem.Sync(); err != nil {
+			db.stopWrites(err)
+			return err
+		}
+	}
+
+	atomic.StoreUint64(&db.seq, seq+uint64(b.Count())-1)
+
+	return nil
+}
+
+// stopWrites makes every write and flush from now on fail with 'err'
+func (db *DB) stopWrites(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bgErr == nil {
+		db.bgErr = err
+	}
+	db.bgCond.Broadcast()
+}